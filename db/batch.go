@@ -0,0 +1,338 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"health-monitoring/log"
+	"health-monitoring/types"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultQueueSize     = 10000
+	defaultBatchSize     = 500
+	defaultBatchInterval = time.Second
+
+	// Time allowed to insert one batch.
+	batchFlushTimeout = 10 * time.Second
+	// Interval of trying to replay the spool, or checking the store after it became
+	// unavailable without a spool.
+	recoverInterval = 5 * time.Second
+)
+
+var (
+	ErrWriteQueueFull = errors.New("write queue of device info is full")
+	ErrWriterClosed   = errors.New("writer of device info is closed")
+	ErrNotConfirmed   = errors.New("device info is queued but not written yet")
+)
+
+// BatchWriter queues the samples added by AddDeviceInfo and inserts them into the store in
+// batches, when the batch is full or the interval has passed since the last insertion.
+// The other methods go to the store directly.
+//
+// The queue is bounded, AddDeviceInfo blocks while it is full until its context is done,
+// so that slow inserts slow down the devices instead of exhausting the memory. A sample
+// takes one place in the queue with the samples of its GPUs, it is queued whole or not at
+// all. Samples queued but not inserted yet are not returned by the queries.
+//
+// With a spool, AddDeviceInfo returns only after the batch of the sample is inserted or
+// appended to the spool and synced to the disk, so that an acknowledged sample survives a
+// crash. The batches failed to insert are appended to the spool instead of being dropped. While the spool is not empty, the batches go to the spool after the spooled ones,
+// and the spool is replayed periodically, so that the samples are inserted in the order they
+// are added once the store is back. Every sample passes the queue, a sample queued before
+// the spool became pending is never appended after a later one. Without a spool,
+// AddDeviceInfo returns ErrStoreUnavailable after an insertion failed with it, until the
+// store can be pinged again.
+type BatchWriter struct {
+	Store
+	queue     chan queuedSample
+	batchSize int
+	interval  time.Duration
+	spool     *Spool
+	down      atomic.Bool // 没有暂存时，存储不可用导致写入失败
+	closed    bool
+	mutex     sync.RWMutex // senders hold the read lock, so that the queue is closed after them
+	stopped   chan struct{}
+
+	queueDepth    prometheus.GaugeFunc
+	flushDuration prometheus.Histogram
+	flushedTotal  prometheus.Counter
+	droppedTotal  prometheus.Counter
+	spoolBytes    prometheus.GaugeFunc
+	spooledTotal  prometheus.Counter
+	replayedTotal prometheus.Counter
+}
+
+// queuedSample is a sample in the queue with the samples of its GPUs. The result of writing
+// it is sent to done if it is not nil.
+type queuedSample struct {
+	infos []types.MDBDeviceInfo // 整机和各个 GPU 的记录
+	done  chan error
+}
+
+// NewBatchWriter starts the writer, the spool is closed and the store is disconnected by
+// the writer after Disconnect once the queued samples are inserted. Zero options take the default values, and a nil
+// spool drops the batches failed to insert.
+func NewBatchWriter(store Store, queueSize, batchSize int, interval time.Duration, spool *Spool) *BatchWriter {
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
+	}
+	if batchSize <= 0 {
+		batchSize = defaultBatchSize
+	}
+	if interval <= 0 {
+		interval = defaultBatchInterval
+	}
+	w := &BatchWriter{
+		Store:     store,
+		queue:     make(chan queuedSample, queueSize),
+		batchSize: batchSize,
+		interval:  interval,
+		spool:     spool,
+		stopped:   make(chan struct{}),
+		flushDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "device_info_flush_duration_seconds",
+			Help:    "duration of inserting one batch of device info",
+			Buckets: prometheus.DefBuckets,
+		}),
+		flushedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "device_info_flushed_total",
+			Help: "number of device info samples inserted by batches",
+		}),
+		droppedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "device_info_dropped_total",
+			Help: "number of device info samples dropped because the insertion failed",
+		}),
+		spooledTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "device_info_spooled_total",
+			Help: "number of device info samples appended to the spool",
+		}),
+		replayedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "device_info_replayed_total",
+			Help: "number of device info samples inserted by replaying the spool",
+		}),
+	}
+	w.queueDepth = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "device_info_queue_depth",
+		Help: "number of device info samples waiting in the write queue",
+	}, func() float64 {
+		return float64(len(w.queue))
+	})
+	w.spoolBytes = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "device_info_spool_bytes",
+		Help: "size of the device info samples waiting in the spool",
+	}, func() float64 {
+		if w.spool == nil {
+			return 0
+		}
+		return float64(w.spool.Size())
+	})
+	go w.run()
+	return w
+}
+
+// Collectors returns the metrics of the writer to be registered.
+func (w *BatchWriter) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		w.queueDepth, w.flushDuration, w.flushedTotal, w.droppedTotal,
+		w.spoolBytes, w.spooledTotal, w.replayedTotal,
+	}
+}
+
+// QueueStatus returns the number of samples waiting in the queue, the capacity of the queue
+// and the size of the samples waiting in the spool.
+func (w *BatchWriter) QueueStatus() (depth, capacity int, spoolBytes int64) {
+	if w.spool != nil {
+		spoolBytes = w.spool.Size()
+	}
+	return len(w.queue), cap(w.queue), spoolBytes
+}
+
+func (w *BatchWriter) AddDeviceInfo(ctx context.Context, nodeId string, tm time.Time, info types.WsMachineInfoRequest) error {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	if w.closed {
+		return ErrWriterClosed
+	}
+	infos := newDeviceInfos(nodeId, tm, info)
+	if w.down.Load() {
+		return ErrStoreUnavailable
+	}
+	sample := queuedSample{infos: infos}
+	if w.spool != nil {
+		sample.done = make(chan error, 1)
+	}
+	select {
+	case w.queue <- sample:
+	case <-ctx.Done():
+		return fmt.Errorf("%w: %v", ErrWriteQueueFull, ctx.Err())
+	}
+	if sample.done == nil {
+		return nil
+	}
+	// The sample is written later even if the context is done first, the device should
+	// not take it as lost
+	select {
+	case err := <-sample.done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("%w: %v", ErrNotConfirmed, ctx.Err())
+	}
+}
+
+// run inserts the queued samples in batches until the queue is closed and drained, then
+// closes the spool and disconnects the store, so that they are never closed under a
+// running insert.
+func (w *BatchWriter) run() {
+	defer close(w.stopped)
+	defer w.close()
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	recoverTicker := time.NewTicker(recoverInterval)
+	defer recoverTicker.Stop()
+	batch := make([]queuedSample, 0, w.batchSize)
+	size := 0 // 当前批次的记录数
+	for {
+		select {
+		case sample, ok := <-w.queue:
+			if !ok {
+				w.flush(batch)
+				return
+			}
+			batch = append(batch, sample)
+			size += len(sample.infos)
+			if size >= w.batchSize {
+				w.flush(batch)
+				batch = batch[:0]
+				size = 0
+			}
+		case <-ticker.C:
+			w.flush(batch)
+			batch = batch[:0]
+			size = 0
+		case <-recoverTicker.C:
+			w.replay()
+			w.checkStore()
+		}
+	}
+}
+
+// flush inserts the samples of the batch and sends the result to the waiting senders.
+func (w *BatchWriter) flush(batch []queuedSample) {
+	if len(batch) == 0 {
+		return
+	}
+	infos := make([]types.MDBDeviceInfo, 0, len(batch))
+	for _, sample := range batch {
+		infos = append(infos, sample.infos...)
+	}
+	err := w.insert(infos)
+	for _, sample := range batch {
+		if sample.done != nil {
+			sample.done <- err
+		}
+	}
+}
+
+// insert writes the samples to the store or the spool, nil is returned once they are
+// inserted or spooled.
+func (w *BatchWriter) insert(infos []types.MDBDeviceInfo) error {
+	if w.spool != nil && w.spool.Pending() {
+		// Samples go after the spooled ones until the spool is replayed
+		return w.appendSpool(infos)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), batchFlushTimeout)
+	defer cancel()
+	start := time.Now()
+	err := w.Store.AddDeviceInfos(ctx, infos)
+	w.flushDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		log.Log.Errorf("Flush %v device infos failed: %v", len(infos), err)
+		if w.spool != nil {
+			return w.appendSpool(infos)
+		}
+		w.droppedTotal.Add(float64(len(infos)))
+		if errors.Is(err, ErrStoreUnavailable) {
+			w.down.Store(true)
+		}
+		return err
+	}
+	w.flushedTotal.Add(float64(len(infos)))
+	return nil
+}
+
+// appendSpool appends the samples to the spool, they are dropped if it fails.
+func (w *BatchWriter) appendSpool(infos []types.MDBDeviceInfo) error {
+	if err := w.spool.Append(infos); err != nil {
+		log.Log.Errorf("Spool %v device infos failed: %v", len(infos), err)
+		w.droppedTotal.Add(float64(len(infos)))
+		return err
+	}
+	w.spooledTotal.Add(float64(len(infos)))
+	return nil
+}
+
+// replay inserts the spooled samples until the spool is empty or the store fails again.
+func (w *BatchWriter) replay() {
+	if w.spool == nil || !w.spool.Pending() {
+		return
+	}
+	n, err := w.spool.Replay(context.Background(), w.batchSize, func(ctx context.Context, infos []types.MDBDeviceInfo) error {
+		ctx, cancel := context.WithTimeout(ctx, batchFlushTimeout)
+		defer cancel()
+		return w.Store.AddDeviceInfos(ctx, infos)
+	})
+	w.replayedTotal.Add(float64(n))
+	if err != nil {
+		log.Log.Warnf("Replay the spool stopped after %v device infos: %v", n, err)
+	} else if n != 0 {
+		log.Log.Infof("Replayed %v device infos from the spool", n)
+	}
+}
+
+// checkStore accepts samples again once the unavailable store can be pinged.
+func (w *BatchWriter) checkStore() {
+	if !w.down.Load() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), batchFlushTimeout)
+	defer cancel()
+	if err := w.Store.Ping(ctx); err == nil {
+		log.Log.Info("Storage is available, accept device infos again")
+		w.down.Store(false)
+	}
+}
+
+// close closes the spool and disconnects the store after run has stopped inserting.
+func (w *BatchWriter) close() {
+	if w.spool != nil {
+		w.spool.Close()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), batchFlushTimeout)
+	defer cancel()
+	w.Store.Disconnect(ctx)
+}
+
+// Disconnect stops accepting samples and waits until the queued ones are inserted and the
+// store is disconnected. If the context is done first, Disconnect returns without waiting,
+// the writer goes on and disconnects the store when the queue is drained.
+func (w *BatchWriter) Disconnect(ctx context.Context) {
+	w.mutex.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.mutex.Unlock()
+	select {
+	case <-w.stopped:
+		log.Log.Info("Flushed the queued device infos")
+	case <-ctx.Done():
+		log.Log.Errorf("Flush the queued device infos failed: %v, %v samples left in the queue", ctx.Err(), len(w.queue))
+	}
+}
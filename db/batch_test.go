@@ -0,0 +1,250 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"health-monitoring/types"
+)
+
+// blockingStore holds the inserts until it is released.
+type blockingStore struct {
+	Store
+	release      chan struct{}
+	disconnected atomic.Bool
+}
+
+func (s *blockingStore) AddDeviceInfos(ctx context.Context, infos []types.MDBDeviceInfo) error {
+	<-s.release
+	return s.Store.AddDeviceInfos(ctx, infos)
+}
+
+func (s *blockingStore) Disconnect(ctx context.Context) {
+	s.disconnected.Store(true)
+	s.Store.Disconnect(ctx)
+}
+
+// go test -v -timeout 30s -count=1 -run TestBatchWriter health-monitoring/db
+func TestBatchWriter(t *testing.T) {
+	ctx := context.Background()
+	memory := NewMemoryDB(0, "test")
+	w := NewBatchWriter(memory, 100, 3, time.Hour, nil)
+
+	tm := time.Now().Truncate(time.Millisecond)
+	for i := 0; i < 4; i++ {
+		if err := w.AddDeviceInfo(ctx, "node1", tm.Add(time.Duration(i)*time.Second), types.WsMachineInfoRequest{UtilizationGPU: i}); err != nil {
+			t.Fatalf("AddDeviceInfo failed: %v", err)
+		}
+	}
+	// The first 3 samples fill a batch, the last one waits for the interval
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		info, err := memory.GetLatestDeviceInfo(ctx, "node1")
+		if err == nil {
+			if info.UtilizationGPU != 2 {
+				t.Fatalf("expect only the full batch inserted, got latest %+v", info)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("full batch is not inserted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	w.Disconnect(ctx)
+	info, err := memory.GetLatestDeviceInfo(ctx, "node1")
+	if err != nil || info.UtilizationGPU != 3 {
+		t.Fatalf("expect the queued sample inserted on disconnect, got %+v %v", info, err)
+	}
+	if err := w.AddDeviceInfo(ctx, "node1", tm, types.WsMachineInfoRequest{}); !errors.Is(err, ErrWriterClosed) {
+		t.Fatalf("expect ErrWriterClosed after disconnect, got %v", err)
+	}
+}
+
+// go test -v -timeout 30s -count=1 -run TestBatchWriterBackpressure health-monitoring/db
+func TestBatchWriterBackpressure(t *testing.T) {
+	ctx := context.Background()
+	store := &blockingStore{Store: NewMemoryDB(0, "test"), release: make(chan struct{})}
+	w := NewBatchWriter(store, 2, 1, time.Hour, nil)
+
+	// One sample is held by the blocked insert, two fill the queue
+	for i := 0; i < 3; i++ {
+		if err := w.AddDeviceInfo(ctx, "node1", time.Now(), types.WsMachineInfoRequest{}); err != nil {
+			t.Fatalf("AddDeviceInfo %v failed: %v", i, err)
+		}
+	}
+	ctx1, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if err := w.AddDeviceInfo(ctx1, "node1", time.Now(), types.WsMachineInfoRequest{}); !errors.Is(err, ErrWriteQueueFull) {
+		t.Fatalf("expect ErrWriteQueueFull, got %v", err)
+	}
+
+	close(store.release)
+	w.Disconnect(ctx)
+	points, err := store.GetDeviceInfoHistory(ctx, "node1", time.Now().Add(-time.Minute), time.Now().Add(time.Minute), time.Hour, types.AggAvg)
+	if err != nil {
+		t.Fatalf("GetDeviceInfoHistory failed: %v", err)
+	}
+	count := 0
+	for _, point := range points {
+		count += point.Count
+	}
+	if count != 3 {
+		t.Fatalf("expect 3 samples inserted, got %v", count)
+	}
+}
+
+// go test -v -timeout 30s -count=1 -run TestBatchWriterWholeSample health-monitoring/db
+func TestBatchWriterWholeSample(t *testing.T) {
+	ctx := context.Background()
+	memory := NewMemoryDB(0, "test").(*memoryDB)
+	store := &blockingStore{Store: memory, release: make(chan struct{})}
+	w := NewBatchWriter(store, 1, 1, time.Hour, nil)
+
+	if err := w.AddDeviceInfo(ctx, "node1", time.Now(), types.WsMachineInfoRequest{}); err != nil {
+		t.Fatalf("AddDeviceInfo failed: %v", err)
+	}
+	// The sample of a device with 2 GPUs takes one place in the queue
+	gpus := types.WsMachineInfoRequest{GPUs: []types.GPUInfo{{Index: 0}, {Index: 1}}}
+	if err := w.AddDeviceInfo(ctx, "node1", time.Now(), gpus); err != nil {
+		t.Fatalf("AddDeviceInfo failed: %v", err)
+	}
+	ctx1, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if err := w.AddDeviceInfo(ctx1, "node1", time.Now(), gpus); !errors.Is(err, ErrWriteQueueFull) {
+		t.Fatalf("expect ErrWriteQueueFull, got %v", err)
+	}
+
+	// The store is not disconnected under the blocked insert when Disconnect gives up
+	ctx2, cancel2 := context.WithCancel(ctx)
+	cancel2()
+	w.Disconnect(ctx2)
+	if store.disconnected.Load() {
+		t.Fatal("expect the store not disconnected before the queue is drained")
+	}
+	close(store.release)
+	<-w.stopped
+	if !store.disconnected.Load() {
+		t.Fatal("expect the store disconnected after the queue is drained")
+	}
+	if len(memory.infos["node1"]) != 2 || len(memory.gpuInfos["node1"]) != 2 {
+		t.Fatalf("expect the whole samples inserted, got %v of device, %v of GPUs", len(memory.infos["node1"]), len(memory.gpuInfos["node1"]))
+	}
+}
+
+// failingStore fails the inserts while it is down.
+type failingStore struct {
+	Store
+	down atomic.Bool
+}
+
+func (s *failingStore) AddDeviceInfos(ctx context.Context, infos []types.MDBDeviceInfo) error {
+	if s.down.Load() {
+		return ErrStoreUnavailable
+	}
+	return s.Store.AddDeviceInfos(ctx, infos)
+}
+
+func (s *failingStore) Ping(ctx context.Context) error {
+	if s.down.Load() {
+		return ErrStoreUnavailable
+	}
+	return nil
+}
+
+// go test -v -timeout 30s -count=1 -run TestBatchWriterSpool health-monitoring/db
+func TestBatchWriterSpool(t *testing.T) {
+	ctx := context.Background()
+	spool, err := OpenSpool(t.TempDir(), 0)
+	if err != nil {
+		t.Fatalf("OpenSpool failed: %v", err)
+	}
+	store := &failingStore{Store: NewMemoryDB(0, "test")}
+	store.down.Store(true)
+	w := NewBatchWriter(store, 100, 1, time.Hour, spool)
+
+	// The sample is acknowledged once the failed batch is spooled
+	tm := time.Now().Truncate(time.Millisecond)
+	if err := w.AddDeviceInfo(ctx, "node1", tm, types.WsMachineInfoRequest{UtilizationGPU: 0}); err != nil {
+		t.Fatalf("AddDeviceInfo failed: %v", err)
+	}
+	if !spool.Pending() {
+		t.Fatal("expect the failed batch spooled when AddDeviceInfo returns")
+	}
+	// Spooled after the failed batch while the spool is pending
+	size := spool.Size()
+	if err := w.AddDeviceInfo(ctx, "node1", tm.Add(time.Second), types.WsMachineInfoRequest{UtilizationGPU: 1}); err != nil {
+		t.Fatalf("AddDeviceInfo failed: %v", err)
+	}
+	if spool.Size() == size {
+		t.Fatal("expect the batch spooled while the spool is pending when AddDeviceInfo returns")
+	}
+
+	store.down.Store(false)
+	w.replay()
+	if spool.Pending() {
+		t.Fatal("expect spool replayed")
+	}
+	info, err := store.GetLatestDeviceInfo(ctx, "node1")
+	if err != nil || info.UtilizationGPU != 1 {
+		t.Fatalf("expect spooled samples inserted, got %+v %v", info, err)
+	}
+	w.Disconnect(ctx)
+}
+
+// go test -v -timeout 30s -count=1 -run TestBatchWriterSpoolFull health-monitoring/db
+func TestBatchWriterSpoolFull(t *testing.T) {
+	ctx := context.Background()
+	spool, err := OpenSpool(t.TempDir(), 1)
+	if err != nil {
+		t.Fatalf("OpenSpool failed: %v", err)
+	}
+	store := &failingStore{Store: NewMemoryDB(0, "test")}
+	store.down.Store(true)
+	w := NewBatchWriter(store, 100, 1, time.Hour, spool)
+	defer w.Disconnect(ctx)
+
+	// The sample is neither inserted nor spooled, the device must not get success
+	if err := w.AddDeviceInfo(ctx, "node1", time.Now(), types.WsMachineInfoRequest{}); !errors.Is(err, ErrSpoolFull) {
+		t.Fatalf("expect ErrSpoolFull, got %v", err)
+	}
+
+	store.down.Store(false)
+	if err := w.AddDeviceInfo(ctx, "node1", time.Now(), types.WsMachineInfoRequest{}); err != nil {
+		t.Fatalf("AddDeviceInfo failed: %v", err)
+	}
+	if _, err := store.GetLatestDeviceInfo(ctx, "node1"); err != nil {
+		t.Fatalf("expect the sample inserted when AddDeviceInfo returns, got %v", err)
+	}
+}
+
+// go test -v -timeout 30s -count=1 -run TestBatchWriterUnavailable health-monitoring/db
+func TestBatchWriterUnavailable(t *testing.T) {
+	ctx := context.Background()
+	store := &failingStore{Store: NewMemoryDB(0, "test")}
+	store.down.Store(true)
+	w := NewBatchWriter(store, 100, 1, time.Hour, nil)
+	defer w.Disconnect(ctx)
+
+	if err := w.AddDeviceInfo(ctx, "node1", time.Now(), types.WsMachineInfoRequest{}); err != nil {
+		t.Fatalf("AddDeviceInfo failed: %v", err)
+	}
+	// The failed insert makes the writer refuse samples
+	deadline := time.Now().Add(5 * time.Second)
+	for w.AddDeviceInfo(ctx, "node1", time.Now(), types.WsMachineInfoRequest{}) == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("expect ErrStoreUnavailable after the insert failed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	store.down.Store(false)
+	w.checkStore()
+	if err := w.AddDeviceInfo(ctx, "node1", time.Now(), types.WsMachineInfoRequest{}); err != nil {
+		t.Fatalf("expect samples accepted after the store is back, got %v", err)
+	}
+}
@@ -0,0 +1,619 @@
+package db
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"health-monitoring/log"
+	"health-monitoring/types"
+)
+
+const (
+	// A new segment is started when the current one grows beyond the size.
+	segmentSize = 64 << 20
+
+	// Period to flush the segment to the disk, the changes in the last period may be lost
+	// when the host crashes, but not when only the process crashes.
+	syncPeriod = time.Second
+
+	// Period to drop the expired samples and compact the log into a snapshot.
+	compactPeriod = time.Hour
+)
+
+// embeddedDB keeps the state in memory like memoryDB and appends every change to a log in
+// the data directory, so that the state survives restarts without any external database.
+// The heartbeats of the online records are not logged, the records of this instance are
+// deleted at startup anyway.
+type embeddedDB struct {
+	*memoryDB
+	dir      string
+	logMutex sync.Mutex // keeps the records in the log in the same order as the changes
+	segment  *os.File
+	seq      uint64 // 当前日志段的序号
+	size     int64  // 当前日志段的大小
+	dirty    bool   // 当前日志段有尚未刷盘的写入
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewEmbeddedDB opens the storage in the directory, creating it if it does not exist. The
+// state is recovered from the latest snapshot and the segments after it, a torn record at
+// the end of a segment left by a crash is truncated. Samples older than expireTime are
+// dropped, zero keeps them forever.
+func NewEmbeddedDB(dir string, expireTime time.Duration, instance string) (Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		log.Log.Errorf("Create data directory %v failed: %v", dir, err)
+		return nil, err
+	}
+	db := &embeddedDB{
+		memoryDB: newMemoryDB(expireTime, instance),
+		dir:      dir,
+		done:     make(chan struct{}),
+	}
+	if err := db.load(); err != nil {
+		log.Log.Errorf("Load data directory %v failed: %v", dir, err)
+		return nil, err
+	}
+	if err := db.openSegment(db.seq + 1); err != nil {
+		log.Log.Errorf("Open segment of data directory %v failed: %v", dir, err)
+		return nil, err
+	}
+
+	// The connections of the last run of this instance are gone
+	deleted := 0
+	now := time.Now()
+	for nodeId, online := range db.online {
+		if online.Instance == instance || !isLive(online, now) {
+			delete(db.online, nodeId)
+			if err := db.appendRecord(recordOffline, online); err != nil {
+				db.segment.Close()
+				return nil, err
+			}
+			deleted++
+		}
+	}
+	log.Log.Infof("Delete online records of instance %v DeletedCount %v", instance, deleted)
+
+	db.wg.Add(1)
+	go db.maintain()
+	return db, nil
+}
+
+// load replays the latest snapshot and the segments after it.
+func (db *embeddedDB) load() error {
+	segments, snapshots, err := logFiles(db.dir)
+	if err != nil {
+		return err
+	}
+	if len(snapshots) != 0 {
+		db.seq = snapshots[len(snapshots)-1]
+		if err := db.replay(snapshotName(db.seq)); err != nil {
+			// Snapshots are renamed into place only after they are fully written
+			return fmt.Errorf("load snapshot %v: %w", db.seq, err)
+		}
+		for _, seq := range snapshots[:len(snapshots)-1] {
+			if err := os.Remove(filepath.Join(db.dir, snapshotName(seq))); err != nil {
+				return err
+			}
+		}
+	}
+	for _, seq := range segments {
+		name := segmentName(seq)
+		if seq <= db.seq {
+			// Covered by the snapshot, the compaction was interrupted before removing it
+			if err := os.Remove(filepath.Join(db.dir, name)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := db.replay(name); err != nil {
+			return fmt.Errorf("load segment %v: %w", seq, err)
+		}
+		db.seq = seq
+	}
+	log.Log.Infof("Loaded %v devices and %v online records from %v", len(db.registry), len(db.online), db.dir)
+	return nil
+}
+
+// replay applies the records of the file, and truncates it after the last good record if
+// the rest is torn or damaged. A record which passed the checksum but cannot be applied
+// fails the load instead, truncating it would throw away the valid records after it.
+func (db *embeddedDB) replay(name string) error {
+	path := filepath.Join(db.dir, name)
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	offset, err := readRecords(f, db.apply)
+	f.Close()
+	if errors.Is(err, errCorruptRecord) && filepath.Ext(name) == segmentExt {
+		log.Log.Warnf("Truncate %v at offset %v: %v", path, offset, err)
+		return os.Truncate(path, offset)
+	}
+	return err
+}
+
+func (db *embeddedDB) apply(rt recordType, payload []byte) error {
+	switch rt {
+	case recordRegistry:
+		device := types.MDBDeviceRegistry{}
+		if err := json.Unmarshal(payload, &device); err != nil {
+			return err
+		}
+		db.registry[device.DeviceId] = device
+	case recordOnline:
+		online := types.MDBDeviceOnline{}
+		if err := json.Unmarshal(payload, &online); err != nil {
+			return err
+		}
+		db.online[online.DeviceId] = online
+	case recordOffline:
+		online := types.MDBDeviceOnline{}
+		if err := json.Unmarshal(payload, &online); err != nil {
+			return err
+		}
+		delete(db.online, online.DeviceId)
+	case recordDeviceInfo:
+		info := types.MDBDeviceInfo{}
+		if err := json.Unmarshal(payload, &info); err != nil {
+			return err
+		}
+		db.insertDeviceInfo(info)
+	case recordHostMetrics:
+		metrics := types.MDBHostMetrics{}
+		if err := json.Unmarshal(payload, &metrics); err != nil {
+			return err
+		}
+		db.insertHostMetrics(metrics)
+	case recordCustomMetric:
+		metric := types.MDBCustomMetric{}
+		if err := json.Unmarshal(payload, &metric); err != nil {
+			return err
+		}
+		db.insertCustomMetric(metric)
+	case recordModelMetrics:
+		metrics := types.MDBModelMetrics{}
+		if err := json.Unmarshal(payload, &metrics); err != nil {
+			return err
+		}
+		db.insertModelMetrics(metrics)
+	case recordDeleteBefore:
+		var tm time.Time
+		if err := json.Unmarshal(payload, &tm); err != nil {
+			return err
+		}
+		db.deleteDeviceInfoBefore(tm)
+	default:
+		return fmt.Errorf("unknown record type %v", rt)
+	}
+	return nil
+}
+
+// openSegment starts a new segment, the caller must hold logMutex.
+func (db *embeddedDB) openSegment(seq uint64) error {
+	f, err := os.OpenFile(filepath.Join(db.dir, segmentName(seq)), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := syncDir(db.dir); err != nil {
+		f.Close()
+		return err
+	}
+	db.segment = f
+	db.seq = seq
+	db.size = 0
+	db.dirty = false
+	return nil
+}
+
+// rotate closes the current segment and starts the next one, the caller must hold logMutex.
+func (db *embeddedDB) rotate() error {
+	if err := db.segment.Sync(); err != nil {
+		return err
+	}
+	if err := db.segment.Close(); err != nil {
+		return err
+	}
+	return db.openSegment(db.seq + 1)
+}
+
+// appendRecord writes the record to the current segment, the caller must hold logMutex.
+func (db *embeddedDB) appendRecord(rt recordType, v interface{}) error {
+	return appendRecords(db, rt, []interface{}{v})
+}
+
+// appendRecords writes the records to the current segment all or none, a partial write
+// is cut off so that the log never holds a change missing in memory. The caller must
+// hold logMutex and apply the changes to memory only after they are logged.
+func appendRecords[T any](db *embeddedDB, rt recordType, values []T) error {
+	buf := make([]byte, 0)
+	for _, v := range values {
+		record, err := encodeRecord(rt, v)
+		if err != nil {
+			log.Log.Errorf("Encode record of type %v failed: %v", rt, err)
+			return err
+		}
+		buf = append(buf, record...)
+	}
+	if _, err := db.segment.Write(buf); err != nil {
+		log.Log.Errorf("Write record to segment %v failed: %v", db.seq, err)
+		if err := db.segment.Truncate(db.size); err == nil {
+			db.segment.Seek(db.size, io.SeekStart)
+		}
+		return err
+	}
+	db.size += int64(len(buf))
+	db.dirty = true
+	if db.size >= segmentSize {
+		// The records are in the log already, the rotation is retried by the next write
+		if err := db.rotate(); err != nil {
+			log.Log.Errorf("Rotate segment %v failed: %v", db.seq, err)
+		}
+	}
+	return nil
+}
+
+// The registry and online methods decide the change under the read lock, log it and then
+// apply it to memory like AddDeviceInfos, so that memory never holds a change missing in
+// the log. logMutex keeps the state from changing between the decision and the apply, the
+// heartbeats are not logged and only renew the records.
+
+func (db *embeddedDB) VerifyDevice(ctx context.Context, nodeId string, pubKey []byte, autoRegister bool) error {
+	db.logMutex.Lock()
+	defer db.logMutex.Unlock()
+	db.memoryDB.mutex.RLock()
+	device, changed, err := db.verifiedDevice(nodeId, pubKey, autoRegister)
+	db.memoryDB.mutex.RUnlock()
+	if err != nil || !changed {
+		return err
+	}
+	return db.putRegistry(device)
+}
+
+func (db *embeddedDB) RegisterDevice(ctx context.Context, device types.MDBDeviceRegistry) error {
+	db.logMutex.Lock()
+	defer db.logMutex.Unlock()
+	db.memoryDB.mutex.RLock()
+	device = db.registeredDevice(device)
+	db.memoryDB.mutex.RUnlock()
+	return db.putRegistry(device)
+}
+
+func (db *embeddedDB) RevokeDevice(ctx context.Context, nodeId string) error {
+	db.logMutex.Lock()
+	defer db.logMutex.Unlock()
+	db.memoryDB.mutex.RLock()
+	device, err := db.revokedDevice(nodeId)
+	_, online := db.online[nodeId]
+	db.memoryDB.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	if err := db.putRegistry(device); err != nil {
+		return err
+	}
+	if !online {
+		return nil
+	}
+	// The device stays revoked if the online record cannot be deleted, revoking it again
+	// retries the deletion
+	return db.deleteOnline(nodeId)
+}
+
+func (db *embeddedDB) NodeOnline(ctx context.Context, nodeId, session string, pubKey []byte) error {
+	_, err := db.nodeOnline(nodeId, session, pubKey, false, false)
+	return err
+}
+
+func (db *embeddedDB) TakeoverNodeOnline(ctx context.Context, nodeId, session string, pubKey []byte, sameKey bool) (*types.MDBDeviceOnline, error) {
+	return db.nodeOnline(nodeId, session, pubKey, true, sameKey)
+}
+
+func (db *embeddedDB) nodeOnline(nodeId, session string, pubKey []byte, takeover, sameKey bool) (*types.MDBDeviceOnline, error) {
+	db.logMutex.Lock()
+	defer db.logMutex.Unlock()
+	db.memoryDB.mutex.RLock()
+	online, old, err := db.memoryDB.nodeOnline(nodeId, session, pubKey, takeover, sameKey)
+	db.memoryDB.mutex.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	if err := db.appendRecord(recordOnline, online); err != nil {
+		return nil, err
+	}
+	db.memoryDB.mutex.Lock()
+	db.online[nodeId] = online
+	db.memoryDB.mutex.Unlock()
+	return old, nil
+}
+
+func (db *embeddedDB) NodeOffline(ctx context.Context, nodeId, session string) error {
+	db.logMutex.Lock()
+	defer db.logMutex.Unlock()
+	db.memoryDB.mutex.RLock()
+	owned := db.ownsOnline(nodeId, session)
+	db.memoryDB.mutex.RUnlock()
+	if !owned {
+		return nil
+	}
+	return db.deleteOnline(nodeId)
+}
+
+// putRegistry logs the registry of the device and then applies it to memory, the caller
+// must hold logMutex.
+func (db *embeddedDB) putRegistry(device types.MDBDeviceRegistry) error {
+	if err := db.appendRecord(recordRegistry, device); err != nil {
+		return err
+	}
+	db.memoryDB.mutex.Lock()
+	db.registry[device.DeviceId] = device
+	db.memoryDB.mutex.Unlock()
+	return nil
+}
+
+// deleteOnline logs the deletion of the online record of the device and then applies it
+// to memory, the caller must hold logMutex.
+func (db *embeddedDB) deleteOnline(nodeId string) error {
+	if err := db.appendRecord(recordOffline, types.MDBDeviceOnline{DeviceId: nodeId}); err != nil {
+		return err
+	}
+	db.memoryDB.mutex.Lock()
+	delete(db.online, nodeId)
+	db.memoryDB.mutex.Unlock()
+	return nil
+}
+
+func (db *embeddedDB) AddDeviceInfo(ctx context.Context, nodeId string, tm time.Time, info types.WsMachineInfoRequest) error {
+	return db.AddDeviceInfos(ctx, newDeviceInfos(nodeId, tm, info))
+}
+
+func (db *embeddedDB) AddDeviceInfos(ctx context.Context, infos []types.MDBDeviceInfo) error {
+	db.logMutex.Lock()
+	defer db.logMutex.Unlock()
+	if err := appendRecords(db, recordDeviceInfo, infos); err != nil {
+		return err
+	}
+	db.memoryDB.mutex.Lock()
+	for _, info := range infos {
+		db.insertDeviceInfo(info)
+	}
+	db.memoryDB.mutex.Unlock()
+	return nil
+}
+
+func (db *embeddedDB) AddHostMetrics(ctx context.Context, nodeId string, tm time.Time, metrics types.WsHostMetricsRequest) error {
+	db.logMutex.Lock()
+	defer db.logMutex.Unlock()
+	sample := newHostMetrics(nodeId, tm, metrics)
+	if err := db.appendRecord(recordHostMetrics, sample); err != nil {
+		return err
+	}
+	db.memoryDB.mutex.Lock()
+	db.insertHostMetrics(sample)
+	db.memoryDB.mutex.Unlock()
+	return nil
+}
+
+func (db *embeddedDB) AddCustomMetrics(ctx context.Context, nodeId string, tm time.Time, samples []types.CustomSample) error {
+	db.logMutex.Lock()
+	defer db.logMutex.Unlock()
+	metrics := newCustomMetrics(nodeId, tm, samples)
+	if err := appendRecords(db, recordCustomMetric, metrics); err != nil {
+		return err
+	}
+	db.memoryDB.mutex.Lock()
+	for _, metric := range metrics {
+		db.insertCustomMetric(metric)
+	}
+	db.memoryDB.mutex.Unlock()
+	return nil
+}
+
+func (db *embeddedDB) AddModelMetrics(ctx context.Context, nodeId string, tm time.Time, metrics types.WsModelMetricsRequest) error {
+	db.logMutex.Lock()
+	defer db.logMutex.Unlock()
+	models := newModelMetrics(nodeId, tm, metrics)
+	if err := appendRecords(db, recordModelMetrics, models); err != nil {
+		return err
+	}
+	db.memoryDB.mutex.Lock()
+	for _, model := range models {
+		db.insertModelMetrics(model)
+	}
+	db.memoryDB.mutex.Unlock()
+	return nil
+}
+
+func (db *embeddedDB) DeleteExpiredDeviceInfo(ctx context.Context, tm time.Time) error {
+	db.logMutex.Lock()
+	defer db.logMutex.Unlock()
+	if err := db.appendRecord(recordDeleteBefore, tm); err != nil {
+		return err
+	}
+	return db.memoryDB.DeleteExpiredDeviceInfo(ctx, tm)
+}
+
+// maintain flushes the log and compacts it periodically until the storage is closed.
+func (db *embeddedDB) maintain() {
+	defer db.wg.Done()
+	syncTicker := time.NewTicker(syncPeriod)
+	defer syncTicker.Stop()
+	compactTicker := time.NewTicker(compactPeriod)
+	defer compactTicker.Stop()
+	for {
+		select {
+		case <-db.done:
+			return
+		case <-syncTicker.C:
+			db.sync()
+		case <-compactTicker.C:
+			db.compact()
+		}
+	}
+}
+
+func (db *embeddedDB) sync() error {
+	db.logMutex.Lock()
+	defer db.logMutex.Unlock()
+	if !db.dirty {
+		return nil
+	}
+	if err := db.segment.Sync(); err != nil {
+		log.Log.Errorf("Sync segment %v failed: %v", db.seq, err)
+		return err
+	}
+	db.dirty = false
+	return nil
+}
+
+// compact drops the expired samples, writes the state into a snapshot and removes the
+// segments covered by the snapshot. The writes are only blocked while the state is copied,
+// not while the snapshot is written.
+func (db *embeddedDB) compact() error {
+	db.logMutex.Lock()
+	if db.expireTime > 0 {
+		db.memoryDB.mutex.Lock()
+		db.deleteDeviceInfoBefore(time.Now().Add(-db.expireTime))
+		db.memoryDB.mutex.Unlock()
+	}
+
+	// The state includes all the records up to the current segment
+	seq := db.seq
+	if err := db.rotate(); err != nil {
+		db.logMutex.Unlock()
+		log.Log.Errorf("Rotate segment %v failed: %v", seq, err)
+		return err
+	}
+	db.memoryDB.mutex.RLock()
+	state := db.memoryDB.clone()
+	db.memoryDB.mutex.RUnlock()
+	db.logMutex.Unlock()
+
+	if err := db.writeSnapshot(seq, state); err != nil {
+		log.Log.Errorf("Write snapshot %v failed: %v", seq, err)
+		return err
+	}
+
+	segments, snapshots, err := logFiles(db.dir)
+	if err != nil {
+		log.Log.Errorf("List data directory %v failed: %v", db.dir, err)
+		return err
+	}
+	for _, s := range segments {
+		if s <= seq {
+			os.Remove(filepath.Join(db.dir, segmentName(s)))
+		}
+	}
+	for _, s := range snapshots {
+		if s < seq {
+			os.Remove(filepath.Join(db.dir, snapshotName(s)))
+		}
+	}
+	if err := syncDir(db.dir); err != nil {
+		log.Log.Errorf("Sync data directory %v failed: %v", db.dir, err)
+		return err
+	}
+	log.Log.Infof("Compacted data directory %v into snapshot %v", db.dir, seq)
+	return nil
+}
+
+// writeSnapshot writes the copy of the state into a temporary file and renames it into
+// place once it is on the disk, so that a crash never leaves a partial snapshot.
+func (db *embeddedDB) writeSnapshot(seq uint64, state *memoryDB) error {
+	path := filepath.Join(db.dir, snapshotName(seq))
+	f, err := os.Create(path + tempExt)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path + tempExt)
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	write := func(rt recordType, v interface{}) error {
+		buf, err := encodeRecord(rt, v)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(buf)
+		return err
+	}
+	err = func() error {
+		for _, device := range state.registry {
+			if err := write(recordRegistry, device); err != nil {
+				return err
+			}
+		}
+		for _, online := range state.online {
+			if err := write(recordOnline, online); err != nil {
+				return err
+			}
+		}
+		for _, samples := range []map[string][]types.MDBDeviceInfo{state.infos, state.gpuInfos} {
+			for _, infos := range samples {
+				for _, info := range infos {
+					if err := write(recordDeviceInfo, info); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		for _, samples := range state.hosts {
+			for _, metrics := range samples {
+				if err := write(recordHostMetrics, metrics); err != nil {
+					return err
+				}
+			}
+		}
+		for _, samples := range state.customs {
+			for _, metric := range samples {
+				if err := write(recordCustomMetric, metric); err != nil {
+					return err
+				}
+			}
+		}
+		for _, samples := range state.models {
+			for _, metrics := range samples {
+				if err := write(recordModelMetrics, metrics); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}()
+	if err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := os.Rename(path+tempExt, path); err != nil {
+		return err
+	}
+	return syncDir(db.dir)
+}
+
+// Disconnect stops the maintenance and flushes the log, the storage must not be used
+// afterwards.
+func (db *embeddedDB) Disconnect(ctx context.Context) {
+	close(db.done)
+	db.wg.Wait()
+	db.logMutex.Lock()
+	defer db.logMutex.Unlock()
+	if err := db.segment.Sync(); err != nil {
+		log.Log.Errorf("Sync segment %v failed: %v", db.seq, err)
+	}
+	if err := db.segment.Close(); err != nil {
+		log.Log.Errorf("Close segment %v failed: %v", db.seq, err)
+	}
+}
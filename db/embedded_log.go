@@ -0,0 +1,163 @@
+package db
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The log of the embedded storage is a sequence of segment files named by increasing
+// sequence numbers, each file is a sequence of records:
+//
+//	| length uint32 | crc32c uint32 | type uint8 | json payload |
+//
+// length counts the type and the payload, crc32c is the Castagnoli checksum of them.
+// A snapshot holds the whole state up to the segment of the same sequence number.
+
+type recordType uint8
+
+const (
+	recordRegistry     recordType = 1 // types.MDBDeviceRegistry
+	recordOnline       recordType = 2 // types.MDBDeviceOnline
+	recordOffline      recordType = 3 // types.MDBDeviceOnline, only device_id is used
+	recordDeviceInfo   recordType = 4 // types.MDBDeviceInfo
+	recordDeleteBefore recordType = 5 // time.Time
+	recordHostMetrics  recordType = 6 // types.MDBHostMetrics
+	recordCustomMetric recordType = 7 // types.MDBCustomMetric
+	recordModelMetrics recordType = 8 // types.MDBModelMetrics
+)
+
+const (
+	segmentExt  = ".seg"
+	snapshotExt = ".snap"
+	tempExt     = ".tmp"
+
+	recordHeaderSize = 8
+	maxRecordSize    = 16 << 20
+)
+
+var (
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+	errCorruptRecord = errors.New("corrupt record")
+	// errStopRead is returned by the apply function of readRecords to stop after the record.
+	errStopRead = errors.New("stop reading records")
+)
+
+func segmentName(seq uint64) string {
+	return fmt.Sprintf("%020d%s", seq, segmentExt)
+}
+
+func snapshotName(seq uint64) string {
+	return fmt.Sprintf("%020d%s", seq, snapshotExt)
+}
+
+// encodeRecord frames the payload encoded as json.
+func encodeRecord(rt recordType, v interface{}) ([]byte, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, recordHeaderSize+1+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(1+len(payload)))
+	buf[recordHeaderSize] = byte(rt)
+	copy(buf[recordHeaderSize+1:], payload)
+	binary.BigEndian.PutUint32(buf[4:8], crc32.Checksum(buf[recordHeaderSize:], crcTable))
+	return buf, nil
+}
+
+// readRecords calls apply for each record of the file, and returns the offset after the
+// last good record. errCorruptRecord is returned if a record is torn or damaged, the
+// records after it are not read. Reading stops without error after the record for which
+// apply returns errStopRead, other errors of apply are returned as they are: the record
+// passed the checksum, so the data is intact and must not be truncated as corrupt.
+func readRecords(r io.Reader, apply func(rt recordType, payload []byte) error) (int64, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, recordHeaderSize)
+	var offset int64
+	for {
+		if _, err := io.ReadFull(br, header); err != nil {
+			if err == io.EOF {
+				return offset, nil
+			}
+			if err == io.ErrUnexpectedEOF {
+				return offset, errCorruptRecord
+			}
+			return offset, err
+		}
+		length := binary.BigEndian.Uint32(header[0:4])
+		if length == 0 || length > maxRecordSize {
+			return offset, errCorruptRecord
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(br, data); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return offset, errCorruptRecord
+			}
+			return offset, err
+		}
+		if crc32.Checksum(data, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+			return offset, errCorruptRecord
+		}
+		next := offset + recordHeaderSize + int64(length)
+		if err := apply(recordType(data[0]), data[1:]); err == errStopRead {
+			return next, nil
+		} else if err != nil {
+			return offset, fmt.Errorf("apply record of type %v at offset %v: %w", data[0], offset, err)
+		}
+		offset = next
+	}
+}
+
+// logFiles lists the sequence numbers of the segments and the snapshots in the directory
+// in ascending order. Temporary files left by an interrupted compaction are removed.
+func logFiles(dir string) (segments, snapshots []uint64, err error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasSuffix(name, tempExt) {
+			if err := os.Remove(filepath.Join(dir, name)); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		ext := filepath.Ext(name)
+		if ext != segmentExt && ext != snapshotExt {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, ext), 10, 64)
+		if err != nil {
+			continue
+		}
+		if ext == segmentExt {
+			segments = append(segments, seq)
+		} else {
+			snapshots = append(snapshots, seq)
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i] < snapshots[j] })
+	return segments, snapshots, nil
+}
+
+// syncDir makes the creation, renaming and removal of files in the directory durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,336 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"health-monitoring/types"
+)
+
+// go test -v -timeout 30s -count=1 -run TestEmbeddedNodeOnlineRace health-monitoring/db
+func TestEmbeddedNodeOnlineRace(t *testing.T) {
+	store, err := NewEmbeddedDB(t.TempDir(), time.Minute, "test")
+	if err != nil {
+		t.Fatalf("Open embedded storage failed: %v", err)
+	}
+	defer store.Disconnect(context.Background())
+	testNodeOnlineRace(context.Background(), t, store)
+}
+
+// go test -v -timeout 30s -count=1 -run TestEmbeddedLatestDeviceInfo health-monitoring/db
+func TestEmbeddedLatestDeviceInfo(t *testing.T) {
+	store, err := NewEmbeddedDB(t.TempDir(), time.Hour, "test")
+	if err != nil {
+		t.Fatalf("Open embedded storage failed: %v", err)
+	}
+	defer store.Disconnect(context.Background())
+	testLatestDeviceInfo(context.Background(), t, store)
+}
+
+// go test -v -timeout 30s -count=1 -run TestEmbeddedOnlineLease health-monitoring/db
+func TestEmbeddedOnlineLease(t *testing.T) {
+	store, err := NewEmbeddedDB(t.TempDir(), time.Hour, "test")
+	if err != nil {
+		t.Fatalf("Open embedded storage failed: %v", err)
+	}
+	defer store.Disconnect(context.Background())
+	testOnlineLease(context.Background(), t, store, store.(*embeddedDB).ageOnline)
+}
+
+// go test -v -timeout 30s -count=1 -run TestEmbeddedTakeoverNodeOnline health-monitoring/db
+func TestEmbeddedTakeoverNodeOnline(t *testing.T) {
+	store, err := NewEmbeddedDB(t.TempDir(), time.Hour, "test")
+	if err != nil {
+		t.Fatalf("Open embedded storage failed: %v", err)
+	}
+	defer store.Disconnect(context.Background())
+	testTakeoverNodeOnline(context.Background(), t, store)
+}
+
+// go test -v -timeout 30s -count=1 -run TestEmbeddedDeviceRegistry health-monitoring/db
+func TestEmbeddedDeviceRegistry(t *testing.T) {
+	store, err := NewEmbeddedDB(t.TempDir(), time.Hour, "test")
+	if err != nil {
+		t.Fatalf("Open embedded storage failed: %v", err)
+	}
+	defer store.Disconnect(context.Background())
+	testDeviceRegistry(context.Background(), t, store)
+}
+
+// go test -v -timeout 30s -count=1 -run TestEmbeddedDeviceInfoP95 health-monitoring/db
+func TestEmbeddedDeviceInfoP95(t *testing.T) {
+	store, err := NewEmbeddedDB(t.TempDir(), 0, "test")
+	if err != nil {
+		t.Fatalf("Open embedded storage failed: %v", err)
+	}
+	defer store.Disconnect(context.Background())
+	testDeviceInfoP95(context.Background(), t, store)
+}
+
+// go test -v -timeout 30s -count=1 -run TestEmbeddedGPUDeviceInfo health-monitoring/db
+func TestEmbeddedGPUDeviceInfo(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewEmbeddedDB(dir, time.Hour, "test")
+	if err != nil {
+		t.Fatalf("Open embedded storage failed: %v", err)
+	}
+	testGPUDeviceInfo(context.Background(), t, store)
+	store.Disconnect(context.Background())
+
+	// The samples of the GPUs are recovered apart from the sample of the device
+	store, err = NewEmbeddedDB(dir, time.Hour, "test")
+	if err != nil {
+		t.Fatalf("Reopen embedded storage failed: %v", err)
+	}
+	defer store.Disconnect(context.Background())
+	edb := store.(*embeddedDB)
+	if len(edb.infos["node1"]) != 1 || len(edb.gpuInfos["node1"]) != 2 {
+		t.Fatalf("unexpected samples after recovery: %v of device, %v of GPUs", len(edb.infos["node1"]), len(edb.gpuInfos["node1"]))
+	}
+}
+
+// go test -v -timeout 30s -count=1 -run TestEmbeddedHostMetrics health-monitoring/db
+func TestEmbeddedHostMetrics(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	store, err := NewEmbeddedDB(dir, time.Hour, "test")
+	if err != nil {
+		t.Fatalf("Open embedded storage failed: %v", err)
+	}
+	tm := time.Now().Truncate(time.Millisecond)
+	if err := store.AddHostMetrics(ctx, "node1", tm, types.WsHostMetricsRequest{
+		Load1:    1.5,
+		Networks: []types.NetworkIO{{Interface: "eth0", RxBytes: 1024, TxBytes: 512}},
+	}); err != nil {
+		t.Fatalf("AddHostMetrics failed: %v", err)
+	}
+	store.Disconnect(ctx)
+
+	store, err = NewEmbeddedDB(dir, time.Hour, "test")
+	if err != nil {
+		t.Fatalf("Reopen embedded storage failed: %v", err)
+	}
+	defer store.Disconnect(ctx)
+	samples := store.(*embeddedDB).hosts["node1"]
+	if len(samples) != 1 || !samples[0].Timestamp.Equal(tm) || samples[0].Load1 != 1.5 || samples[0].Networks[0].Interface != "eth0" {
+		t.Fatalf("unexpected host metrics after recovery: %+v", samples)
+	}
+}
+
+// go test -v -timeout 30s -count=1 -run TestEmbeddedRecovery health-monitoring/db
+func TestEmbeddedRecovery(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	store, err := NewEmbeddedDB(dir, time.Hour, "test")
+	if err != nil {
+		t.Fatalf("Open embedded storage failed: %v", err)
+	}
+	if err := store.VerifyDevice(ctx, "node1", []byte("key1"), true); err != nil {
+		t.Fatalf("VerifyDevice failed: %v", err)
+	}
+	if err := store.NodeOnline(ctx, "node1", "session1", []byte("key1")); err != nil {
+		t.Fatalf("NodeOnline failed: %v", err)
+	}
+	tm := time.Now().Truncate(time.Millisecond)
+	for i := 0; i < 10; i++ {
+		if err := store.AddDeviceInfo(ctx, "node1", tm.Add(time.Duration(i-10)*time.Second), types.WsMachineInfoRequest{
+			UtilizationGPU: i,
+		}); err != nil {
+			t.Fatalf("AddDeviceInfo failed: %v", err)
+		}
+	}
+	store.Disconnect(ctx)
+
+	// A crash in the middle of a write leaves a torn record at the end of the segment
+	segments, _, err := logFiles(dir)
+	if err != nil || len(segments) == 0 {
+		t.Fatalf("expect segments in the data directory, got %v %v", segments, err)
+	}
+	f, err := os.OpenFile(filepath.Join(dir, segmentName(segments[len(segments)-1])), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("Open segment failed: %v", err)
+	}
+	f.Write([]byte{0, 0, 1, 0, 1, 2})
+	f.Close()
+
+	// The online records of the same instance are deleted at startup, others are kept
+	store, err = NewEmbeddedDB(dir, time.Hour, "other")
+	if err != nil {
+		t.Fatalf("Reopen embedded storage failed: %v", err)
+	}
+	if !store.IsNodeOnline(ctx, "node1") {
+		t.Fatal("online record of another instance should be recovered")
+	}
+	if err := store.VerifyDevice(ctx, "node1", []byte("key2"), true); err != ErrPubKeyMismatch {
+		t.Fatalf("pinned key should be recovered, got %v", err)
+	}
+	info, err := store.GetLatestDeviceInfo(ctx, "node1")
+	if err != nil || info.UtilizationGPU != 9 || !info.Timestamp.Equal(tm.Add(-time.Second)) {
+		t.Fatalf("unexpected latest device info after recovery: %+v %v", info, err)
+	}
+	store.Disconnect(ctx)
+
+	store, err = NewEmbeddedDB(dir, time.Hour, "test")
+	if err != nil {
+		t.Fatalf("Reopen embedded storage failed: %v", err)
+	}
+	defer store.Disconnect(ctx)
+	if store.IsNodeOnline(ctx, "node1") {
+		t.Fatal("online record of the same instance should be deleted at startup")
+	}
+}
+
+// go test -v -timeout 30s -count=1 -run TestEmbeddedCompaction health-monitoring/db
+func TestEmbeddedCompaction(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	store, err := NewEmbeddedDB(dir, time.Hour, "test")
+	if err != nil {
+		t.Fatalf("Open embedded storage failed: %v", err)
+	}
+	if err := store.RegisterDevice(ctx, types.MDBDeviceRegistry{DeviceId: "node1", Project: "p1"}); err != nil {
+		t.Fatalf("RegisterDevice failed: %v", err)
+	}
+	tm := time.Now().Truncate(time.Millisecond)
+	for _, offset := range []time.Duration{-50 * time.Minute, -30 * time.Minute, -10 * time.Minute} {
+		if err := store.AddDeviceInfo(ctx, "node1", tm.Add(offset), types.WsMachineInfoRequest{}); err != nil {
+			t.Fatalf("AddDeviceInfo failed: %v", err)
+		}
+	}
+	// Pretend the first two samples have expired
+	store.(*embeddedDB).expireTime = 20 * time.Minute
+	if err := store.(*embeddedDB).compact(); err != nil {
+		t.Fatalf("compact failed: %v", err)
+	}
+	segments, snapshots, err := logFiles(dir)
+	if err != nil || len(segments) != 1 || len(snapshots) != 1 || segments[0] <= snapshots[0] {
+		t.Fatalf("expect one snapshot and one segment after it, got %v %v %v", snapshots, segments, err)
+	}
+	if err := store.AddDeviceInfo(ctx, "node1", tm, types.WsMachineInfoRequest{}); err != nil {
+		t.Fatalf("AddDeviceInfo failed: %v", err)
+	}
+	store.Disconnect(ctx)
+
+	store, err = NewEmbeddedDB(dir, time.Hour, "test")
+	if err != nil {
+		t.Fatalf("Reopen embedded storage failed: %v", err)
+	}
+	defer store.Disconnect(ctx)
+	devices, err := store.ListDevices(ctx)
+	if err != nil || len(devices) != 1 || devices[0].Project != "p1" {
+		t.Fatalf("unexpected devices after compaction: %+v %v", devices, err)
+	}
+	points, err := store.GetDeviceInfoHistory(ctx, "node1", tm.Add(-time.Hour), tm.Add(time.Second), time.Hour, types.AggAvg)
+	if err != nil {
+		t.Fatalf("GetDeviceInfoHistory failed: %v", err)
+	}
+	count := 0
+	for _, point := range points {
+		count += point.Count
+	}
+	if count != 2 {
+		t.Fatalf("expect 2 samples left after compaction, got %v", count)
+	}
+}
+
+// go test -v -timeout 30s -count=1 -run TestEmbeddedUndecodableRecord health-monitoring/db
+func TestEmbeddedUndecodableRecord(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	store, err := NewEmbeddedDB(dir, time.Hour, "test")
+	if err != nil {
+		t.Fatalf("Open embedded storage failed: %v", err)
+	}
+	edb := store.(*embeddedDB)
+	tm := time.Now().Truncate(time.Millisecond)
+	if err := store.AddDeviceInfo(ctx, "node1", tm.Add(-time.Second), types.WsMachineInfoRequest{}); err != nil {
+		t.Fatalf("AddDeviceInfo failed: %v", err)
+	}
+	// A record with a valid checksum which cannot be decoded, followed by a valid one
+	edb.logMutex.Lock()
+	if err := edb.appendRecord(recordHostMetrics, "not host metrics"); err != nil {
+		t.Fatalf("appendRecord failed: %v", err)
+	}
+	edb.logMutex.Unlock()
+	if err := store.AddDeviceInfo(ctx, "node1", tm, types.WsMachineInfoRequest{}); err != nil {
+		t.Fatalf("AddDeviceInfo failed: %v", err)
+	}
+	seq := edb.seq
+	store.Disconnect(ctx)
+	path := filepath.Join(dir, segmentName(seq))
+	before, _ := os.Stat(path)
+
+	// The load fails without truncating the records after the bad one
+	if _, err := NewEmbeddedDB(dir, time.Hour, "test"); err == nil || errors.Is(err, errCorruptRecord) {
+		t.Fatalf("expect a hard failure of the undecodable record, got %v", err)
+	}
+	after, _ := os.Stat(path)
+	if after.Size() != before.Size() {
+		t.Fatalf("expect segment of %v bytes kept, got %v", before.Size(), after.Size())
+	}
+}
+
+// go test -v -timeout 30s -count=1 -run TestEmbeddedAppendFailure health-monitoring/db
+func TestEmbeddedAppendFailure(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewEmbeddedDB(t.TempDir(), time.Hour, "test")
+	if err != nil {
+		t.Fatalf("Open embedded storage failed: %v", err)
+	}
+	defer store.Disconnect(ctx)
+	edb := store.(*embeddedDB)
+	if err := store.RegisterDevice(ctx, types.MDBDeviceRegistry{DeviceId: "node1", Project: "p1"}); err != nil {
+		t.Fatalf("RegisterDevice failed: %v", err)
+	}
+	if err := store.NodeOnline(ctx, "node1", "session1", nil); err != nil {
+		t.Fatalf("NodeOnline failed: %v", err)
+	}
+
+	// Every append fails once the segment is closed, the memory must not change
+	edb.segment.Close()
+	tm := time.Now()
+	if err := store.AddDeviceInfo(ctx, "node1", tm, types.WsMachineInfoRequest{}); err == nil {
+		t.Fatal("expect AddDeviceInfo failed")
+	}
+	if _, err := store.GetLatestDeviceInfo(ctx, "node1"); !errors.Is(err, ErrDeviceInfoNotFound) {
+		t.Fatalf("expect no device info in memory, got %v", err)
+	}
+	if err := store.AddHostMetrics(ctx, "node1", tm, types.WsHostMetricsRequest{}); err == nil || len(edb.hosts["node1"]) != 0 {
+		t.Fatalf("expect AddHostMetrics failed without host metrics in memory, got %v", err)
+	}
+	if err := store.RegisterDevice(ctx, types.MDBDeviceRegistry{DeviceId: "node1", Project: "p2"}); err == nil {
+		t.Fatal("expect RegisterDevice failed")
+	}
+	if err := store.RegisterDevice(ctx, types.MDBDeviceRegistry{DeviceId: "node2"}); err == nil {
+		t.Fatal("expect RegisterDevice failed")
+	}
+	devices, _ := store.ListDevices(ctx)
+	if len(devices) != 1 || devices[0].Project != "p1" {
+		t.Fatalf("expect the registry unchanged, got %+v", devices)
+	}
+	if err := store.NodeOffline(ctx, "node1", "session1"); err == nil || !store.IsNodeOnline(ctx, "node1") {
+		t.Fatalf("expect NodeOffline failed with the device still online, got %v", err)
+	}
+	if err := store.NodeOnline(ctx, "node2", "session2", nil); err == nil || store.IsNodeOnline(ctx, "node2") {
+		t.Fatalf("expect NodeOnline failed with the device offline, got %v", err)
+	}
+	if _, err := store.TakeoverNodeOnline(ctx, "node1", "session3", nil, false); err == nil {
+		t.Fatal("expect TakeoverNodeOnline failed")
+	}
+	if owned, _ := store.OwnedSessions(ctx, []string{"session1"}); !owned["session1"] {
+		t.Fatal("expect session1 to still own node1")
+	}
+	if err := store.RevokeDevice(ctx, "node1"); err == nil {
+		t.Fatal("expect RevokeDevice failed")
+	}
+	devices, _ = store.ListDevices(ctx)
+	if len(devices) != 1 || devices[0].Revoked || !store.IsNodeOnline(ctx, "node1") {
+		t.Fatalf("expect node1 neither revoked nor offline, got %+v", devices)
+	}
+}
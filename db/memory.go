@@ -0,0 +1,646 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"maps"
+	"math"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"health-monitoring/types"
+)
+
+// memoryDB keeps everything in memory, it is lost when the process exits. It is meant
+// for tests and for trying the service without a database.
+type memoryDB struct {
+	instance   string
+	expireTime time.Duration
+	registry   map[string]types.MDBDeviceRegistry
+	online     map[string]types.MDBDeviceOnline
+	infos      map[string][]types.MDBDeviceInfo   // samples of each device sorted by timestamp
+	gpuInfos   map[string][]types.MDBDeviceInfo   // samples of the GPUs of each device sorted by timestamp
+	hosts      map[string][]types.MDBHostMetrics  // host metrics of each device sorted by timestamp
+	customs    map[string][]types.MDBCustomMetric // custom metrics of each device sorted by timestamp
+	models     map[string][]types.MDBModelMetrics // model metrics of each device sorted by timestamp
+	mutex      sync.RWMutex
+}
+
+// NewMemoryDB creates an in-memory storage, samples older than expireTime are dropped,
+// zero keeps them forever.
+func NewMemoryDB(expireTime time.Duration, instance string) Store {
+	return newMemoryDB(expireTime, instance)
+}
+
+func newMemoryDB(expireTime time.Duration, instance string) *memoryDB {
+	return &memoryDB{
+		instance:   instance,
+		expireTime: expireTime,
+		registry:   make(map[string]types.MDBDeviceRegistry),
+		online:     make(map[string]types.MDBDeviceOnline),
+		infos:      make(map[string][]types.MDBDeviceInfo),
+		gpuInfos:   make(map[string][]types.MDBDeviceInfo),
+		hosts:      make(map[string][]types.MDBHostMetrics),
+		customs:    make(map[string][]types.MDBCustomMetric),
+		models:     make(map[string][]types.MDBModelMetrics),
+	}
+}
+
+// clone copies the state, the caller must hold the lock for reading. The samples are
+// copied too since inserts shift them in place.
+func (db *memoryDB) clone() *memoryDB {
+	c := newMemoryDB(db.expireTime, db.instance)
+	maps.Copy(c.registry, db.registry)
+	maps.Copy(c.online, db.online)
+	cloneSamples(c.infos, db.infos)
+	cloneSamples(c.gpuInfos, db.gpuInfos)
+	cloneSamples(c.hosts, db.hosts)
+	cloneSamples(c.customs, db.customs)
+	cloneSamples(c.models, db.models)
+	return c
+}
+
+func cloneSamples[T any](dst, src map[string][]T) {
+	for nodeId, samples := range src {
+		dst[nodeId] = slices.Clone(samples)
+	}
+}
+
+func (db *memoryDB) VerifyDevice(ctx context.Context, nodeId string, pubKey []byte, autoRegister bool) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	device, changed, err := db.verifiedDevice(nodeId, pubKey, autoRegister)
+	if err != nil || !changed {
+		return err
+	}
+	db.registry[nodeId] = device
+	return nil
+}
+
+// verifiedDevice checks the device like VerifyDevice and returns its registry with the key
+// pinned, changed is false if the registry does not change. The caller must hold mutex.
+func (db *memoryDB) verifiedDevice(nodeId string, pubKey []byte, autoRegister bool) (types.MDBDeviceRegistry, bool, error) {
+	device, ok := db.registry[nodeId]
+	if !ok {
+		if !autoRegister {
+			return device, false, ErrDeviceNotRegistered
+		}
+		return types.MDBDeviceRegistry{
+			DeviceId:   nodeId,
+			PubKey:     pubKey,
+			AddTime:    time.Now(),
+			UpdateTime: time.Now(),
+		}, true, nil
+	}
+	if device.Revoked {
+		return device, false, ErrDeviceRevoked
+	}
+	if len(device.PubKey) == 0 {
+		device.PubKey = pubKey
+		device.UpdateTime = time.Now()
+		return device, true, nil
+	}
+	if !bytes.Equal(device.PubKey, pubKey) {
+		return device, false, ErrPubKeyMismatch
+	}
+	return device, false, nil
+}
+
+func (db *memoryDB) RegisterDevice(ctx context.Context, device types.MDBDeviceRegistry) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	db.registry[device.DeviceId] = db.registeredDevice(device)
+	return nil
+}
+
+// registeredDevice returns the registry of the device after RegisterDevice, the caller
+// must hold mutex.
+func (db *memoryDB) registeredDevice(device types.MDBDeviceRegistry) types.MDBDeviceRegistry {
+	old, ok := db.registry[device.DeviceId]
+	if !ok {
+		old = types.MDBDeviceRegistry{
+			DeviceId: device.DeviceId,
+			AddTime:  time.Now(),
+		}
+	}
+	old.Project = device.Project
+	old.Owner = device.Owner
+	old.Revoked = false
+	old.UpdateTime = time.Now()
+	if len(device.PubKey) != 0 {
+		old.PubKey = device.PubKey
+	}
+	return old
+}
+
+func (db *memoryDB) RevokeDevice(ctx context.Context, nodeId string) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	device, err := db.revokedDevice(nodeId)
+	if err != nil {
+		return err
+	}
+	db.registry[nodeId] = device
+	delete(db.online, nodeId)
+	return nil
+}
+
+// revokedDevice returns the registry of the device after RevokeDevice, the caller must
+// hold mutex.
+func (db *memoryDB) revokedDevice(nodeId string) (types.MDBDeviceRegistry, error) {
+	device, ok := db.registry[nodeId]
+	if !ok {
+		return device, ErrDeviceNotRegistered
+	}
+	device.Revoked = true
+	device.UpdateTime = time.Now()
+	return device, nil
+}
+
+func (db *memoryDB) ListDevices(ctx context.Context) ([]types.MDBDeviceRegistry, error) {
+	db.mutex.RLock()
+	devices := make([]types.MDBDeviceRegistry, 0, len(db.registry))
+	for _, device := range db.registry {
+		devices = append(devices, device)
+	}
+	db.mutex.RUnlock()
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].DeviceId < devices[j].DeviceId
+	})
+	return devices, nil
+}
+
+// isLive reports whether the online record has not expired.
+func isLive(online types.MDBDeviceOnline, now time.Time) bool {
+	return online.Heartbeat.After(now.Add(-OnlineLease))
+}
+
+func (db *memoryDB) NodeOnline(ctx context.Context, nodeId, session string, pubKey []byte) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	online, _, err := db.nodeOnline(nodeId, session, pubKey, false, false)
+	if err != nil {
+		return err
+	}
+	db.online[nodeId] = online
+	return nil
+}
+
+func (db *memoryDB) TakeoverNodeOnline(ctx context.Context, nodeId, session string, pubKey []byte, sameKey bool) (*types.MDBDeviceOnline, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	online, old, err := db.nodeOnline(nodeId, session, pubKey, true, sameKey)
+	if err != nil {
+		return nil, err
+	}
+	db.online[nodeId] = online
+	return old, nil
+}
+
+// nodeOnline returns the online record of the session and the record it replaces, nil if
+// there is none. ErrNodeAlreadyOnline is returned if the device is online with another
+// live session that cannot be taken over: any when takeover is false, one of another key
+// when sameKey is set. The caller must hold mutex.
+func (db *memoryDB) nodeOnline(nodeId, session string, pubKey []byte, takeover, sameKey bool) (types.MDBDeviceOnline, *types.MDBDeviceOnline, error) {
+	now := time.Now()
+	old, ok := db.online[nodeId]
+	if ok && isLive(old, now) && (!takeover || sameKey && !bytes.Equal(old.PubKey, pubKey)) {
+		return types.MDBDeviceOnline{}, nil, ErrNodeAlreadyOnline
+	}
+	online := types.MDBDeviceOnline{
+		DeviceId:  nodeId,
+		AddTime:   now,
+		Instance:  db.instance,
+		Heartbeat: now,
+		Session:   session,
+		PubKey:    pubKey,
+	}
+	if !ok {
+		return online, nil, nil
+	}
+	return online, &old, nil
+}
+
+func (db *memoryDB) RefreshNodeOnline(ctx context.Context, nodeId, session string) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if online, ok := db.online[nodeId]; ok && online.Session == session {
+		online.Heartbeat = time.Now()
+		db.online[nodeId] = online
+	}
+	return nil
+}
+
+func (db *memoryDB) NodeOffline(ctx context.Context, nodeId, session string) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.ownsOnline(nodeId, session) {
+		delete(db.online, nodeId)
+	}
+	return nil
+}
+
+// ownsOnline reports whether the session owns the online record of the device, the caller
+// must hold mutex.
+func (db *memoryDB) ownsOnline(nodeId, session string) bool {
+	online, ok := db.online[nodeId]
+	return ok && online.Session == session
+}
+
+func (db *memoryDB) IsNodeOnline(ctx context.Context, nodeId string) bool {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	online, ok := db.online[nodeId]
+	return ok && isLive(online, time.Now())
+}
+
+func (db *memoryDB) ListOnlineDevices(ctx context.Context) ([]types.MDBDeviceOnline, error) {
+	db.mutex.RLock()
+	now := time.Now()
+	devices := make([]types.MDBDeviceOnline, 0, len(db.online))
+	for _, online := range db.online {
+		if isLive(online, now) {
+			devices = append(devices, online)
+		}
+	}
+	db.mutex.RUnlock()
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].DeviceId < devices[j].DeviceId
+	})
+	return devices, nil
+}
+
+func (db *memoryDB) OwnedSessions(ctx context.Context, sessions []string) (map[string]bool, error) {
+	wanted := make(map[string]bool, len(sessions))
+	for _, session := range sessions {
+		wanted[session] = true
+	}
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	owned := make(map[string]bool, len(sessions))
+	for _, online := range db.online {
+		if wanted[online.Session] {
+			owned[online.Session] = true
+		}
+	}
+	return owned, nil
+}
+
+func (db *memoryDB) AddDeviceInfo(ctx context.Context, nodeId string, tm time.Time, info types.WsMachineInfoRequest) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	for _, deviceInfo := range newDeviceInfos(nodeId, tm, info) {
+		db.insertDeviceInfo(deviceInfo)
+	}
+	return nil
+}
+
+func (db *memoryDB) AddDeviceInfos(ctx context.Context, infos []types.MDBDeviceInfo) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	for _, info := range infos {
+		db.insertDeviceInfo(info)
+	}
+	return nil
+}
+
+func newDeviceInfo(nodeId string, tm time.Time, info types.WsMachineInfoRequest) types.MDBDeviceInfo {
+	return types.MDBDeviceInfo{
+		Timestamp: tm,
+		Device: types.MDBMetaField{
+			DeviceId: nodeId,
+			Project:  info.Project,
+			Models:   info.Models,
+			GPUName:  info.GPUName,
+		},
+		UtilizationGPU: info.UtilizationGPU,
+		MemoryTotal:    info.MemoryTotal,
+		MemoryUsed:     info.MemoryUsed,
+	}
+}
+
+// newDeviceInfos returns the sample of the device followed by the samples of its GPUs.
+func newDeviceInfos(nodeId string, tm time.Time, info types.WsMachineInfoRequest) []types.MDBDeviceInfo {
+	infos := make([]types.MDBDeviceInfo, 0, 1+len(info.GPUs))
+	infos = append(infos, newDeviceInfo(nodeId, tm, info))
+	for _, gpu := range info.GPUs {
+		index := gpu.Index
+		infos = append(infos, types.MDBDeviceInfo{
+			Timestamp: tm,
+			Device: types.MDBMetaField{
+				DeviceId: nodeId,
+				Project:  info.Project,
+				Models:   info.Models,
+				GPUName:  gpu.Name,
+				GPUIndex: &index,
+				GPUUUID:  gpu.UUID,
+			},
+			UtilizationGPU: gpu.UtilizationGPU,
+			MemoryTotal:    gpu.MemoryTotal,
+			MemoryUsed:     gpu.MemoryUsed,
+			GPU: &types.MDBGPUInfo{
+				Temperature: gpu.Temperature,
+				PowerDraw:   gpu.PowerDraw,
+				FanSpeed:    gpu.FanSpeed,
+				ClockSM:     gpu.ClockSM,
+				ClockMemory: gpu.ClockMemory,
+			},
+		})
+	}
+	return infos
+}
+
+// insertDeviceInfo inserts the sample in order and drops the expired ones of the device,
+// the caller must hold the write lock. The samples of GPUs are kept apart from the
+// samples of devices, which are the ones queried.
+func (db *memoryDB) insertDeviceInfo(info types.MDBDeviceInfo) {
+	samples := db.infos
+	if info.Device.GPUIndex != nil {
+		samples = db.gpuInfos
+	}
+	insertSample(samples, info.Device.DeviceId, info, deviceInfoTime, db.expireTime)
+}
+
+func (db *memoryDB) GetLatestDeviceInfo(ctx context.Context, nodeId string) (*types.MDBDeviceInfo, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	infos := db.infos[nodeId]
+	if len(infos) == 0 {
+		return nil, ErrDeviceInfoNotFound
+	}
+	info := infos[len(infos)-1]
+	return &info, nil
+}
+
+func (db *memoryDB) GetLatestDeviceInfos(ctx context.Context, nodeIds []string) (map[string]types.MDBDeviceInfo, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	result := make(map[string]types.MDBDeviceInfo, len(nodeIds))
+	for _, nodeId := range nodeIds {
+		if infos := db.infos[nodeId]; len(infos) != 0 {
+			result[nodeId] = infos[len(infos)-1]
+		}
+	}
+	return result, nil
+}
+
+func (db *memoryDB) GetDeviceInfoHistory(ctx context.Context, nodeId string, from, to time.Time, step time.Duration, agg string) ([]types.DeviceInfoPoint, error) {
+	if !isAggregation(agg) {
+		return nil, ErrUnknownAggregation
+	}
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	return aggregateDeviceInfo(db.infos[nodeId], from, to, step, agg), nil
+}
+
+func (db *memoryDB) DeleteExpiredDeviceInfo(ctx context.Context, tm time.Time) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	db.deleteDeviceInfoBefore(tm)
+	return nil
+}
+
+// deleteDeviceInfoBefore deletes the samples before tm, the caller must hold the write lock.
+func (db *memoryDB) deleteDeviceInfoBefore(tm time.Time) {
+	deleteSamplesBefore(db.infos, tm, deviceInfoTime)
+	deleteSamplesBefore(db.gpuInfos, tm, deviceInfoTime)
+	deleteSamplesBefore(db.hosts, tm, hostMetricsTime)
+	deleteSamplesBefore(db.customs, tm, customMetricTime)
+	deleteSamplesBefore(db.models, tm, modelMetricsTime)
+}
+
+func (db *memoryDB) AddHostMetrics(ctx context.Context, nodeId string, tm time.Time, metrics types.WsHostMetricsRequest) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	db.insertHostMetrics(newHostMetrics(nodeId, tm, metrics))
+	return nil
+}
+
+func newHostMetrics(nodeId string, tm time.Time, metrics types.WsHostMetricsRequest) types.MDBHostMetrics {
+	return types.MDBHostMetrics{
+		Timestamp:      tm,
+		Device:         types.MDBHostMetaField{DeviceId: nodeId},
+		CPUUtilization: metrics.CPUUtilization,
+		CPUCores:       metrics.CPUCores,
+		Load1:          metrics.Load1,
+		Load5:          metrics.Load5,
+		Load15:         metrics.Load15,
+		MemoryTotal:    metrics.MemoryTotal,
+		MemoryUsed:     metrics.MemoryUsed,
+		Disks:          metrics.Disks,
+		Networks:       metrics.Networks,
+		Uptime:         metrics.Uptime,
+	}
+}
+
+// insertHostMetrics inserts the sample in order and drops the expired ones of the device
+// like insertDeviceInfo, the caller must hold the write lock.
+func (db *memoryDB) insertHostMetrics(metrics types.MDBHostMetrics) {
+	insertSample(db.hosts, metrics.Device.DeviceId, metrics, hostMetricsTime, db.expireTime)
+}
+
+func (db *memoryDB) AddCustomMetrics(ctx context.Context, nodeId string, tm time.Time, samples []types.CustomSample) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	for _, metric := range newCustomMetrics(nodeId, tm, samples) {
+		db.insertCustomMetric(metric)
+	}
+	return nil
+}
+
+// newCustomMetrics returns the samples to store, the samples without timestamp take tm.
+func newCustomMetrics(nodeId string, tm time.Time, samples []types.CustomSample) []types.MDBCustomMetric {
+	metrics := make([]types.MDBCustomMetric, 0, len(samples))
+	for _, sample := range samples {
+		timestamp := tm
+		if sample.Timestamp != 0 {
+			timestamp = time.UnixMilli(sample.Timestamp)
+		}
+		metrics = append(metrics, types.MDBCustomMetric{
+			Timestamp: timestamp,
+			Device: types.MDBCustomMetaField{
+				DeviceId: nodeId,
+				Name:     sample.Name,
+				Labels:   sample.Labels,
+			},
+			Type:    sample.Type,
+			Value:   sample.Value,
+			Buckets: sample.Buckets,
+			Count:   sample.Count,
+			Sum:     sample.Sum,
+		})
+	}
+	return metrics
+}
+
+// insertCustomMetric inserts the sample like insertHostMetrics, the caller must hold the
+// write lock.
+func (db *memoryDB) insertCustomMetric(metric types.MDBCustomMetric) {
+	insertSample(db.customs, metric.Device.DeviceId, metric, customMetricTime, db.expireTime)
+}
+
+func (db *memoryDB) AddModelMetrics(ctx context.Context, nodeId string, tm time.Time, metrics types.WsModelMetricsRequest) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	for _, model := range newModelMetrics(nodeId, tm, metrics) {
+		db.insertModelMetrics(model)
+	}
+	return nil
+}
+
+// newModelMetrics returns one sample of each model.
+func newModelMetrics(nodeId string, tm time.Time, metrics types.WsModelMetricsRequest) []types.MDBModelMetrics {
+	models := make([]types.MDBModelMetrics, 0, len(metrics.Models))
+	for _, model := range metrics.Models {
+		models = append(models, types.MDBModelMetrics{
+			Timestamp: tm,
+			Device: types.MDBModelMetaField{
+				DeviceId: nodeId,
+				Project:  metrics.Project,
+				Model:    model.Model,
+			},
+			RequestsPerSecond:         model.RequestsPerSecond,
+			PromptTokensPerSecond:     model.PromptTokensPerSecond,
+			CompletionTokensPerSecond: model.CompletionTokensPerSecond,
+			TimeToFirstToken:          model.TimeToFirstToken,
+			Latency:                   model.Latency,
+			QueueDepth:                model.QueueDepth,
+			Errors:                    model.Errors,
+			ContextLength:             model.ContextLength,
+		})
+	}
+	return models
+}
+
+// insertModelMetrics inserts the sample like insertHostMetrics, the caller must hold the
+// write lock.
+func (db *memoryDB) insertModelMetrics(metrics types.MDBModelMetrics) {
+	insertSample(db.models, metrics.Device.DeviceId, metrics, modelMetricsTime, db.expireTime)
+}
+
+func deviceInfoTime(info types.MDBDeviceInfo) time.Time { return info.Timestamp }
+
+func hostMetricsTime(metrics types.MDBHostMetrics) time.Time { return metrics.Timestamp }
+
+func customMetricTime(metric types.MDBCustomMetric) time.Time { return metric.Timestamp }
+
+func modelMetricsTime(metrics types.MDBModelMetrics) time.Time { return metrics.Timestamp }
+
+// insertSample inserts the sample into the samples of the device sorted by timestamp, and
+// drops the ones older than expireTime unless it is zero.
+func insertSample[T any](samples map[string][]T, nodeId string, sample T, timestamp func(T) time.Time, expireTime time.Duration) {
+	list := samples[nodeId]
+	// Samples usually arrive in order, search from the end
+	i := len(list)
+	for i > 0 && timestamp(list[i-1]).After(timestamp(sample)) {
+		i--
+	}
+	var zero T
+	list = append(list, zero)
+	copy(list[i+1:], list[i:])
+	list[i] = sample
+	if expireTime > 0 {
+		list = dropSamplesBefore(list, time.Now().Add(-expireTime), timestamp)
+	}
+	if len(list) == 0 {
+		delete(samples, nodeId)
+	} else {
+		samples[nodeId] = list
+	}
+}
+
+// deleteSamplesBefore removes the samples before tm of all devices.
+func deleteSamplesBefore[T any](samples map[string][]T, tm time.Time, timestamp func(T) time.Time) {
+	for nodeId, list := range samples {
+		if list = dropSamplesBefore(list, tm, timestamp); len(list) == 0 {
+			delete(samples, nodeId)
+		} else {
+			samples[nodeId] = list
+		}
+	}
+}
+
+// dropSamplesBefore removes the samples before tm from the sorted samples.
+func dropSamplesBefore[T any](samples []T, tm time.Time, timestamp func(T) time.Time) []T {
+	i := sort.Search(len(samples), func(i int) bool {
+		return !timestamp(samples[i]).Before(tm)
+	})
+	return samples[i:]
+}
+
+func (db *memoryDB) Ping(ctx context.Context) error { return nil }
+
+func (db *memoryDB) Disconnect(ctx context.Context) {}
+
+func isAggregation(agg string) bool {
+	switch agg {
+	case types.AggAvg, types.AggMax, types.AggMin, types.AggP95:
+		return true
+	}
+	return false
+}
+
+// aggregateDeviceInfo aggregates the sorted samples in [from, to) into buckets of step.
+func aggregateDeviceInfo(infos []types.MDBDeviceInfo, from, to time.Time, step time.Duration, agg string) []types.DeviceInfoPoint {
+	points := make([]types.DeviceInfoPoint, 0)
+	var utilization, memoryTotal, memoryUsed []float64
+	flush := func(bucket time.Time) {
+		if len(utilization) == 0 {
+			return
+		}
+		points = append(points, types.DeviceInfoPoint{
+			Timestamp:      bucket,
+			UtilizationGPU: aggregate(utilization, agg),
+			MemoryTotal:    aggregate(memoryTotal, agg),
+			MemoryUsed:     aggregate(memoryUsed, agg),
+			Count:          len(utilization),
+		})
+		utilization, memoryTotal, memoryUsed = utilization[:0], memoryTotal[:0], memoryUsed[:0]
+	}
+
+	var bucket time.Time
+	for _, info := range dropSamplesBefore(infos, from, deviceInfoTime) {
+		if !info.Timestamp.Before(to) {
+			break
+		}
+		if b := truncateTime(info.Timestamp, step); !b.Equal(bucket) {
+			flush(bucket)
+			bucket = b
+		}
+		utilization = append(utilization, float64(info.UtilizationGPU))
+		memoryTotal = append(memoryTotal, float64(info.MemoryTotal))
+		memoryUsed = append(memoryUsed, float64(info.MemoryUsed))
+	}
+	flush(bucket)
+	return points
+}
+
+// aggregate computes the aggregation of the values, p95 uses the nearest rank method like
+// percentile_disc of PostgreSQL.
+func aggregate(values []float64, agg string) float64 {
+	switch agg {
+	case types.AggMax:
+		max := math.Inf(-1)
+		for _, v := range values {
+			max = math.Max(max, v)
+		}
+		return max
+	case types.AggMin:
+		min := math.Inf(1)
+		for _, v := range values {
+			min = math.Min(min, v)
+		}
+		return min
+	case types.AggP95:
+		sorted := append([]float64(nil), values...)
+		sort.Float64s(sorted)
+		return sorted[int(math.Ceil(0.95*float64(len(sorted))))-1]
+	}
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
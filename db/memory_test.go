@@ -0,0 +1,208 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"health-monitoring/types"
+)
+
+// go test -v -timeout 30s -count=1 -run TestMemoryNodeOnlineRace health-monitoring/db
+func TestMemoryNodeOnlineRace(t *testing.T) {
+	testNodeOnlineRace(context.Background(), t, NewMemoryDB(time.Minute, "test"))
+}
+
+// go test -v -timeout 30s -count=1 -run TestMemoryLatestDeviceInfo health-monitoring/db
+func TestMemoryLatestDeviceInfo(t *testing.T) {
+	testLatestDeviceInfo(context.Background(), t, NewMemoryDB(time.Hour, "test"))
+}
+
+// go test -v -timeout 30s -count=1 -run TestMemoryGPUDeviceInfo health-monitoring/db
+func TestMemoryGPUDeviceInfo(t *testing.T) {
+	testGPUDeviceInfo(context.Background(), t, NewMemoryDB(time.Hour, "test"))
+}
+
+// go test -v -timeout 30s -count=1 -run TestMemoryOnlineLease health-monitoring/db
+func TestMemoryOnlineLease(t *testing.T) {
+	store := newMemoryDB(time.Hour, "test")
+	testOnlineLease(context.Background(), t, store, store.ageOnline)
+}
+
+// go test -v -timeout 30s -count=1 -run TestMemoryTakeoverNodeOnline health-monitoring/db
+func TestMemoryTakeoverNodeOnline(t *testing.T) {
+	testTakeoverNodeOnline(context.Background(), t, NewMemoryDB(time.Hour, "test"))
+}
+
+// go test -v -timeout 30s -count=1 -run TestMemoryDeviceRegistry health-monitoring/db
+func TestMemoryDeviceRegistry(t *testing.T) {
+	testDeviceRegistry(context.Background(), t, NewMemoryDB(time.Hour, "test"))
+}
+
+// go test -v -timeout 30s -count=1 -run TestMemoryDeviceInfoP95 health-monitoring/db
+func TestMemoryDeviceInfoP95(t *testing.T) {
+	testDeviceInfoP95(context.Background(), t, NewMemoryDB(0, "test"))
+}
+
+// go test -v -timeout 30s -count=1 -run TestMemoryHostMetrics health-monitoring/db
+func TestMemoryHostMetrics(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryDB(time.Hour, "test")
+
+	tm := time.Now().Truncate(time.Millisecond)
+	for _, offset := range []time.Duration{0, -2 * time.Hour, -time.Minute} {
+		if err := store.AddHostMetrics(ctx, "node1", tm.Add(offset), types.WsHostMetricsRequest{
+			CPUUtilization: 12.5,
+			Disks:          []types.DiskUsage{{Mount: "/", Total: 1 << 40, Used: 1 << 39}},
+		}); err != nil {
+			t.Fatalf("AddHostMetrics failed: %v", err)
+		}
+	}
+	samples := store.hosts["node1"]
+	if len(samples) != 2 || !samples[0].Timestamp.Equal(tm.Add(-time.Minute)) || !samples[1].Timestamp.Equal(tm) {
+		t.Fatalf("expect 2 samples in order without the expired one, got %+v", samples)
+	}
+	if samples[1].Device.DeviceId != "node1" || samples[1].Disks[0].Mount != "/" {
+		t.Fatalf("unexpected host metrics: %+v", samples[1])
+	}
+
+	if err := store.DeleteExpiredDeviceInfo(ctx, tm); err != nil {
+		t.Fatalf("DeleteExpiredDeviceInfo failed: %v", err)
+	}
+	if samples := store.hosts["node1"]; len(samples) != 1 {
+		t.Fatalf("expect 1 sample left after expiry, got %+v", samples)
+	}
+}
+
+// go test -v -timeout 30s -count=1 -run TestMemoryCustomMetrics health-monitoring/db
+func TestMemoryCustomMetrics(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryDB(time.Hour, "test")
+
+	tm := time.Now().Truncate(time.Millisecond)
+	if err := store.AddCustomMetrics(ctx, "node1", tm, []types.CustomSample{
+		{Name: "queue_depth", Type: types.CustomMetricGauge, Labels: map[string]string{"model": "a"}, Value: 3},
+		{Name: "queue_depth", Type: types.CustomMetricGauge, Timestamp: tm.Add(-time.Second).UnixMilli(), Value: 2},
+	}); err != nil {
+		t.Fatalf("AddCustomMetrics failed: %v", err)
+	}
+	samples := store.customs["node1"]
+	if len(samples) != 2 || !samples[0].Timestamp.Equal(tm.Add(-time.Second)) || !samples[1].Timestamp.Equal(tm) {
+		t.Fatalf("expect 2 samples sorted by their own timestamps, got %+v", samples)
+	}
+	if samples[1].Device.Name != "queue_depth" || samples[1].Device.Labels["model"] != "a" || samples[1].Value != 3 {
+		t.Fatalf("unexpected custom metric: %+v", samples[1])
+	}
+
+	if err := store.DeleteExpiredDeviceInfo(ctx, tm); err != nil {
+		t.Fatalf("DeleteExpiredDeviceInfo failed: %v", err)
+	}
+	if samples := store.customs["node1"]; len(samples) != 1 {
+		t.Fatalf("expect 1 sample left after expiry, got %+v", samples)
+	}
+}
+
+// go test -v -timeout 30s -count=1 -run TestMemoryModelMetrics health-monitoring/db
+func TestMemoryModelMetrics(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryDB(time.Hour, "test")
+
+	tm := time.Now().Truncate(time.Millisecond)
+	if err := store.AddModelMetrics(ctx, "node1", tm, types.WsModelMetricsRequest{
+		Project: "DecentralGPT",
+		Models: []types.ModelServingMetrics{
+			{Model: "Llama3-70B", RequestsPerSecond: 2.5, Latency: types.Percentiles{P50: 800, P90: 1500, P99: 3000}},
+			{Model: "Qwen2-72B", QueueDepth: 4, Errors: 1},
+		},
+	}); err != nil {
+		t.Fatalf("AddModelMetrics failed: %v", err)
+	}
+	samples := store.models["node1"]
+	if len(samples) != 2 {
+		t.Fatalf("expect one sample of each model, got %+v", samples)
+	}
+	for _, sample := range samples {
+		if sample.Device.DeviceId != "node1" || sample.Device.Project != "DecentralGPT" || !sample.Timestamp.Equal(tm) {
+			t.Fatalf("unexpected meta of model metrics: %+v", sample)
+		}
+	}
+	if samples[0].Device.Model != "Llama3-70B" || samples[0].Latency.P99 != 3000 || samples[1].QueueDepth != 4 {
+		t.Fatalf("unexpected model metrics: %+v", samples)
+	}
+}
+
+// go test -v -timeout 30s -count=1 -run TestMemoryDeviceInfoHistory health-monitoring/db
+func TestMemoryDeviceInfoHistory(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryDB(0, "test")
+
+	from := time.Date(2024, time.September, 1, 10, 0, 0, 0, time.UTC)
+	// two samples in the first minute, one in the third, none in the second
+	samples := []struct {
+		offset      time.Duration
+		utilization int
+	}{
+		{10 * time.Second, 20},
+		{40 * time.Second, 60},
+		{2*time.Minute + 5*time.Second, 90},
+		{3*time.Minute + 5*time.Second, 10}, // out of [from, to)
+	}
+	for _, sample := range samples {
+		if err := store.AddDeviceInfo(ctx, "node1", from.Add(sample.offset), types.WsMachineInfoRequest{
+			UtilizationGPU: sample.utilization,
+			MemoryTotal:    24564,
+			MemoryUsed:     int64(sample.utilization * 100),
+		}); err != nil {
+			t.Fatalf("AddDeviceInfo failed: %v", err)
+		}
+	}
+
+	if _, err := store.GetDeviceInfoHistory(ctx, "node1", from, from.Add(3*time.Minute), time.Minute, "sum"); err != ErrUnknownAggregation {
+		t.Fatalf("expect ErrUnknownAggregation, got %v", err)
+	}
+
+	expects := map[string][]float64{
+		types.AggAvg: {40, 90},
+		types.AggMax: {60, 90},
+		types.AggMin: {20, 90},
+		types.AggP95: {60, 90},
+	}
+	for agg, expect := range expects {
+		points, err := store.GetDeviceInfoHistory(ctx, "node1", from, from.Add(3*time.Minute), time.Minute, agg)
+		if err != nil {
+			t.Fatalf("GetDeviceInfoHistory %v failed: %v", agg, err)
+		}
+		if len(points) != 2 {
+			t.Fatalf("expect 2 points of %v, got %+v", agg, points)
+		}
+		if !points[0].Timestamp.Equal(from) || !points[1].Timestamp.Equal(from.Add(2*time.Minute)) {
+			t.Fatalf("unexpected buckets of %v: %+v", agg, points)
+		}
+		if points[0].Count != 2 || points[1].Count != 1 {
+			t.Fatalf("unexpected sample counts of %v: %+v", agg, points)
+		}
+		for i := range points {
+			if points[i].UtilizationGPU != expect[i] || points[i].MemoryUsed != expect[i]*100 {
+				t.Fatalf("unexpected %v of bucket %v: %+v", agg, i, points[i])
+			}
+		}
+	}
+
+	if err := store.DeleteExpiredDeviceInfo(ctx, from.Add(time.Minute)); err != nil {
+		t.Fatalf("DeleteExpiredDeviceInfo failed: %v", err)
+	}
+	points, err := store.GetDeviceInfoHistory(ctx, "node1", from, from.Add(3*time.Minute), time.Minute, types.AggAvg)
+	if err != nil || len(points) != 1 {
+		t.Fatalf("expect only the third minute left after expiry, got %+v %v", points, err)
+	}
+}
+
+// ageOnline moves the heartbeat of the online record of the device back by d.
+func (db *memoryDB) ageOnline(nodeId string, d time.Duration) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if online, ok := db.online[nodeId]; ok {
+		online.Heartbeat = time.Now().Add(-d)
+		db.online[nodeId] = online
+	}
+}
@@ -3,78 +3,292 @@ package db
 import (
 	"context"
 	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"health-monitoring/log"
 	"health-monitoring/types"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-var MDB *mongoDB = nil
+const (
+	// Calls fail after the timeout instead of waiting for the default 30s when MongoDB is down.
+	mongoServerSelectionTimeout = 5 * time.Second
+	// Interval of checking MongoDB while it is available.
+	mongoPingInterval = 10 * time.Second
+	// Bounds of the backoff of connecting to MongoDB while it is unavailable.
+	mongoMinBackoff = time.Second
+	mongoMaxBackoff = 30 * time.Second
+)
 
 type mongoDB struct {
-	Mongo                  *mongo.Client
-	deviceOnlineCollection *mongo.Collection
-	deviceInfoCollection   *mongo.Collection
+	Mongo                    *mongo.Client
+	database                 string
+	expireTime               int64
+	instance                 string
+	deviceOnlineCollection   *mongo.Collection
+	deviceInfoCollection     *mongo.Collection
+	deviceRegistryCollection *mongo.Collection
+	hostMetricsCollection    *mongo.Collection
+	customMetricsCollection  *mongo.Collection
+	modelMetricsCollection   *mongo.Collection
+
+	available atomic.Bool // 初始化完成并且最近一次检查可以连通
+	done      chan struct{}
+	wg        sync.WaitGroup
+
+	availableGauge prometheus.GaugeFunc
+	opDuration     *prometheus.HistogramVec
+	opErrors       *prometheus.CounterVec
 }
 
-func InitMongo(ctx context.Context, uri, db string, eas int64) error {
+// NewMongoDB connects to MongoDB and prepares the collections. If MongoDB cannot be reached,
+// the storage starts in the degraded mode, the calls return ErrStoreUnavailable until the
+// preparation is retried successfully in the background. The connection is checked
+// periodically afterwards, the calls return ErrStoreUnavailable again while it is lost.
+func NewMongoDB(ctx context.Context, uri, db string, eas int64, instance string) (Store, error) {
+	mdb := &mongoDB{
+		database:   db,
+		expireTime: eas,
+		instance:   instance,
+		done:       make(chan struct{}),
+		opDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "mongo_operation_duration_seconds",
+				Help:    "duration of mongodb commands by command name",
+				Buckets: prometheus.DefBuckets,
+			},
+			[]string{"command"},
+		),
+		opErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "mongo_operation_errors_total",
+				Help: "number of failed mongodb commands by command name",
+			},
+			[]string{"command"},
+		),
+	}
+	mdb.availableGauge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "mongo_available",
+		Help: "whether mongodb is available, 0 in the degraded mode",
+	}, func() float64 {
+		if mdb.available.Load() {
+			return 1
+		}
+		return 0
+	})
+
 	serverAPI := options.ServerAPI(options.ServerAPIVersion1)
-	opts := options.Client().ApplyURI(uri).SetServerAPIOptions(serverAPI)
+	opts := options.Client().
+		ApplyURI(uri).
+		SetServerAPIOptions(serverAPI).
+		SetServerSelectionTimeout(mongoServerSelectionTimeout).
+		SetMonitor(&event.CommandMonitor{
+			Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+				mdb.opDuration.WithLabelValues(e.CommandName).Observe(e.Duration.Seconds())
+			},
+			Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+				mdb.opDuration.WithLabelValues(e.CommandName).Observe(e.Duration.Seconds())
+				mdb.opErrors.WithLabelValues(e.CommandName).Inc()
+			},
+		})
 	client, err := mongo.Connect(ctx, opts)
 	if err != nil {
-		log.Log.Fatalf("Connect mongodb failed: %v", err)
-		return err
+		log.Log.Errorf("Connect mongodb failed: %v", err)
+		return nil, err
 	}
-	if err = client.Ping(ctx, nil); err != nil {
-		log.Log.Fatalf("Ping mongodb failed: %v", err)
-		return err
+	mdb.Mongo = client
+	mdb.deviceOnlineCollection = client.Database(db).Collection("device_online")
+	mdb.deviceInfoCollection = client.Database(db).Collection("device_info")
+	mdb.deviceRegistryCollection = client.Database(db).Collection("device_registry")
+	mdb.hostMetricsCollection = client.Database(db).Collection("host_metrics")
+	mdb.customMetricsCollection = client.Database(db).Collection("custom_metrics")
+	mdb.modelMetricsCollection = client.Database(db).Collection("model_metrics")
+
+	ready := true
+	if err := mdb.setup(ctx); err != nil {
+		log.Log.Errorf("Prepare mongodb failed, start in degraded mode: %v", err)
+		ready = false
+	}
+	mdb.available.Store(ready)
+	mdb.wg.Add(1)
+	go mdb.monitor(ready)
+	return mdb, nil
+}
+
+// setup creates the collections and the indexes, and deletes the online records left by
+// the last run of this instance.
+func (db *mongoDB) setup(ctx context.Context) error {
+	if err := db.Mongo.Ping(ctx, nil); err != nil {
+		return fmt.Errorf("ping mongodb: %w", err)
 	}
-	MDB = &mongoDB{
-		Mongo: client,
+
+	// Samples of device info and the other metrics are kept in time series collections
+	for _, name := range []string{"device_info", "host_metrics", "custom_metrics", "model_metrics"} {
+		if err := db.createTimeSeries(ctx, name); err != nil {
+			return err
+		}
 	}
 
-	cl, err := client.Database(db).ListCollectionNames(ctx, bson.M{"name": "device_info"})
+	// One device can only be registered once
+	if _, err := db.deviceRegistryCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.M{"device_id": 1},
+		Options: options.Index().SetUnique(true),
+	}); err != nil {
+		return fmt.Errorf("create index of device registry: %w", err)
+	}
+
+	// Online records of crashed instances expire when their lease is not refreshed
+	if _, err := db.deviceOnlineCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.M{"heartbeat": 1},
+		Options: options.Index().SetExpireAfterSeconds(int32(OnlineLease.Seconds())),
+	}); err != nil {
+		return fmt.Errorf("create ttl index of device online: %w", err)
+	}
+
+	// The connections of the last run of this instance are gone, and the records written
+	// before leases were introduced would never expire
+	result, err := db.deviceOnlineCollection.DeleteMany(ctx, bson.M{"$or": bson.A{
+		bson.M{"instance": db.instance},
+		bson.M{"heartbeat": bson.M{"$exists": false}},
+	}})
 	if err != nil {
-		log.Log.Fatalf("List mongodb collection names failed: %v", err)
-		return err
+		return fmt.Errorf("delete online records of instance %v: %w", db.instance, err)
 	}
-	if len(cl) == 0 {
-		// Create collection with time series for device info
-		tsOpts := options.TimeSeries()
-		tsOpts.SetTimeField("timestamp")
-		tsOpts.SetMetaField("device")
-		tsOpts.SetGranularity("minutes")
-		// tsOpts.SetBucketMaxSpan(30)
-		// tsOpts.SetBucketRounding(5)
-		ccOpts := options.CreateCollection()
-		ccOpts.SetTimeSeriesOptions(tsOpts)
-		ccOpts.SetExpireAfterSeconds(eas)
-		if err := client.Database(db).CreateCollection(ctx, "device_info", ccOpts); err != nil {
-			log.Log.Fatalf("Create time series collection failed: %v", err)
-			return err
+	log.Log.Infof("Delete online records of instance %v DeletedCount %v", db.instance, result.DeletedCount)
+
+	// One device can only be online once, concurrent connections are decided by the index
+	if _, err := db.deviceOnlineCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.M{"device_id": 1},
+		Options: options.Index().SetUnique(true),
+	}); err != nil {
+		return fmt.Errorf("create unique index of device online, remove the duplicate records first: %w", err)
+	}
+	return nil
+}
+
+// createTimeSeries creates the time series collection with the meta field device if it
+// does not exist.
+func (db *mongoDB) createTimeSeries(ctx context.Context, name string) error {
+	cl, err := db.Mongo.Database(db.database).ListCollectionNames(ctx, bson.M{"name": name})
+	if err != nil {
+		return fmt.Errorf("list mongodb collection names: %w", err)
+	}
+	if len(cl) != 0 {
+		return nil
+	}
+	tsOpts := options.TimeSeries()
+	tsOpts.SetTimeField("timestamp")
+	tsOpts.SetMetaField("device")
+	tsOpts.SetGranularity("minutes")
+	// tsOpts.SetBucketMaxSpan(30)
+	// tsOpts.SetBucketRounding(5)
+	ccOpts := options.CreateCollection()
+	ccOpts.SetTimeSeriesOptions(tsOpts)
+	ccOpts.SetExpireAfterSeconds(db.expireTime)
+	if err := db.Mongo.Database(db.database).CreateCollection(ctx, name, ccOpts); err != nil {
+		return fmt.Errorf("create time series collection %v: %w", name, err)
+	}
+	log.Log.Infof("Create collection %v with time series success", name)
+	return nil
+}
+
+// monitor retries the preparation with backoff until it succeeds, then pings MongoDB
+// periodically to update the availability.
+func (db *mongoDB) monitor(ready bool) {
+	defer db.wg.Done()
+	backoff := mongoMinBackoff
+	wait := mongoPingInterval
+	if !ready {
+		wait = backoff
+	}
+	for {
+		select {
+		case <-db.done:
+			return
+		case <-time.After(wait):
 		}
-		log.Log.Info("Create collection with time series success")
+
+		ctx, cancel := context.WithTimeout(context.Background(), mongoServerSelectionTimeout)
+		var err error
+		if ready {
+			err = db.Mongo.Ping(ctx, nil)
+		} else {
+			err = db.setup(ctx)
+		}
+		cancel()
+
+		if err != nil {
+			if db.available.Swap(false) || !ready {
+				log.Log.Errorf("MongoDB is unavailable, retry in %v: %v", backoff, err)
+			}
+			wait = backoff
+			backoff = min(backoff*2, mongoMaxBackoff)
+			continue
+		}
+		if !ready {
+			log.Log.Info("Prepare mongodb success")
+			ready = true
+		}
+		if !db.available.Swap(true) {
+			log.Log.Info("MongoDB is available")
+		}
+		backoff = mongoMinBackoff
+		wait = mongoPingInterval
 	}
+}
+
+// check returns ErrStoreUnavailable if MongoDB is known to be unavailable, so that the
+// calls fail fast instead of waiting for the server selection timeout.
+func (db *mongoDB) check() error {
+	if !db.available.Load() {
+		return ErrStoreUnavailable
+	}
+	return nil
+}
+
+// Collectors returns the metrics of the mongodb commands to be registered.
+func (db *mongoDB) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{db.availableGauge, db.opDuration, db.opErrors}
+}
 
-	MDB.deviceOnlineCollection = client.Database(db).Collection("device_online")
-	MDB.deviceInfoCollection = client.Database(db).Collection("device_info")
+func (db *mongoDB) Ping(ctx context.Context) error {
+	if err := db.check(); err != nil {
+		return err
+	}
+	if err := db.Mongo.Ping(ctx, nil); err != nil {
+		return fmt.Errorf("%w: %v", ErrStoreUnavailable, err)
+	}
 	return nil
 }
 
 func (db *mongoDB) Disconnect(ctx context.Context) {
+	close(db.done)
+	db.wg.Wait()
 	if err := db.Mongo.Disconnect(ctx); err != nil {
-		panic(err)
+		log.Log.Errorf("Disconnect mongodb failed: %v", err)
 	}
 }
 
 func (db *mongoDB) IsNodeOnline(ctx context.Context, nodeId string) bool {
+	if db.check() != nil {
+		return false
+	}
 	result := types.MDBDeviceOnline{}
-	if err := db.deviceOnlineCollection.FindOne(ctx, bson.M{"device_id": nodeId}).Decode(&result); err != nil {
+	// The ttl monitor only runs every 60 seconds, skip the expired records it has not deleted yet
+	filter := bson.M{
+		"device_id": nodeId,
+		"heartbeat": bson.M{"$gt": time.Now().Add(-OnlineLease)},
+	}
+	if err := db.deviceOnlineCollection.FindOne(ctx, filter).Decode(&result); err != nil {
 		if errors.Is(err, mongo.ErrNoDocuments) {
 			return false
 		}
@@ -83,21 +297,110 @@ func (db *mongoDB) IsNodeOnline(ctx context.Context, nodeId string) bool {
 	return true
 }
 
-func (db *mongoDB) NodeOnline(ctx context.Context, nodeId string) error {
-	res, err := db.deviceOnlineCollection.InsertOne(ctx, types.MDBDeviceOnline{
-		DeviceId: nodeId,
-		AddTime:  time.Now(),
-	})
+// NodeOnline marks the device online in one atomic operation. An expired record left
+// behind by a crashed instance is taken over, while a live record makes the insert
+// fail on the unique index, which is reported as ErrNodeAlreadyOnline.
+func (db *mongoDB) NodeOnline(ctx context.Context, nodeId, session string, pubKey []byte) error {
+	if err := db.check(); err != nil {
+		return err
+	}
+	now := time.Now()
+	res, err := db.deviceOnlineCollection.UpdateOne(
+		ctx,
+		bson.M{
+			"device_id": nodeId,
+			"heartbeat": bson.M{"$lte": now.Add(-OnlineLease)},
+		},
+		bson.M{"$set": types.MDBDeviceOnline{
+			DeviceId:  nodeId,
+			AddTime:   now,
+			Instance:  db.instance,
+			Heartbeat: now,
+			Session:   session,
+			PubKey:    pubKey,
+		}},
+		options.Update().SetUpsert(true),
+	)
 	if err != nil {
-		log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Error("insert online failed: ", err)
+		if mongo.IsDuplicateKeyError(err) {
+			return ErrNodeAlreadyOnline
+		}
+		log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Error("upsert online failed: ", err)
 		return err
 	}
-	log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Info("inserted online id ", res.InsertedID)
+	log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Info("upserted online id ", res.UpsertedID)
 	return nil
 }
 
-func (db *mongoDB) NodeOffline(ctx context.Context, nodeId string) error {
-	result, err := db.deviceOnlineCollection.DeleteOne(ctx, bson.M{"device_id": nodeId})
+// TakeoverNodeOnline marks the device online even if it is still online with another
+// session, and returns the record of the session taken over, nil if there is none.
+// With sameKey only a session of the same public key can be taken over, otherwise
+// ErrNodeAlreadyOnline is returned like NodeOnline.
+func (db *mongoDB) TakeoverNodeOnline(ctx context.Context, nodeId, session string, pubKey []byte, sameKey bool) (*types.MDBDeviceOnline, error) {
+	if err := db.check(); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	filter := bson.M{"device_id": nodeId}
+	if sameKey {
+		filter = bson.M{"device_id": nodeId, "$or": bson.A{
+			bson.M{"pub_key": pubKey},
+			bson.M{"heartbeat": bson.M{"$lte": now.Add(-OnlineLease)}},
+		}}
+	}
+	old := &types.MDBDeviceOnline{}
+	err := db.deviceOnlineCollection.FindOneAndUpdate(
+		ctx,
+		filter,
+		bson.M{"$set": types.MDBDeviceOnline{
+			DeviceId:  nodeId,
+			AddTime:   now,
+			Instance:  db.instance,
+			Heartbeat: now,
+			Session:   session,
+			PubKey:    pubKey,
+		}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.Before),
+	).Decode(old)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Info("inserted online session ", session)
+		return nil, nil
+	}
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, ErrNodeAlreadyOnline
+		}
+		log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Error("takeover online failed: ", err)
+		return nil, err
+	}
+	log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Infof("session %v took over session %v of instance %v", session, old.Session, old.Instance)
+	return old, nil
+}
+
+// RefreshNodeOnline renews the lease of the online record of the session.
+func (db *mongoDB) RefreshNodeOnline(ctx context.Context, nodeId, session string) error {
+	if err := db.check(); err != nil {
+		return err
+	}
+	_, err := db.deviceOnlineCollection.UpdateOne(
+		ctx,
+		bson.M{"device_id": nodeId, "session": session},
+		bson.M{"$set": bson.M{"heartbeat": time.Now()}},
+	)
+	if err != nil {
+		log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Error("refresh online failed: ", err)
+		return err
+	}
+	return nil
+}
+
+// NodeOffline deletes the online record of the session, the record of a new session
+// which has taken over the device is kept.
+func (db *mongoDB) NodeOffline(ctx context.Context, nodeId, session string) error {
+	if err := db.check(); err != nil {
+		return err
+	}
+	result, err := db.deviceOnlineCollection.DeleteOne(ctx, bson.M{"device_id": nodeId, "session": session})
 	if err != nil {
 		log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Error("delete online failed: ", err)
 		return err
@@ -106,80 +409,302 @@ func (db *mongoDB) NodeOffline(ctx context.Context, nodeId string) error {
 	return nil
 }
 
-func (db *mongoDB) GetDeviceInfo(ctx context.Context, nodeId string) (*types.MDBDeviceInfo, error) {
-	result := &types.MDBDeviceInfo{}
-	if err := db.deviceInfoCollection.FindOne(ctx, bson.M{"device_id": nodeId}).Decode(result); err != nil {
+// ListOnlineDevices returns the online records of all instances whose lease has not expired.
+func (db *mongoDB) ListOnlineDevices(ctx context.Context) ([]types.MDBDeviceOnline, error) {
+	if err := db.check(); err != nil {
 		return nil, err
 	}
-	return result, nil
+	devices := make([]types.MDBDeviceOnline, 0)
+	cursor, err := db.deviceOnlineCollection.Find(
+		ctx,
+		bson.M{"heartbeat": bson.M{"$gt": time.Now().Add(-OnlineLease)}},
+		options.Find().SetSort(bson.M{"device_id": 1}),
+	)
+	if err != nil {
+		log.Log.Errorf("Find online devices failed: %v", err)
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	if err := cursor.All(ctx, &devices); err != nil {
+		log.Log.Errorf("Decode cursor of online devices failed: %v", err)
+		return nil, err
+	}
+	return devices, nil
 }
 
-func (db *mongoDB) AddDeviceInfo(ctx context.Context, nodeId string, tm time.Time, info types.WsMachineInfoRequest) error {
-	result, err := db.deviceInfoCollection.InsertOne(
+// OwnedSessions returns which of the sessions still own the online record of their device.
+func (db *mongoDB) OwnedSessions(ctx context.Context, sessions []string) (map[string]bool, error) {
+	if err := db.check(); err != nil {
+		return nil, err
+	}
+	cursor, err := db.deviceOnlineCollection.Find(
 		ctx,
-		types.MDBDeviceInfo{
-			Timestamp: tm,
-			Device: types.MDBMetaField{
-				DeviceId: nodeId,
-				Project:  info.Project,
-				Models:   info.Models,
-				GPUName:  info.GPUName,
-			},
-			UtilizationGPU: info.UtilizationGPU,
-			MemoryTotal:    info.MemoryTotal,
-			MemoryUsed:     info.MemoryUsed,
-		},
+		bson.M{"session": bson.M{"$in": sessions}},
+		options.Find().SetProjection(bson.M{"session": 1}),
 	)
 	if err != nil {
-		log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Error("insert device info failed: ", err)
-		return err
+		log.Log.Errorf("Find online sessions failed: %v", err)
+		return nil, err
 	}
-	log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Info("inserted device info id ", result.InsertedID)
-	return nil
+	defer cursor.Close(ctx)
+	owned := make(map[string]bool, len(sessions))
+	for cursor.Next(ctx) {
+		result := types.MDBDeviceOnline{}
+		if err := cursor.Decode(&result); err != nil {
+			log.Log.Errorf("Decode online session failed: %v", err)
+			return nil, err
+		}
+		owned[result.Session] = true
+	}
+	if err := cursor.Err(); err != nil {
+		log.Log.Errorf("Traversal online sessions failed: %v", err)
+		return nil, err
+	}
+	return owned, nil
 }
 
-func (db *mongoDB) DeleteExpiredDeviceInfo(ctx context.Context, tm time.Time) error {
-	result, err := db.deviceInfoCollection.DeleteMany(
+// GetLatestDeviceInfo returns the latest sample of the device, ErrDeviceInfoNotFound if
+// the device has no sample.
+func (db *mongoDB) GetLatestDeviceInfo(ctx context.Context, nodeId string) (*types.MDBDeviceInfo, error) {
+	if err := db.check(); err != nil {
+		return nil, err
+	}
+	result := &types.MDBDeviceInfo{}
+	err := db.deviceInfoCollection.FindOne(
 		ctx,
-		bson.M{
-			"timestamp": bson.M{"$lt": tm},
-		},
-	)
+		bson.M{"device.device_id": nodeId, "device.gpu_index": bson.M{"$exists": false}},
+		options.FindOne().SetSort(bson.M{"timestamp": -1}),
+	).Decode(result)
 	if err != nil {
-		log.Log.Errorf("Delete expired documents before %v manully failed: %v", tm, err)
-		return err
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrDeviceInfoNotFound
+		}
+		log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Error("find latest device info failed: ", err)
+		return nil, err
 	}
-	log.Log.Infof("Delete expired documents before %v manully DeletedCount %v", tm, result.DeletedCount)
-	return nil
+	return result, nil
 }
 
-func (db *mongoDB) GetAllLatestDeviceInfo(ctx context.Context) []types.MDBDeviceInfo {
-	di := make([]types.MDBDeviceInfo, 0)
-	pipeline := mongo.Pipeline{
-		// {{"$match", bson.D{{"timestamp", bson.D{{"$gt", specificTimestamp}}}}}},
-		{{"$sort", bson.D{{"device.device_id", 1}, {"timestamp", -1}}}},
-		{{"$group", bson.D{
-			{"_id", "$device.device_id"},
-			{"latestRecord", bson.D{{"$first", "$$ROOT"}}},
-		}}},
-		{{"$replaceRoot", bson.D{{"newRoot", "$latestRecord"}}}},
+// GetLatestDeviceInfos returns the latest sample of each device, indexed by node id.
+// Devices without any sample are not in the result.
+func (db *mongoDB) GetLatestDeviceInfos(ctx context.Context, nodeIds []string) (map[string]types.MDBDeviceInfo, error) {
+	if err := db.check(); err != nil {
+		return nil, err
+	}
+	pipeline := bson.A{
+		bson.M{"$match": bson.M{
+			"device.device_id": bson.M{"$in": nodeIds},
+			"device.gpu_index": bson.M{"$exists": false},
+		}},
+		bson.M{"$sort": bson.M{"timestamp": -1}},
+		bson.M{"$group": bson.M{
+			"_id":          "$device.device_id",
+			"latestRecord": bson.M{"$first": "$$ROOT"},
+		}},
+		bson.M{"$replaceRoot": bson.M{"newRoot": "$latestRecord"}},
 	}
 	cursor, err := db.deviceInfoCollection.Aggregate(ctx, pipeline)
 	if err != nil {
-		log.Log.Errorf("Aggregate documents of all latest device info failed: %v", err)
-		return di
+		log.Log.Errorf("Aggregate latest device info of %v devices failed: %v", len(nodeIds), err)
+		return nil, err
 	}
 	defer cursor.Close(ctx)
+	infos := make(map[string]types.MDBDeviceInfo, len(nodeIds))
 	for cursor.Next(ctx) {
 		result := types.MDBDeviceInfo{}
 		if err := cursor.Decode(&result); err != nil {
 			log.Log.Errorf("Decode aggregate cursor into struct failed: %v", err)
-		} else {
-			di = append(di, result)
+			return nil, err
 		}
+		infos[result.Device.DeviceId] = result
 	}
 	if err := cursor.Err(); err != nil {
 		log.Log.Errorf("Traversal aggregate cursor failed: %v", err)
+		return nil, err
+	}
+	return infos, nil
+}
+
+func (db *mongoDB) AddDeviceInfo(ctx context.Context, nodeId string, tm time.Time, info types.WsMachineInfoRequest) error {
+	if err := db.check(); err != nil {
+		return err
+	}
+	infos := newDeviceInfos(nodeId, tm, info)
+	if len(infos) > 1 {
+		// The samples of the GPUs are written with the sample of the device
+		return db.AddDeviceInfos(ctx, infos)
+	}
+	result, err := db.deviceInfoCollection.InsertOne(ctx, infos[0])
+	if err != nil {
+		log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Error("insert device info failed: ", err)
+		return err
+	}
+	log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Info("inserted device info id ", result.InsertedID)
+	return nil
+}
+
+func (db *mongoDB) AddDeviceInfos(ctx context.Context, infos []types.MDBDeviceInfo) error {
+	if err := db.check(); err != nil {
+		return err
+	}
+	docs := make([]interface{}, 0, len(infos))
+	for _, info := range infos {
+		docs = append(docs, info)
+	}
+	// Unordered so that one bad document does not stop the rest of the batch
+	result, err := db.deviceInfoCollection.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	if err != nil {
+		log.Log.Errorf("Insert %v device infos failed: %v", len(infos), err)
+		return err
+	}
+	log.Log.Infof("Inserted %v device infos", len(result.InsertedIDs))
+	return nil
+}
+
+func (db *mongoDB) AddHostMetrics(ctx context.Context, nodeId string, tm time.Time, metrics types.WsHostMetricsRequest) error {
+	if err := db.check(); err != nil {
+		return err
+	}
+	result, err := db.hostMetricsCollection.InsertOne(ctx, newHostMetrics(nodeId, tm, metrics))
+	if err != nil {
+		log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Error("insert host metrics failed: ", err)
+		return err
+	}
+	log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Info("inserted host metrics id ", result.InsertedID)
+	return nil
+}
+
+func (db *mongoDB) AddCustomMetrics(ctx context.Context, nodeId string, tm time.Time, samples []types.CustomSample) error {
+	if err := db.check(); err != nil {
+		return err
+	}
+	docs := make([]interface{}, 0, len(samples))
+	for _, metric := range newCustomMetrics(nodeId, tm, samples) {
+		docs = append(docs, metric)
+	}
+	result, err := db.customMetricsCollection.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	if err != nil {
+		log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Error("insert custom metrics failed: ", err)
+		return err
+	}
+	log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Infof("inserted %v custom metrics", len(result.InsertedIDs))
+	return nil
+}
+
+func (db *mongoDB) AddModelMetrics(ctx context.Context, nodeId string, tm time.Time, metrics types.WsModelMetricsRequest) error {
+	if err := db.check(); err != nil {
+		return err
+	}
+	docs := make([]interface{}, 0, len(metrics.Models))
+	for _, model := range newModelMetrics(nodeId, tm, metrics) {
+		docs = append(docs, model)
+	}
+	if len(docs) == 0 {
+		return nil
+	}
+	result, err := db.modelMetricsCollection.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	if err != nil {
+		log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Error("insert model metrics failed: ", err)
+		return err
+	}
+	log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Infof("inserted %v model metrics", len(result.InsertedIDs))
+	return nil
+}
+
+func (db *mongoDB) DeleteExpiredDeviceInfo(ctx context.Context, tm time.Time) error {
+	if err := db.check(); err != nil {
+		return err
+	}
+	for _, collection := range []*mongo.Collection{
+		db.deviceInfoCollection,
+		db.hostMetricsCollection,
+		db.customMetricsCollection,
+		db.modelMetricsCollection,
+	} {
+		result, err := collection.DeleteMany(
+			ctx,
+			bson.M{
+				"timestamp": bson.M{"$lt": tm},
+			},
+		)
+		if err != nil {
+			log.Log.Errorf("Delete expired documents of %v before %v manully failed: %v", collection.Name(), tm, err)
+			return err
+		}
+		log.Log.Infof("Delete expired documents of %v before %v manully DeletedCount %v", collection.Name(), tm, result.DeletedCount)
+	}
+	return nil
+}
+
+// GetDeviceInfoHistory aggregates the samples of the device in [from, to) into buckets of
+// step, with one of the aggregations AggAvg, AggMax, AggMin and AggP95.
+func (db *mongoDB) GetDeviceInfoHistory(ctx context.Context, nodeId string, from, to time.Time, step time.Duration, agg string) ([]types.DeviceInfoPoint, error) {
+	if err := db.check(); err != nil {
+		return nil, err
+	}
+	var accumulator func(field string) bson.M
+	switch agg {
+	case types.AggAvg:
+		accumulator = func(field string) bson.M { return bson.M{"$avg": field} }
+	case types.AggMax:
+		accumulator = func(field string) bson.M { return bson.M{"$max": field} }
+	case types.AggMin:
+		accumulator = func(field string) bson.M { return bson.M{"$min": field} }
+	case types.AggP95:
+		// The samples are collected and ranked in $project, $percentile is only approximate
+		accumulator = func(field string) bson.M { return bson.M{"$push": field} }
+	default:
+		return nil, ErrUnknownAggregation
+	}
+	value := func(field string) interface{} {
+		if agg == types.AggP95 {
+			// The nearest rank, ceil(0.95 * n) of the sorted samples
+			rank := bson.M{"$ceil": bson.M{"$multiply": bson.A{0.95, bson.M{"$size": "$" + field}}}}
+			return bson.M{"$arrayElemAt": bson.A{
+				bson.M{"$sortArray": bson.M{"input": "$" + field, "sortBy": 1}},
+				bson.M{"$toInt": bson.M{"$subtract": bson.A{rank, 1}}},
+			}}
+		}
+		return "$" + field
+	}
+
+	pipeline := bson.A{
+		bson.M{"$match": bson.M{
+			"device.device_id": nodeId,
+			"device.gpu_index": bson.M{"$exists": false},
+			"timestamp":        bson.M{"$gte": from, "$lt": to},
+		}},
+		bson.M{"$group": bson.M{
+			"_id": bson.M{"$dateTrunc": bson.M{
+				"date":    "$timestamp",
+				"unit":    "second",
+				"binSize": int64(step / time.Second),
+			}},
+			"utilization_gpu": accumulator("$utilization_gpu"),
+			"memory_total":    accumulator("$memory_total"),
+			"memory_used":     accumulator("$memory_used"),
+			"count":           bson.M{"$sum": 1},
+		}},
+		bson.M{"$project": bson.M{
+			"_id":             0,
+			"timestamp":       "$_id",
+			"utilization_gpu": value("utilization_gpu"),
+			"memory_total":    value("memory_total"),
+			"memory_used":     value("memory_used"),
+			"count":           1,
+		}},
+		bson.M{"$sort": bson.M{"timestamp": 1}},
+	}
+	cursor, err := db.deviceInfoCollection.Aggregate(ctx, pipeline)
+	if err != nil {
+		log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Error("aggregate device info history failed: ", err)
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	points := make([]types.DeviceInfoPoint, 0)
+	if err := cursor.All(ctx, &points); err != nil {
+		log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Error("decode device info history failed: ", err)
+		return nil, err
 	}
-	return di
+	return points, nil
 }
@@ -0,0 +1,156 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"time"
+
+	"health-monitoring/log"
+	"health-monitoring/types"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// VerifyDevice checks that the device is registered and not revoked, and that it uses
+// the pinned public key. The key is pinned the first time the device comes online if
+// the registry has no key of the device. Unknown devices are registered with the key
+// when autoRegister is true, otherwise they are refused.
+func (db *mongoDB) VerifyDevice(ctx context.Context, nodeId string, pubKey []byte, autoRegister bool) error {
+	if err := db.check(); err != nil {
+		return err
+	}
+	result := types.MDBDeviceRegistry{}
+	err := db.deviceRegistryCollection.FindOne(ctx, bson.M{"device_id": nodeId}).Decode(&result)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		if !autoRegister {
+			return ErrDeviceNotRegistered
+		}
+		_, err = db.deviceRegistryCollection.InsertOne(ctx, types.MDBDeviceRegistry{
+			DeviceId:   nodeId,
+			PubKey:     pubKey,
+			AddTime:    time.Now(),
+			UpdateTime: time.Now(),
+		})
+		if err == nil {
+			log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Info("auto registered device with public key")
+			return nil
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Error("insert device registry failed: ", err)
+			return err
+		}
+		// Another connection registered the device at the same time, compare with it
+		err = db.deviceRegistryCollection.FindOne(ctx, bson.M{"device_id": nodeId}).Decode(&result)
+	}
+	if err != nil {
+		log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Error("find device registry failed: ", err)
+		return err
+	}
+	if result.Revoked {
+		return ErrDeviceRevoked
+	}
+
+	if len(result.PubKey) == 0 {
+		res, err := db.deviceRegistryCollection.UpdateOne(
+			ctx,
+			bson.M{"device_id": nodeId, "pub_key": bson.M{"$exists": false}},
+			bson.M{"$set": bson.M{"pub_key": pubKey, "update_time": time.Now()}},
+		)
+		if err != nil {
+			log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Error("pin device public key failed: ", err)
+			return err
+		}
+		if res.ModifiedCount == 1 {
+			log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Info("pinned device public key")
+			return nil
+		}
+		// Another connection pinned the key at the same time, compare with it
+		if err := db.deviceRegistryCollection.FindOne(ctx, bson.M{"device_id": nodeId}).Decode(&result); err != nil {
+			log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Error("find device registry failed: ", err)
+			return err
+		}
+	}
+	if !bytes.Equal(result.PubKey, pubKey) {
+		return ErrPubKeyMismatch
+	}
+	return nil
+}
+
+// RegisterDevice adds the device to the registry or updates it, a revoked device is
+// approved again. The pinned key is replaced if a new key is given.
+func (db *mongoDB) RegisterDevice(ctx context.Context, device types.MDBDeviceRegistry) error {
+	if err := db.check(); err != nil {
+		return err
+	}
+	set := bson.M{
+		"project":     device.Project,
+		"owner":       device.Owner,
+		"revoked":     false,
+		"update_time": time.Now(),
+	}
+	if len(device.PubKey) != 0 {
+		set["pub_key"] = device.PubKey
+	}
+	_, err := db.deviceRegistryCollection.UpdateOne(
+		ctx,
+		bson.M{"device_id": device.DeviceId},
+		bson.M{
+			"$set":         set,
+			"$setOnInsert": bson.M{"add_time": time.Now()},
+		},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		log.Log.WithFields(logrus.Fields{"node_id": device.DeviceId}).Error("register device failed: ", err)
+		return err
+	}
+	log.Log.WithFields(logrus.Fields{"node_id": device.DeviceId}).Info("registered device")
+	return nil
+}
+
+func (db *mongoDB) RevokeDevice(ctx context.Context, nodeId string) error {
+	if err := db.check(); err != nil {
+		return err
+	}
+	res, err := db.deviceRegistryCollection.UpdateOne(
+		ctx,
+		bson.M{"device_id": nodeId},
+		bson.M{"$set": bson.M{"revoked": true, "update_time": time.Now()}},
+	)
+	if err != nil {
+		log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Error("revoke device failed: ", err)
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrDeviceNotRegistered
+	}
+	// The instance holding the session kicks it once the record is gone
+	if _, err := db.deviceOnlineCollection.DeleteOne(ctx, bson.M{"device_id": nodeId}); err != nil {
+		log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Error("delete online of revoked device failed: ", err)
+		return err
+	}
+	log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Info("revoked device")
+	return nil
+}
+
+func (db *mongoDB) ListDevices(ctx context.Context) ([]types.MDBDeviceRegistry, error) {
+	if err := db.check(); err != nil {
+		return nil, err
+	}
+	devices := make([]types.MDBDeviceRegistry, 0)
+	cursor, err := db.deviceRegistryCollection.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"device_id": 1}))
+	if err != nil {
+		log.Log.Errorf("Find documents of device registry failed: %v", err)
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	if err := cursor.All(ctx, &devices); err != nil {
+		log.Log.Errorf("Decode cursor of device registry failed: %v", err)
+		return nil, err
+	}
+	return devices, nil
+}
@@ -1,6 +1,7 @@
 package db
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"log"
@@ -424,3 +425,117 @@ func TestMongoDBTimeSeries(t *testing.T) {
 	}
 	t.Log("Drop test database success")
 }
+
+// go test -v -timeout 60s -count=1 -run TestNodeOnlineRace health-monitoring/db
+func TestNodeOnlineRace(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	store := newTestMongoDB(ctx, t, 60)
+	testNodeOnlineRace(ctx, t, store)
+}
+
+// go test -v -timeout 60s -count=1 -run TestLatestDeviceInfo health-monitoring/db
+func TestLatestDeviceInfo(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	store := newTestMongoDB(ctx, t, 3600)
+	testLatestDeviceInfo(ctx, t, store)
+}
+
+// go test -v -timeout 60s -count=1 -run TestOnlineLease health-monitoring/db
+func TestOnlineLease(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	store := newTestMongoDB(ctx, t, 3600)
+	collection := store.(*mongoDB).deviceOnlineCollection
+	testOnlineLease(ctx, t, store, func(nodeId string, d time.Duration) {
+		if _, err := collection.UpdateOne(ctx, bson.M{"device_id": nodeId}, bson.M{"$set": bson.M{"heartbeat": time.Now().Add(-d)}}); err != nil {
+			t.Fatalf("Age online record failed: %v", err)
+		}
+	})
+
+	// The records of crashed instances are deleted by the TTL index once the lease expired
+	indexes, err := collection.Indexes().ListSpecifications(ctx)
+	if err != nil {
+		t.Fatalf("List indexes of device online failed: %v", err)
+	}
+	found := false
+	for _, index := range indexes {
+		if index.ExpireAfterSeconds != nil && *index.ExpireAfterSeconds == int32(OnlineLease.Seconds()) &&
+			bytes.Contains(index.KeysDocument, []byte("heartbeat")) {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expect TTL index on heartbeat of %v, got %+v", OnlineLease, indexes)
+	}
+}
+
+// go test -v -timeout 60s -count=1 -run TestTakeoverNodeOnline health-monitoring/db
+func TestTakeoverNodeOnline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	store := newTestMongoDB(ctx, t, 3600)
+	testTakeoverNodeOnline(ctx, t, store)
+}
+
+// go test -v -timeout 60s -count=1 -run TestDeviceRegistry health-monitoring/db
+func TestDeviceRegistry(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	store := newTestMongoDB(ctx, t, 3600)
+	testDeviceRegistry(ctx, t, store)
+}
+
+// go test -v -timeout 60s -count=1 -run TestDeviceInfoP95 health-monitoring/db
+func TestDeviceInfoP95(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	store := newTestMongoDB(ctx, t, 3*3600)
+	testDeviceInfoP95(ctx, t, store)
+}
+
+// go test -v -timeout 30s -count=1 -run TestMongoDBDegraded health-monitoring/db
+func TestMongoDBDegraded(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// Nothing listens on the port, the storage starts in the degraded mode
+	store, err := NewMongoDB(ctx, "mongodb://127.0.0.1:1", "test_health_monitoring", 3600, "test")
+	if err != nil {
+		t.Fatalf("expect degraded start, got %v", err)
+	}
+	defer store.Disconnect(context.Background())
+	if err := store.Ping(context.Background()); !errors.Is(err, ErrStoreUnavailable) {
+		t.Fatalf("expect Ping ErrStoreUnavailable, got %v", err)
+	}
+	if err := store.NodeOnline(context.Background(), "node1", "session1", nil); !errors.Is(err, ErrStoreUnavailable) {
+		t.Fatalf("expect NodeOnline ErrStoreUnavailable, got %v", err)
+	}
+	if _, err := store.ListOnlineDevices(context.Background()); !errors.Is(err, ErrStoreUnavailable) {
+		t.Fatalf("expect ListOnlineDevices ErrStoreUnavailable, got %v", err)
+	}
+}
+
+// newTestMongoDB connects to the test database, which is dropped when the test finishes.
+func newTestMongoDB(ctx context.Context, t *testing.T, expireTime int64) Store {
+	store, err := NewMongoDB(ctx, "mongodb://localhost:27017", "test_health_monitoring", expireTime, "test")
+	if err != nil {
+		t.Fatalf("Init mongodb failed: %v", err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := store.(*mongoDB).Mongo.Database("test_health_monitoring").Drop(ctx); err != nil {
+			t.Logf("Drop test database failed: %v", err)
+		}
+		store.Disconnect(ctx)
+	})
+	return store
+}
@@ -0,0 +1,608 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"health-monitoring/log"
+	"health-monitoring/types"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/sirupsen/logrus"
+)
+
+// postgreSQL stores the device info samples in a TimescaleDB hypertable, the registry and
+// the online records in regular tables.
+type postgreSQL struct {
+	pool     *pgxpool.Pool
+	instance string
+}
+
+// The schema is created at startup, samples are partitioned by timestamp and searched by
+// device id like the meta field of the MongoDB time series collection.
+var postgreSQLSchema = []string{
+	`CREATE TABLE IF NOT EXISTS device_registry (
+		device_id   TEXT PRIMARY KEY,
+		pub_key     BYTEA,
+		project     TEXT NOT NULL DEFAULT '',
+		owner       TEXT NOT NULL DEFAULT '',
+		revoked     BOOLEAN NOT NULL DEFAULT FALSE,
+		add_time    TIMESTAMPTZ NOT NULL,
+		update_time TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS device_online (
+		device_id TEXT PRIMARY KEY,
+		add_time  TIMESTAMPTZ NOT NULL,
+		instance  TEXT NOT NULL,
+		heartbeat TIMESTAMPTZ NOT NULL,
+		session   TEXT NOT NULL,
+		pub_key   BYTEA
+	)`,
+	`CREATE INDEX IF NOT EXISTS device_online_session_idx ON device_online (session)`,
+	`CREATE TABLE IF NOT EXISTS device_info (
+		timestamp       TIMESTAMPTZ NOT NULL,
+		device_id       TEXT NOT NULL,
+		project         TEXT NOT NULL DEFAULT '',
+		models          JSONB,
+		gpu_name        TEXT NOT NULL DEFAULT '',
+		utilization_gpu INTEGER NOT NULL,
+		memory_total    BIGINT NOT NULL,
+		memory_used     BIGINT NOT NULL
+	)`,
+	`SELECT create_hypertable('device_info', 'timestamp', if_not_exists => TRUE)`,
+	`CREATE INDEX IF NOT EXISTS device_info_device_id_timestamp_idx ON device_info (device_id, timestamp DESC)`,
+	// The samples of each GPU, the sample of the whole device has a NULL gpu_index
+	`ALTER TABLE device_info
+		ADD COLUMN IF NOT EXISTS gpu_index    INTEGER,
+		ADD COLUMN IF NOT EXISTS gpu_uuid     TEXT,
+		ADD COLUMN IF NOT EXISTS temperature  INTEGER,
+		ADD COLUMN IF NOT EXISTS power_draw   DOUBLE PRECISION,
+		ADD COLUMN IF NOT EXISTS fan_speed    INTEGER,
+		ADD COLUMN IF NOT EXISTS clock_sm     INTEGER,
+		ADD COLUMN IF NOT EXISTS clock_memory INTEGER`,
+	`CREATE TABLE IF NOT EXISTS host_metrics (
+		timestamp       TIMESTAMPTZ NOT NULL,
+		device_id       TEXT NOT NULL,
+		cpu_utilization DOUBLE PRECISION NOT NULL,
+		cpu_cores       INTEGER NOT NULL,
+		load1           DOUBLE PRECISION NOT NULL,
+		load5           DOUBLE PRECISION NOT NULL,
+		load15          DOUBLE PRECISION NOT NULL,
+		memory_total    BIGINT NOT NULL,
+		memory_used     BIGINT NOT NULL,
+		disks           JSONB,
+		networks        JSONB,
+		uptime          BIGINT NOT NULL
+	)`,
+	`SELECT create_hypertable('host_metrics', 'timestamp', if_not_exists => TRUE)`,
+	`CREATE INDEX IF NOT EXISTS host_metrics_device_id_timestamp_idx ON host_metrics (device_id, timestamp DESC)`,
+	`CREATE TABLE IF NOT EXISTS custom_metrics (
+		timestamp TIMESTAMPTZ NOT NULL,
+		device_id TEXT NOT NULL,
+		name      TEXT NOT NULL,
+		labels    JSONB,
+		type      TEXT NOT NULL,
+		value     DOUBLE PRECISION NOT NULL,
+		buckets   JSONB,
+		count     BIGINT NOT NULL DEFAULT 0,
+		sum       DOUBLE PRECISION NOT NULL DEFAULT 0
+	)`,
+	`SELECT create_hypertable('custom_metrics', 'timestamp', if_not_exists => TRUE)`,
+	`CREATE INDEX IF NOT EXISTS custom_metrics_device_id_name_timestamp_idx ON custom_metrics (device_id, name, timestamp DESC)`,
+	`CREATE TABLE IF NOT EXISTS model_metrics (
+		timestamp                    TIMESTAMPTZ NOT NULL,
+		device_id                    TEXT NOT NULL,
+		project                      TEXT NOT NULL DEFAULT '',
+		model                        TEXT NOT NULL,
+		requests_per_second          DOUBLE PRECISION NOT NULL,
+		prompt_tokens_per_second     DOUBLE PRECISION NOT NULL,
+		completion_tokens_per_second DOUBLE PRECISION NOT NULL,
+		ttft_p50                     DOUBLE PRECISION NOT NULL,
+		ttft_p90                     DOUBLE PRECISION NOT NULL,
+		ttft_p99                     DOUBLE PRECISION NOT NULL,
+		latency_p50                  DOUBLE PRECISION NOT NULL,
+		latency_p90                  DOUBLE PRECISION NOT NULL,
+		latency_p99                  DOUBLE PRECISION NOT NULL,
+		queue_depth                  INTEGER NOT NULL,
+		errors                       BIGINT NOT NULL,
+		context_length               INTEGER NOT NULL
+	)`,
+	`SELECT create_hypertable('model_metrics', 'timestamp', if_not_exists => TRUE)`,
+	`CREATE INDEX IF NOT EXISTS model_metrics_device_id_model_timestamp_idx ON model_metrics (device_id, model, timestamp DESC)`,
+}
+
+// NewPostgreSQL connects to PostgreSQL and creates the tables. The TimescaleDB extension
+// must be installed in the database, samples older than eas seconds are dropped by the
+// retention policy of the hypertable. Unlike MongoDB there is no degraded mode at startup,
+// it fails if PostgreSQL cannot be reached. Afterwards the calls failing to reach the
+// server return ErrStoreUnavailable.
+func NewPostgreSQL(ctx context.Context, uri string, eas int64, instance string) (Store, error) {
+	pool, err := pgxpool.New(ctx, uri)
+	if err != nil {
+		log.Log.Errorf("Connect postgresql failed: %v", err)
+		return nil, err
+	}
+	if err := pool.Ping(ctx); err != nil {
+		log.Log.Errorf("Ping postgresql failed: %v", err)
+		pool.Close()
+		return nil, err
+	}
+	pdb := &postgreSQL{
+		pool:     pool,
+		instance: instance,
+	}
+
+	for _, sql := range postgreSQLSchema {
+		if _, err := pool.Exec(ctx, sql); err != nil {
+			log.Log.Errorf("Create postgresql schema failed: %v", err)
+			pool.Close()
+			return nil, err
+		}
+	}
+	// Replace the policies so that changes of the expire time take effect
+	for _, table := range []string{"device_info", "host_metrics", "custom_metrics", "model_metrics"} {
+		if _, err := pool.Exec(ctx, `SELECT remove_retention_policy($1, if_exists => TRUE)`, table); err != nil {
+			log.Log.Errorf("Remove retention policy of %v failed: %v", table, err)
+			pool.Close()
+			return nil, err
+		}
+		if eas > 0 {
+			if _, err := pool.Exec(
+				ctx,
+				`SELECT add_retention_policy($1, drop_after => $2 * INTERVAL '1 second')`,
+				table, eas,
+			); err != nil {
+				log.Log.Errorf("Add retention policy of %v failed: %v", table, err)
+				pool.Close()
+				return nil, err
+			}
+		}
+	}
+
+	// The connections of the last run of this instance are gone, and there is no TTL index
+	// to delete the records whose lease has expired
+	tag, err := pool.Exec(
+		ctx,
+		`DELETE FROM device_online WHERE instance = $1 OR heartbeat <= $2`,
+		instance, time.Now().Add(-OnlineLease),
+	)
+	if err != nil {
+		log.Log.Errorf("Delete online records of instance %v failed: %v", instance, err)
+		pool.Close()
+		return nil, err
+	}
+	log.Log.Infof("Delete online records of instance %v DeletedCount %v", instance, tag.RowsAffected())
+	return pdb, nil
+}
+
+// unavailable wraps the errors of connecting to or talking with the server in
+// ErrStoreUnavailable, the errors returned by the server are returned as they are.
+func unavailable(err error) error {
+	var connectErr *pgconn.ConnectError
+	var netErr net.Error
+	if errors.As(err, &connectErr) || errors.As(err, &netErr) || pgconn.Timeout(err) {
+		return fmt.Errorf("%w: %v", ErrStoreUnavailable, err)
+	}
+	return err
+}
+
+func (db *postgreSQL) Ping(ctx context.Context) error {
+	if err := db.pool.Ping(ctx); err != nil {
+		return fmt.Errorf("%w: %v", ErrStoreUnavailable, err)
+	}
+	return nil
+}
+
+func (db *postgreSQL) Disconnect(ctx context.Context) {
+	db.pool.Close()
+}
+
+func (db *postgreSQL) IsNodeOnline(ctx context.Context, nodeId string) bool {
+	var online bool
+	err := db.pool.QueryRow(
+		ctx,
+		`SELECT EXISTS (SELECT 1 FROM device_online WHERE device_id = $1 AND heartbeat > $2)`,
+		nodeId, time.Now().Add(-OnlineLease),
+	).Scan(&online)
+	if err != nil {
+		log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Error("query online failed: ", err)
+		return false
+	}
+	return online
+}
+
+// upsertOnlineSQL replaces the online record of the device, the condition of the update
+// is appended by the callers.
+const upsertOnlineSQL = `INSERT INTO device_online (device_id, add_time, instance, heartbeat, session, pub_key)
+	VALUES ($1, $2, $3, $2, $4, $5)
+	ON CONFLICT (device_id) DO UPDATE SET
+		add_time = EXCLUDED.add_time,
+		instance = EXCLUDED.instance,
+		heartbeat = EXCLUDED.heartbeat,
+		session = EXCLUDED.session,
+		pub_key = EXCLUDED.pub_key`
+
+func (db *postgreSQL) NodeOnline(ctx context.Context, nodeId, session string, pubKey []byte) error {
+	now := time.Now()
+	tag, err := db.pool.Exec(
+		ctx,
+		upsertOnlineSQL+` WHERE device_online.heartbeat <= $6`,
+		nodeId, now, db.instance, session, pubKey, now.Add(-OnlineLease),
+	)
+	if err != nil {
+		log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Error("upsert online failed: ", err)
+		return unavailable(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNodeAlreadyOnline
+	}
+	log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Info("upserted online session ", session)
+	return nil
+}
+
+func (db *postgreSQL) TakeoverNodeOnline(ctx context.Context, nodeId, session string, pubKey []byte, sameKey bool) (*types.MDBDeviceOnline, error) {
+	now := time.Now()
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Error("begin takeover transaction failed: ", err)
+		return nil, unavailable(err)
+	}
+	defer tx.Rollback(ctx)
+
+	// Lock the old record so that it is still the one taken over when the update is done
+	old := &types.MDBDeviceOnline{}
+	err = tx.QueryRow(
+		ctx,
+		`SELECT device_id, add_time, instance, heartbeat, session, pub_key
+		FROM device_online WHERE device_id = $1 FOR UPDATE`,
+		nodeId,
+	).Scan(&old.DeviceId, &old.AddTime, &old.Instance, &old.Heartbeat, &old.Session, &old.PubKey)
+	if errors.Is(err, pgx.ErrNoRows) {
+		old = nil
+	} else if err != nil {
+		log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Error("find online failed: ", err)
+		return nil, unavailable(err)
+	}
+
+	// The condition also decides the connections racing to insert the first record
+	tag, err := tx.Exec(
+		ctx,
+		upsertOnlineSQL+` WHERE NOT $6 OR device_online.pub_key = EXCLUDED.pub_key OR device_online.heartbeat <= $7`,
+		nodeId, now, db.instance, session, pubKey, sameKey, now.Add(-OnlineLease),
+	)
+	if err != nil {
+		log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Error("takeover online failed: ", err)
+		return nil, unavailable(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return nil, ErrNodeAlreadyOnline
+	}
+	if err := tx.Commit(ctx); err != nil {
+		log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Error("commit takeover transaction failed: ", err)
+		return nil, unavailable(err)
+	}
+	if old == nil {
+		log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Info("inserted online session ", session)
+		return nil, nil
+	}
+	log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Infof("session %v took over session %v of instance %v", session, old.Session, old.Instance)
+	return old, nil
+}
+
+func (db *postgreSQL) RefreshNodeOnline(ctx context.Context, nodeId, session string) error {
+	_, err := db.pool.Exec(
+		ctx,
+		`UPDATE device_online SET heartbeat = $3 WHERE device_id = $1 AND session = $2`,
+		nodeId, session, time.Now(),
+	)
+	if err != nil {
+		log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Error("refresh online failed: ", err)
+		return unavailable(err)
+	}
+	return nil
+}
+
+func (db *postgreSQL) NodeOffline(ctx context.Context, nodeId, session string) error {
+	tag, err := db.pool.Exec(
+		ctx,
+		`DELETE FROM device_online WHERE device_id = $1 AND session = $2`,
+		nodeId, session,
+	)
+	if err != nil {
+		log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Error("delete online failed: ", err)
+		return unavailable(err)
+	}
+	log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Info("delete online count ", tag.RowsAffected())
+	return nil
+}
+
+func (db *postgreSQL) ListOnlineDevices(ctx context.Context) ([]types.MDBDeviceOnline, error) {
+	rows, err := db.pool.Query(
+		ctx,
+		`SELECT device_id, add_time, instance, heartbeat, session, pub_key
+		FROM device_online WHERE heartbeat > $1 ORDER BY device_id`,
+		time.Now().Add(-OnlineLease),
+	)
+	if err != nil {
+		log.Log.Errorf("Query online devices failed: %v", err)
+		return nil, unavailable(err)
+	}
+	devices := make([]types.MDBDeviceOnline, 0)
+	for rows.Next() {
+		device := types.MDBDeviceOnline{}
+		if err := rows.Scan(&device.DeviceId, &device.AddTime, &device.Instance, &device.Heartbeat, &device.Session, &device.PubKey); err != nil {
+			rows.Close()
+			log.Log.Errorf("Scan online device failed: %v", err)
+			return nil, unavailable(err)
+		}
+		devices = append(devices, device)
+	}
+	if err := rows.Err(); err != nil {
+		log.Log.Errorf("Traversal online devices failed: %v", err)
+		return nil, unavailable(err)
+	}
+	return devices, nil
+}
+
+func (db *postgreSQL) OwnedSessions(ctx context.Context, sessions []string) (map[string]bool, error) {
+	rows, err := db.pool.Query(ctx, `SELECT session FROM device_online WHERE session = ANY($1)`, sessions)
+	if err != nil {
+		log.Log.Errorf("Query online sessions failed: %v", err)
+		return nil, unavailable(err)
+	}
+	owned := make(map[string]bool, len(sessions))
+	for rows.Next() {
+		var session string
+		if err := rows.Scan(&session); err != nil {
+			rows.Close()
+			log.Log.Errorf("Scan online session failed: %v", err)
+			return nil, unavailable(err)
+		}
+		owned[session] = true
+	}
+	if err := rows.Err(); err != nil {
+		log.Log.Errorf("Traversal online sessions failed: %v", err)
+		return nil, unavailable(err)
+	}
+	return owned, nil
+}
+
+const selectDeviceInfoSQL = `SELECT timestamp, device_id, project, models, gpu_name, utilization_gpu, memory_total, memory_used FROM device_info`
+
+func scanDeviceInfo(row pgx.Row, info *types.MDBDeviceInfo) error {
+	return row.Scan(
+		&info.Timestamp,
+		&info.Device.DeviceId,
+		&info.Device.Project,
+		&info.Device.Models,
+		&info.Device.GPUName,
+		&info.UtilizationGPU,
+		&info.MemoryTotal,
+		&info.MemoryUsed,
+	)
+}
+
+func (db *postgreSQL) GetLatestDeviceInfo(ctx context.Context, nodeId string) (*types.MDBDeviceInfo, error) {
+	result := &types.MDBDeviceInfo{}
+	err := scanDeviceInfo(db.pool.QueryRow(
+		ctx,
+		selectDeviceInfoSQL+` WHERE device_id = $1 AND gpu_index IS NULL ORDER BY timestamp DESC LIMIT 1`,
+		nodeId,
+	), result)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrDeviceInfoNotFound
+		}
+		log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Error("query latest device info failed: ", err)
+		return nil, unavailable(err)
+	}
+	return result, nil
+}
+
+func (db *postgreSQL) GetLatestDeviceInfos(ctx context.Context, nodeIds []string) (map[string]types.MDBDeviceInfo, error) {
+	rows, err := db.pool.Query(
+		ctx,
+		`SELECT DISTINCT ON (device_id) timestamp, device_id, project, models, gpu_name, utilization_gpu, memory_total, memory_used
+		FROM device_info WHERE device_id = ANY($1) AND gpu_index IS NULL ORDER BY device_id, timestamp DESC`,
+		nodeIds,
+	)
+	if err != nil {
+		log.Log.Errorf("Query latest device info of %v devices failed: %v", len(nodeIds), err)
+		return nil, unavailable(err)
+	}
+	infos := make(map[string]types.MDBDeviceInfo, len(nodeIds))
+	for rows.Next() {
+		result := types.MDBDeviceInfo{}
+		if err := scanDeviceInfo(rows, &result); err != nil {
+			rows.Close()
+			log.Log.Errorf("Scan latest device info failed: %v", err)
+			return nil, unavailable(err)
+		}
+		infos[result.Device.DeviceId] = result
+	}
+	if err := rows.Err(); err != nil {
+		log.Log.Errorf("Traversal latest device info failed: %v", err)
+		return nil, unavailable(err)
+	}
+	return infos, nil
+}
+
+func (db *postgreSQL) AddDeviceInfo(ctx context.Context, nodeId string, tm time.Time, info types.WsMachineInfoRequest) error {
+	if len(info.GPUs) != 0 {
+		// The samples of the GPUs are written with the sample of the device
+		return db.AddDeviceInfos(ctx, newDeviceInfos(nodeId, tm, info))
+	}
+	_, err := db.pool.Exec(
+		ctx,
+		`INSERT INTO device_info (timestamp, device_id, project, models, gpu_name, utilization_gpu, memory_total, memory_used)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		tm, nodeId, info.Project, info.Models, info.GPUName, info.UtilizationGPU, info.MemoryTotal, info.MemoryUsed,
+	)
+	if err != nil {
+		log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Error("insert device info failed: ", err)
+		return unavailable(err)
+	}
+	log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Info("inserted device info")
+	return nil
+}
+
+func (db *postgreSQL) AddDeviceInfos(ctx context.Context, infos []types.MDBDeviceInfo) error {
+	count, err := db.pool.CopyFrom(
+		ctx,
+		pgx.Identifier{"device_info"},
+		[]string{
+			"timestamp", "device_id", "project", "models", "gpu_name", "utilization_gpu", "memory_total", "memory_used",
+			"gpu_index", "gpu_uuid", "temperature", "power_draw", "fan_speed", "clock_sm", "clock_memory",
+		},
+		pgx.CopyFromSlice(len(infos), func(i int) ([]interface{}, error) {
+			info := infos[i]
+			row := []interface{}{
+				info.Timestamp, info.Device.DeviceId, info.Device.Project, info.Device.Models,
+				info.Device.GPUName, info.UtilizationGPU, info.MemoryTotal, info.MemoryUsed,
+				info.Device.GPUIndex, nil, nil, nil, nil, nil, nil,
+			}
+			if gpu := info.GPU; gpu != nil {
+				row[9] = info.Device.GPUUUID
+				row[10], row[11], row[12], row[13], row[14] = gpu.Temperature, gpu.PowerDraw, gpu.FanSpeed, gpu.ClockSM, gpu.ClockMemory
+			}
+			return row, nil
+		}),
+	)
+	if err != nil {
+		log.Log.Errorf("Copy %v device infos failed: %v", len(infos), err)
+		return unavailable(err)
+	}
+	log.Log.Infof("Inserted %v device infos", count)
+	return nil
+}
+
+func (db *postgreSQL) AddCustomMetrics(ctx context.Context, nodeId string, tm time.Time, samples []types.CustomSample) error {
+	metrics := newCustomMetrics(nodeId, tm, samples)
+	count, err := db.pool.CopyFrom(
+		ctx,
+		pgx.Identifier{"custom_metrics"},
+		[]string{"timestamp", "device_id", "name", "labels", "type", "value", "buckets", "count", "sum"},
+		pgx.CopyFromSlice(len(metrics), func(i int) ([]interface{}, error) {
+			metric := metrics[i]
+			return []interface{}{
+				metric.Timestamp, metric.Device.DeviceId, metric.Device.Name, metric.Device.Labels,
+				metric.Type, metric.Value, metric.Buckets, int64(metric.Count), metric.Sum,
+			}, nil
+		}),
+	)
+	if err != nil {
+		log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Error("copy custom metrics failed: ", err)
+		return unavailable(err)
+	}
+	log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Infof("inserted %v custom metrics", count)
+	return nil
+}
+
+func (db *postgreSQL) AddModelMetrics(ctx context.Context, nodeId string, tm time.Time, metrics types.WsModelMetricsRequest) error {
+	models := newModelMetrics(nodeId, tm, metrics)
+	count, err := db.pool.CopyFrom(
+		ctx,
+		pgx.Identifier{"model_metrics"},
+		[]string{
+			"timestamp", "device_id", "project", "model",
+			"requests_per_second", "prompt_tokens_per_second", "completion_tokens_per_second",
+			"ttft_p50", "ttft_p90", "ttft_p99", "latency_p50", "latency_p90", "latency_p99",
+			"queue_depth", "errors", "context_length",
+		},
+		pgx.CopyFromSlice(len(models), func(i int) ([]interface{}, error) {
+			model := models[i]
+			return []interface{}{
+				model.Timestamp, model.Device.DeviceId, model.Device.Project, model.Device.Model,
+				model.RequestsPerSecond, model.PromptTokensPerSecond, model.CompletionTokensPerSecond,
+				model.TimeToFirstToken.P50, model.TimeToFirstToken.P90, model.TimeToFirstToken.P99,
+				model.Latency.P50, model.Latency.P90, model.Latency.P99,
+				model.QueueDepth, int64(model.Errors), model.ContextLength,
+			}, nil
+		}),
+	)
+	if err != nil {
+		log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Error("copy model metrics failed: ", err)
+		return unavailable(err)
+	}
+	log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Infof("inserted %v model metrics", count)
+	return nil
+}
+
+func (db *postgreSQL) DeleteExpiredDeviceInfo(ctx context.Context, tm time.Time) error {
+	for _, table := range []string{"device_info", "host_metrics", "custom_metrics", "model_metrics"} {
+		tag, err := db.pool.Exec(ctx, `DELETE FROM `+table+` WHERE timestamp < $1`, tm)
+		if err != nil {
+			log.Log.Errorf("Delete expired rows of %v before %v manully failed: %v", table, tm, err)
+			return unavailable(err)
+		}
+		log.Log.Infof("Delete expired rows of %v before %v manully DeletedCount %v", table, tm, tag.RowsAffected())
+	}
+	return nil
+}
+
+func (db *postgreSQL) AddHostMetrics(ctx context.Context, nodeId string, tm time.Time, metrics types.WsHostMetricsRequest) error {
+	_, err := db.pool.Exec(
+		ctx,
+		`INSERT INTO host_metrics (timestamp, device_id, cpu_utilization, cpu_cores, load1, load5, load15, memory_total, memory_used, disks, networks, uptime)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`,
+		tm, nodeId, metrics.CPUUtilization, metrics.CPUCores, metrics.Load1, metrics.Load5, metrics.Load15,
+		metrics.MemoryTotal, metrics.MemoryUsed, metrics.Disks, metrics.Networks, metrics.Uptime,
+	)
+	if err != nil {
+		log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Error("insert host metrics failed: ", err)
+		return unavailable(err)
+	}
+	log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Info("inserted host metrics")
+	return nil
+}
+
+func (db *postgreSQL) GetDeviceInfoHistory(ctx context.Context, nodeId string, from, to time.Time, step time.Duration, agg string) ([]types.DeviceInfoPoint, error) {
+	var aggregate string
+	switch agg {
+	case types.AggAvg:
+		aggregate = "avg(%s)"
+	case types.AggMax:
+		aggregate = "max(%s)"
+	case types.AggMin:
+		aggregate = "min(%s)"
+	case types.AggP95:
+		// percentile_disc picks the nearest rank, percentile_cont would interpolate
+		aggregate = "percentile_disc(0.95) WITHIN GROUP (ORDER BY %s)"
+	default:
+		return nil, ErrUnknownAggregation
+	}
+	column := func(name string) string {
+		return fmt.Sprintf(aggregate, name) + "::DOUBLE PRECISION"
+	}
+
+	// Buckets start from the same reference time as $dateTrunc, not the default origin of time_bucket
+	sql := `SELECT time_bucket($1 * INTERVAL '1 second', timestamp, $2::TIMESTAMPTZ) AS bucket, ` +
+		column("utilization_gpu") + `, ` + column("memory_total") + `, ` + column("memory_used") + `, count(*)
+		FROM device_info WHERE device_id = $3 AND gpu_index IS NULL AND timestamp >= $4 AND timestamp < $5
+		GROUP BY bucket ORDER BY bucket`
+	rows, err := db.pool.Query(ctx, sql, int64(step/time.Second), bucketReference, nodeId, from, to)
+	if err != nil {
+		log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Error("aggregate device info history failed: ", err)
+		return nil, unavailable(err)
+	}
+	points := make([]types.DeviceInfoPoint, 0)
+	for rows.Next() {
+		point := types.DeviceInfoPoint{}
+		if err := rows.Scan(&point.Timestamp, &point.UtilizationGPU, &point.MemoryTotal, &point.MemoryUsed, &point.Count); err != nil {
+			rows.Close()
+			log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Error("scan device info history failed: ", err)
+			return nil, unavailable(err)
+		}
+		points = append(points, point)
+	}
+	if err := rows.Err(); err != nil {
+		log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Error("traversal device info history failed: ", err)
+		return nil, unavailable(err)
+	}
+	return points, nil
+}
@@ -0,0 +1,155 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"time"
+
+	"health-monitoring/log"
+	"health-monitoring/types"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/sirupsen/logrus"
+)
+
+func (db *postgreSQL) VerifyDevice(ctx context.Context, nodeId string, pubKey []byte, autoRegister bool) error {
+	if autoRegister {
+		tag, err := db.pool.Exec(
+			ctx,
+			`INSERT INTO device_registry (device_id, pub_key, add_time, update_time)
+			VALUES ($1, $2, $3, $3) ON CONFLICT (device_id) DO NOTHING`,
+			nodeId, pubKey, time.Now(),
+		)
+		if err != nil {
+			log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Error("insert device registry failed: ", err)
+			return unavailable(err)
+		}
+		if tag.RowsAffected() == 1 {
+			log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Info("auto registered device with public key")
+			return nil
+		}
+	}
+
+	var pinned []byte
+	var revoked bool
+	err := db.pool.QueryRow(
+		ctx,
+		`SELECT pub_key, revoked FROM device_registry WHERE device_id = $1`,
+		nodeId,
+	).Scan(&pinned, &revoked)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrDeviceNotRegistered
+	}
+	if err != nil {
+		log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Error("query device registry failed: ", err)
+		return unavailable(err)
+	}
+	if revoked {
+		return ErrDeviceRevoked
+	}
+
+	if len(pinned) == 0 {
+		// Another connection may pin the key at the same time, the first one wins
+		err := db.pool.QueryRow(
+			ctx,
+			`UPDATE device_registry SET pub_key = COALESCE(pub_key, $2), update_time = $3
+			WHERE device_id = $1 RETURNING pub_key`,
+			nodeId, pubKey, time.Now(),
+		).Scan(&pinned)
+		if err != nil {
+			log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Error("pin device public key failed: ", err)
+			return unavailable(err)
+		}
+		if bytes.Equal(pinned, pubKey) {
+			log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Info("pinned device public key")
+			return nil
+		}
+	}
+	if !bytes.Equal(pinned, pubKey) {
+		return ErrPubKeyMismatch
+	}
+	return nil
+}
+
+func (db *postgreSQL) RegisterDevice(ctx context.Context, device types.MDBDeviceRegistry) error {
+	var pubKey []byte
+	if len(device.PubKey) != 0 {
+		pubKey = device.PubKey
+	}
+	_, err := db.pool.Exec(
+		ctx,
+		`INSERT INTO device_registry (device_id, pub_key, project, owner, revoked, add_time, update_time)
+		VALUES ($1, $2, $3, $4, FALSE, $5, $5)
+		ON CONFLICT (device_id) DO UPDATE SET
+			pub_key = COALESCE(EXCLUDED.pub_key, device_registry.pub_key),
+			project = EXCLUDED.project,
+			owner = EXCLUDED.owner,
+			revoked = FALSE,
+			update_time = EXCLUDED.update_time`,
+		device.DeviceId, pubKey, device.Project, device.Owner, time.Now(),
+	)
+	if err != nil {
+		log.Log.WithFields(logrus.Fields{"node_id": device.DeviceId}).Error("register device failed: ", err)
+		return unavailable(err)
+	}
+	log.Log.WithFields(logrus.Fields{"node_id": device.DeviceId}).Info("registered device")
+	return nil
+}
+
+func (db *postgreSQL) RevokeDevice(ctx context.Context, nodeId string) error {
+	tag, err := db.pool.Exec(
+		ctx,
+		`UPDATE device_registry SET revoked = TRUE, update_time = $2 WHERE device_id = $1`,
+		nodeId, time.Now(),
+	)
+	if err != nil {
+		log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Error("revoke device failed: ", err)
+		return unavailable(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrDeviceNotRegistered
+	}
+	// The instance holding the session kicks it once the record is gone
+	if _, err := db.pool.Exec(ctx, `DELETE FROM device_online WHERE device_id = $1`, nodeId); err != nil {
+		log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Error("delete online of revoked device failed: ", err)
+		return unavailable(err)
+	}
+	log.Log.WithFields(logrus.Fields{"node_id": nodeId}).Info("revoked device")
+	return nil
+}
+
+func (db *postgreSQL) ListDevices(ctx context.Context) ([]types.MDBDeviceRegistry, error) {
+	rows, err := db.pool.Query(
+		ctx,
+		`SELECT device_id, pub_key, project, owner, revoked, add_time, update_time
+		FROM device_registry ORDER BY device_id`,
+	)
+	if err != nil {
+		log.Log.Errorf("Query device registry failed: %v", err)
+		return nil, unavailable(err)
+	}
+	devices := make([]types.MDBDeviceRegistry, 0)
+	for rows.Next() {
+		device := types.MDBDeviceRegistry{}
+		if err := rows.Scan(
+			&device.DeviceId,
+			&device.PubKey,
+			&device.Project,
+			&device.Owner,
+			&device.Revoked,
+			&device.AddTime,
+			&device.UpdateTime,
+		); err != nil {
+			rows.Close()
+			log.Log.Errorf("Scan device registry failed: %v", err)
+			return nil, unavailable(err)
+		}
+		devices = append(devices, device)
+	}
+	if err := rows.Err(); err != nil {
+		log.Log.Errorf("Traversal device registry failed: %v", err)
+		return nil, unavailable(err)
+	}
+	return devices, nil
+}
@@ -0,0 +1,282 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"health-monitoring/log"
+	"health-monitoring/types"
+)
+
+const (
+	// A new spool segment is started when the current one grows beyond the size.
+	spoolSegmentSize = 4 << 20
+
+	// spoolOffsetName is the file keeping the replay position in the oldest segment.
+	spoolOffsetName = "offset"
+)
+
+var ErrSpoolFull = errors.New("spool of device info is full")
+
+// Spool is a write-ahead log of the device info samples which could not be inserted into
+// the store. The samples are appended to segment files in the same format as the embedded
+// storage, synced to the disk before Append returns, and replayed in the same order.
+//
+// The replay position is saved after every batch, a crash between inserting a batch and
+// saving the position inserts the batch again when the spool is replayed after restart.
+type Spool struct {
+	dir      string
+	maxSize  int64
+	mutex    sync.Mutex
+	segments []uint64 // 尚未回放完的日志段序号，按写入顺序排列
+	file     *os.File // 正在追加的日志段，回放到它时会被关闭
+	fileSize int64
+	offset   int64 // 最早的日志段中已经回放的位置
+	size     int64 // 尚未回放的数据大小
+}
+
+// OpenSpool opens the spool in the directory, creating it if it does not exist. The torn
+// records left by a crash at the end of the segments are truncated.
+func OpenSpool(dir string, maxSize int64) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	segments, _, err := logFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	s := &Spool{
+		dir:      dir,
+		maxSize:  maxSize,
+		segments: segments,
+	}
+	var firstSize int64
+	for i, seq := range segments {
+		path := filepath.Join(dir, segmentName(seq))
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		size, err := readRecords(f, func(rt recordType, payload []byte) error { return nil })
+		f.Close()
+		if errors.Is(err, errCorruptRecord) {
+			log.Log.Warnf("Truncate %v at offset %v: %v", path, size, err)
+			err = os.Truncate(path, size)
+		}
+		if err != nil {
+			return nil, err
+		}
+		s.size += size
+		if i == 0 {
+			firstSize = size
+		}
+	}
+
+	if len(segments) != 0 {
+		var position struct {
+			Seq    uint64 `json:"seq"`
+			Offset int64  `json:"offset"`
+		}
+		data, err := os.ReadFile(filepath.Join(dir, spoolOffsetName))
+		if err == nil && json.Unmarshal(data, &position) == nil && position.Seq == segments[0] &&
+			position.Offset >= 0 && position.Offset <= firstSize {
+			s.offset = position.Offset
+			s.size -= position.Offset
+		}
+	}
+	if s.size != 0 {
+		log.Log.Infof("Spool %v has %v bytes to replay", dir, s.size)
+	}
+	return s, nil
+}
+
+// Size returns the size of the samples not replayed yet.
+func (s *Spool) Size() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.size
+}
+
+// Pending reports whether there are samples not replayed yet.
+func (s *Spool) Pending() bool {
+	return s.Size() != 0
+}
+
+// Append writes the samples to the spool and syncs them to the disk, ErrSpoolFull is
+// returned if they would make the spool larger than the limit.
+func (s *Spool) Append(infos []types.MDBDeviceInfo) error {
+	buf := make([]byte, 0)
+	for _, info := range infos {
+		record, err := encodeRecord(recordDeviceInfo, info)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, record...)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.maxSize > 0 && s.size+int64(len(buf)) > s.maxSize {
+		return ErrSpoolFull
+	}
+	if s.file == nil || s.fileSize >= spoolSegmentSize {
+		if err := s.openSegment(); err != nil {
+			return err
+		}
+	}
+	if _, err := s.file.Write(buf); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	s.fileSize += int64(len(buf))
+	s.size += int64(len(buf))
+	return nil
+}
+
+// openSegment closes the current segment and starts a new one, the caller must hold the lock.
+func (s *Spool) openSegment() error {
+	s.closeSegment()
+	var seq uint64 = 1
+	if len(s.segments) != 0 {
+		seq = s.segments[len(s.segments)-1] + 1
+	}
+	f, err := os.OpenFile(filepath.Join(s.dir, segmentName(seq)), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := syncDir(s.dir); err != nil {
+		f.Close()
+		return err
+	}
+	s.segments = append(s.segments, seq)
+	s.file = f
+	s.fileSize = 0
+	return nil
+}
+
+// closeSegment stops appending to the current segment, the caller must hold the lock.
+func (s *Spool) closeSegment() {
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+}
+
+// Replay inserts the spooled samples in batches of batchSize in the order they were
+// appended, until the spool is empty or insert fails. It returns the number of samples
+// inserted.
+func (s *Spool) Replay(ctx context.Context, batchSize int, insert func(ctx context.Context, infos []types.MDBDeviceInfo) error) (int, error) {
+	replayed := 0
+	for {
+		s.mutex.Lock()
+		if len(s.segments) == 0 {
+			s.mutex.Unlock()
+			return replayed, nil
+		}
+		seq, offset := s.segments[0], s.offset
+		if len(s.segments) == 1 && s.file != nil {
+			// Only closed segments are read, new samples go to a new segment
+			s.closeSegment()
+		}
+		s.mutex.Unlock()
+
+		infos, next, err := s.read(seq, offset, batchSize)
+		if err != nil {
+			return replayed, err
+		}
+		if len(infos) != 0 {
+			if err := insert(ctx, infos); err != nil {
+				return replayed, err
+			}
+			replayed += len(infos)
+		}
+		if err := s.commit(seq, offset, next, len(infos) == 0); err != nil {
+			return replayed, err
+		}
+	}
+}
+
+// read returns at most n samples of the segment from the offset, and the offset after them.
+// A corrupt record ends the segment.
+func (s *Spool) read(seq uint64, offset int64, n int) ([]types.MDBDeviceInfo, int64, error) {
+	path := filepath.Join(s.dir, segmentName(seq))
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, 0); err != nil {
+		return nil, 0, err
+	}
+	infos := make([]types.MDBDeviceInfo, 0, n)
+	size, err := readRecords(f, func(rt recordType, payload []byte) error {
+		info := types.MDBDeviceInfo{}
+		if err := json.Unmarshal(payload, &info); err != nil {
+			// The spool is only written by this process, skip the sample instead of blocking the replay
+			log.Log.Errorf("Skip undecodable sample in spool segment %v: %v", path, err)
+			return nil
+		}
+		infos = append(infos, info)
+		if len(infos) >= n {
+			return errStopRead
+		}
+		return nil
+	})
+	if errors.Is(err, errCorruptRecord) {
+		log.Log.Errorf("Skip the rest of spool segment %v after offset %v: %v", path, offset+size, err)
+		return infos, offset + size, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return infos, offset + size, nil
+}
+
+// commit moves the replay position after the inserted samples, the segment is removed
+// when it has been replayed to the end.
+func (s *Spool) commit(seq uint64, offset, next int64, end bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if end {
+		s.segments = s.segments[1:]
+		s.offset = 0
+		// The position is removed first, the sequence numbers start over once the spool is
+		// empty, and a stale position must not be applied to a new segment of the same number
+		if err := os.Remove(filepath.Join(s.dir, spoolOffsetName)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Remove(filepath.Join(s.dir, segmentName(seq))); err != nil {
+			return err
+		}
+		if len(s.segments) == 0 {
+			// Records skipped as corrupt are not counted
+			s.size = 0
+		}
+		return nil
+	}
+	s.size -= next - offset
+	if s.size < 0 {
+		s.size = 0
+	}
+	s.offset = next
+	data, _ := json.Marshal(map[string]interface{}{"seq": seq, "offset": next})
+	path := filepath.Join(s.dir, spoolOffsetName)
+	if err := os.WriteFile(path+tempExt, data, 0o644); err != nil {
+		return fmt.Errorf("save replay position of spool: %w", err)
+	}
+	return os.Rename(path+tempExt, path)
+}
+
+// Close closes the current segment, the spooled samples are replayed after reopening.
+func (s *Spool) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closeSegment()
+}
@@ -0,0 +1,128 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"health-monitoring/types"
+)
+
+// go test -v -timeout 30s -count=1 -run TestSpool health-monitoring/db
+func TestSpool(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	spool, err := OpenSpool(dir, 0)
+	if err != nil {
+		t.Fatalf("OpenSpool failed: %v", err)
+	}
+	tm := time.Now().Truncate(time.Millisecond)
+	for i := 0; i < 5; i++ {
+		info := newDeviceInfo("node1", tm.Add(time.Duration(i)*time.Second), types.WsMachineInfoRequest{UtilizationGPU: i})
+		if err := spool.Append([]types.MDBDeviceInfo{info}); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+
+	// The insert fails after the first batch, the rest is replayed after reopening
+	replayed := make([]int, 0)
+	errInsert := errors.New("insert failed")
+	n, err := spool.Replay(ctx, 2, func(ctx context.Context, infos []types.MDBDeviceInfo) error {
+		if len(replayed) != 0 {
+			return errInsert
+		}
+		for _, info := range infos {
+			replayed = append(replayed, info.UtilizationGPU)
+		}
+		return nil
+	})
+	if n != 2 || !errors.Is(err, errInsert) {
+		t.Fatalf("expect 2 replayed before the failure, got %v %v", n, err)
+	}
+	spool.Close()
+
+	// A torn record at the end is truncated
+	segments, _, _ := logFiles(dir)
+	f, _ := os.OpenFile(filepath.Join(dir, segmentName(segments[len(segments)-1])), os.O_WRONLY|os.O_APPEND, 0o644)
+	f.Write([]byte{0, 0, 0, 9, 1})
+	f.Close()
+
+	spool, err = OpenSpool(dir, 0)
+	if err != nil {
+		t.Fatalf("OpenSpool failed: %v", err)
+	}
+	if !spool.Pending() {
+		t.Fatal("expect spool pending after reopening")
+	}
+	n, err = spool.Replay(ctx, 2, func(ctx context.Context, infos []types.MDBDeviceInfo) error {
+		for _, info := range infos {
+			replayed = append(replayed, info.UtilizationGPU)
+		}
+		return nil
+	})
+	if n != 3 || err != nil {
+		t.Fatalf("expect 3 replayed, got %v %v", n, err)
+	}
+	for i, v := range replayed {
+		if v != i {
+			t.Fatalf("expect samples replayed in order, got %v", replayed)
+		}
+	}
+	if spool.Pending() || spool.Size() != 0 {
+		t.Fatalf("expect spool empty, got %v bytes", spool.Size())
+	}
+	if segments, _, _ := logFiles(dir); len(segments) != 0 {
+		t.Fatalf("expect replayed segments removed, got %v", segments)
+	}
+
+	// The limit rejects new samples
+	spool, err = OpenSpool(dir, 10)
+	if err != nil {
+		t.Fatalf("OpenSpool failed: %v", err)
+	}
+	if err := spool.Append([]types.MDBDeviceInfo{newDeviceInfo("node1", tm, types.WsMachineInfoRequest{})}); !errors.Is(err, ErrSpoolFull) {
+		t.Fatalf("expect ErrSpoolFull, got %v", err)
+	}
+}
+
+// go test -v -timeout 30s -count=1 -run TestSpoolReuse health-monitoring/db
+func TestSpoolReuse(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	spool, err := OpenSpool(dir, 0)
+	if err != nil {
+		t.Fatalf("OpenSpool failed: %v", err)
+	}
+	tm := time.Now().Truncate(time.Millisecond)
+	appendN := func(n int) {
+		for i := 0; i < n; i++ {
+			info := newDeviceInfo("node1", tm.Add(time.Duration(i)*time.Second), types.WsMachineInfoRequest{UtilizationGPU: i})
+			if err := spool.Append([]types.MDBDeviceInfo{info}); err != nil {
+				t.Fatalf("Append failed: %v", err)
+			}
+		}
+	}
+	insert := func(ctx context.Context, infos []types.MDBDeviceInfo) error { return nil }
+
+	appendN(4)
+	if n, err := spool.Replay(ctx, 2, insert); n != 4 || err != nil {
+		t.Fatalf("expect 4 replayed, got %v %v", n, err)
+	}
+
+	// The new segment takes the number of the replayed one, the old position is not applied to it
+	appendN(4)
+	spool.Close()
+	spool, err = OpenSpool(dir, 0)
+	if err != nil {
+		t.Fatalf("OpenSpool failed: %v", err)
+	}
+	if n, err := spool.Replay(ctx, 2, insert); n != 4 || err != nil {
+		t.Fatalf("expect 4 replayed after reopening, got %v %v", n, err)
+	}
+	if spool.Size() != 0 {
+		t.Fatalf("expect spool empty, got %v bytes", spool.Size())
+	}
+}
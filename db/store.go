@@ -0,0 +1,129 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"health-monitoring/types"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	ErrNodeAlreadyOnline   = errors.New("device has been online")
+	ErrUnknownAggregation  = errors.New("unknown aggregation")
+	ErrDeviceInfoNotFound  = errors.New("device info not found")
+	ErrDeviceNotRegistered = errors.New("device is not registered")
+	ErrDeviceRevoked       = errors.New("device has been revoked")
+	ErrPubKeyMismatch      = errors.New("public key does not match the pinned key of the device")
+	ErrStoreUnavailable    = errors.New("storage is temporarily unavailable")
+)
+
+// OnlineLease is how long an online record stays valid without heartbeat, it must be
+// longer than the interval of the pings sent by devices.
+const OnlineLease = 90 * time.Second
+
+// Store is the storage of the device registry, the online state of devices and the
+// machine info, host metrics, custom metrics and model metrics samples they report.
+type Store interface {
+	// VerifyDevice checks that the device is registered and not revoked, and that it uses
+	// the pinned public key. The key is pinned the first time the device comes online if
+	// the registry has no key of the device. Unknown devices are registered with the key
+	// when autoRegister is true, otherwise they are refused with ErrDeviceNotRegistered.
+	VerifyDevice(ctx context.Context, nodeId string, pubKey []byte, autoRegister bool) error
+	// RegisterDevice adds the device to the registry or updates it, a revoked device is
+	// approved again. The pinned key is replaced if a new key is given.
+	RegisterDevice(ctx context.Context, device types.MDBDeviceRegistry) error
+	// RevokeDevice marks the device revoked and deletes its online record, so that the
+	// instance holding its session finds the session no longer owned and kicks it.
+	RevokeDevice(ctx context.Context, nodeId string) error
+	ListDevices(ctx context.Context) ([]types.MDBDeviceRegistry, error)
+
+	// NodeOnline marks the device online with the session atomically, ErrNodeAlreadyOnline
+	// is returned if the device is online with another session whose lease has not expired.
+	NodeOnline(ctx context.Context, nodeId, session string, pubKey []byte) error
+	// TakeoverNodeOnline marks the device online even if it is still online with another
+	// session, and returns the record of the session taken over, nil if there is none.
+	// With sameKey only a session of the same public key can be taken over, otherwise
+	// ErrNodeAlreadyOnline is returned like NodeOnline.
+	TakeoverNodeOnline(ctx context.Context, nodeId, session string, pubKey []byte, sameKey bool) (*types.MDBDeviceOnline, error)
+	// RefreshNodeOnline renews the lease of the online record of the session.
+	RefreshNodeOnline(ctx context.Context, nodeId, session string) error
+	// NodeOffline deletes the online record of the session, the record of a new session
+	// which has taken over the device is kept.
+	NodeOffline(ctx context.Context, nodeId, session string) error
+	IsNodeOnline(ctx context.Context, nodeId string) bool
+	// ListOnlineDevices returns the online records of all instances whose lease has not expired.
+	ListOnlineDevices(ctx context.Context) ([]types.MDBDeviceOnline, error)
+	// OwnedSessions returns which of the sessions still own the online record of their device.
+	OwnedSessions(ctx context.Context, sessions []string) (map[string]bool, error)
+
+	AddDeviceInfo(ctx context.Context, nodeId string, tm time.Time, info types.WsMachineInfoRequest) error
+	// AddDeviceInfos inserts the samples in one batch.
+	AddDeviceInfos(ctx context.Context, infos []types.MDBDeviceInfo) error
+	// GetLatestDeviceInfo returns the latest sample of the device, ErrDeviceInfoNotFound if
+	// the device has no sample.
+	GetLatestDeviceInfo(ctx context.Context, nodeId string) (*types.MDBDeviceInfo, error)
+	// GetLatestDeviceInfos returns the latest sample of each device, indexed by node id.
+	// Devices without any sample are not in the result.
+	GetLatestDeviceInfos(ctx context.Context, nodeIds []string) (map[string]types.MDBDeviceInfo, error)
+	// GetDeviceInfoHistory aggregates the samples of the device in [from, to) into buckets
+	// of step, with one of the aggregations AggAvg, AggMax, AggMin and AggP95. AggP95 is
+	// the nearest rank percentile on every storage: the ceil(0.95 * n)-th smallest of the
+	// n samples of the bucket, always one of the samples.
+	GetDeviceInfoHistory(ctx context.Context, nodeId string, from, to time.Time, step time.Duration, agg string) ([]types.DeviceInfoPoint, error)
+	// DeleteExpiredDeviceInfo deletes the samples of machine info, host metrics, custom
+	// metrics and model metrics before tm.
+	DeleteExpiredDeviceInfo(ctx context.Context, tm time.Time) error
+
+	// AddHostMetrics inserts a sample of the system metrics of the host of the device.
+	AddHostMetrics(ctx context.Context, nodeId string, tm time.Time, metrics types.WsHostMetricsRequest) error
+	// AddCustomMetrics inserts the samples of the custom metrics of the device, the samples
+	// without timestamp take tm.
+	AddCustomMetrics(ctx context.Context, nodeId string, tm time.Time, samples []types.CustomSample) error
+	// AddModelMetrics inserts a sample of the serving stats of each model of the device.
+	AddModelMetrics(ctx context.Context, nodeId string, tm time.Time, metrics types.WsModelMetricsRequest) error
+
+	// Ping checks the connection to the storage, ErrStoreUnavailable is returned if it
+	// cannot be used now.
+	Ping(ctx context.Context) error
+	Disconnect(ctx context.Context)
+}
+
+// Instrumented is implemented by the storages which export their own metrics.
+type Instrumented interface {
+	Collectors() []prometheus.Collector
+}
+
+// NewStore creates the storage selected by the configuration.
+func NewStore(ctx context.Context, cfg *types.Config) (Store, error) {
+	switch cfg.Storage.Type {
+	case "", types.StorageMongoDB:
+		return NewMongoDB(ctx, cfg.MongoDB.URI, cfg.MongoDB.Database, cfg.MongoDB.ExpireTime, cfg.InstanceId)
+	case types.StoragePostgreSQL:
+		return NewPostgreSQL(ctx, cfg.PostgreSQL.URI, cfg.MongoDB.ExpireTime, cfg.InstanceId)
+	case types.StorageEmbedded:
+		if cfg.Storage.DataDir == "" {
+			return nil, errors.New("data directory of embedded storage is not set")
+		}
+		return NewEmbeddedDB(cfg.Storage.DataDir, time.Duration(cfg.MongoDB.ExpireTime)*time.Second, cfg.InstanceId)
+	case types.StorageMemory:
+		return NewMemoryDB(time.Duration(cfg.MongoDB.ExpireTime)*time.Second, cfg.InstanceId), nil
+	}
+	return nil, fmt.Errorf("unknown storage type %q", cfg.Storage.Type)
+}
+
+// bucketReference is the reference time of the time buckets, the same as $dateTrunc of MongoDB.
+var bucketReference = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// truncateTime returns the start of the time bucket of step containing tm.
+func truncateTime(tm time.Time, step time.Duration) time.Time {
+	d := tm.Sub(bucketReference)
+	bucket := d / step
+	if d%step < 0 {
+		bucket--
+	}
+	return bucketReference.Add(bucket * step)
+}
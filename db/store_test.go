@@ -0,0 +1,347 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"health-monitoring/types"
+)
+
+// The tests of the behaviours every Store must have, they are run against each implementation.
+
+// testNodeOnlineRace checks that only one of the connections racing for the same node comes online.
+func testNodeOnlineRace(ctx context.Context, t *testing.T, store Store) {
+	const connections = 50
+	var wg sync.WaitGroup
+	var online, repeated, failed atomic.Int32
+	for i := 0; i < connections; i++ {
+		wg.Add(1)
+		go func(session string) {
+			defer wg.Done()
+			err := store.NodeOnline(ctx, "race-node", session, nil)
+			if err == nil {
+				online.Add(1)
+			} else if errors.Is(err, ErrNodeAlreadyOnline) {
+				repeated.Add(1)
+			} else {
+				failed.Add(1)
+				t.Logf("NodeOnline failed: %v", err)
+			}
+		}(strconv.Itoa(i))
+	}
+	wg.Wait()
+
+	t.Logf("online %v, repeated %v, failed %v", online.Load(), repeated.Load(), failed.Load())
+	if online.Load() != 1 || repeated.Load() != connections-1 {
+		t.Fatalf("expect exactly 1 connection online and %v repeated", connections-1)
+	}
+	if !store.IsNodeOnline(ctx, "race-node") {
+		t.Fatal("node should be online")
+	}
+
+	sessions := make([]string, 0, connections)
+	for i := 0; i < connections; i++ {
+		sessions = append(sessions, strconv.Itoa(i))
+	}
+	owned, err := store.OwnedSessions(ctx, sessions)
+	if err != nil || len(owned) != 1 {
+		t.Fatalf("expect exactly 1 session owning the node, got %v %v", owned, err)
+	}
+	for session := range owned {
+		if err := store.NodeOffline(ctx, "race-node", session); err != nil {
+			t.Fatalf("NodeOffline failed: %v", err)
+		}
+	}
+	if err := store.NodeOnline(ctx, "race-node", "new", nil); err != nil {
+		t.Fatalf("node should be able to online again after offline: %v", err)
+	}
+}
+
+// testTakeoverNodeOnline checks that a session takes over the device online with another
+// session and gets the record taken over, and that sameKey only takes over the sessions
+// of the same public key.
+func testTakeoverNodeOnline(ctx context.Context, t *testing.T, store Store) {
+	key1 := bytes.Repeat([]byte{1}, ed25519.PublicKeySize)
+	key2 := bytes.Repeat([]byte{2}, ed25519.PublicKeySize)
+	takeover := func(session string, key []byte, sameKey bool, want string) {
+		old, err := store.TakeoverNodeOnline(ctx, "takeover-node", session, key, sameKey)
+		if err != nil {
+			t.Fatalf("TakeoverNodeOnline of %v failed: %v", session, err)
+		}
+		if want == "" && old != nil || want != "" && (old == nil || old.Session != want) {
+			t.Fatalf("expect %q taken over by %v, got %+v", want, session, old)
+		}
+	}
+
+	takeover("session1", key1, false, "")
+	takeover("session2", key1, false, "session1")
+	if owned, err := store.OwnedSessions(ctx, []string{"session1", "session2"}); err != nil || owned["session1"] || !owned["session2"] {
+		t.Fatalf("expect only session2 owning the device, got %v %v", owned, err)
+	}
+
+	// sameKey refuses another key, the live session keeps the device
+	if _, err := store.TakeoverNodeOnline(ctx, "takeover-node", "session3", key2, true); !errors.Is(err, ErrNodeAlreadyOnline) {
+		t.Fatalf("expect ErrNodeAlreadyOnline taking over with another key, got %v", err)
+	}
+	if owned, err := store.OwnedSessions(ctx, []string{"session2"}); err != nil || !owned["session2"] {
+		t.Fatalf("expect session2 still owning the device, got %v %v", owned, err)
+	}
+	takeover("session3", key1, true, "session2")
+	old, err := store.TakeoverNodeOnline(ctx, "takeover-node", "session4", key2, false)
+	if err != nil || old == nil || old.Session != "session3" || !bytes.Equal(old.PubKey, key1) {
+		t.Fatalf("expect session3 of key1 taken over regardless of the key, got %+v %v", old, err)
+	}
+
+	// The session taken over going offline keeps the record of the new one
+	if err := store.NodeOffline(ctx, "takeover-node", "session3"); err != nil {
+		t.Fatalf("NodeOffline failed: %v", err)
+	}
+	if !store.IsNodeOnline(ctx, "takeover-node") {
+		t.Fatal("expect the device still online with session4")
+	}
+}
+
+// testLatestDeviceInfo checks that the latest sample is picked by timestamp instead of insertion order.
+func testLatestDeviceInfo(ctx context.Context, t *testing.T, store Store) {
+	if _, err := store.GetLatestDeviceInfo(ctx, "node1"); !errors.Is(err, ErrDeviceInfoNotFound) {
+		t.Fatalf("expect ErrDeviceInfoNotFound before any sample, got %v", err)
+	}
+
+	tm := time.Now().Truncate(time.Millisecond)
+	// insert out of order, the latest sample must be picked by timestamp
+	samples := []struct {
+		nodeId      string
+		offset      time.Duration
+		utilization int
+	}{
+		{"node1", -2 * time.Minute, 20},
+		{"node1", 0, 40},
+		{"node1", -time.Minute, 30},
+		{"node2", -3 * time.Minute, 50},
+		{"node2", -4 * time.Minute, 60},
+	}
+	for _, sample := range samples {
+		if err := store.AddDeviceInfo(ctx, sample.nodeId, tm.Add(sample.offset), types.WsMachineInfoRequest{
+			Project:        "DecentralGPT",
+			Models:         []types.ModelInfo{{Model: "Codestral-22B-v0.1"}},
+			GPUName:        "NVIDIA RTX A5000",
+			UtilizationGPU: sample.utilization,
+			MemoryTotal:    24564,
+			MemoryUsed:     22128,
+		}); err != nil {
+			t.Fatalf("AddDeviceInfo failed: %v", err)
+		}
+	}
+
+	info, err := store.GetLatestDeviceInfo(ctx, "node1")
+	if err != nil {
+		t.Fatalf("GetLatestDeviceInfo failed: %v", err)
+	}
+	if info.UtilizationGPU != 40 || !info.Timestamp.Equal(tm) || info.Device.DeviceId != "node1" {
+		t.Fatalf("unexpected latest device info of node1: %+v", info)
+	}
+
+	infos, err := store.GetLatestDeviceInfos(ctx, []string{"node1", "node2", "node3"})
+	if err != nil {
+		t.Fatalf("GetLatestDeviceInfos failed: %v", err)
+	}
+	if len(infos) != 2 {
+		t.Fatalf("expect latest device info of 2 devices, got %v", len(infos))
+	}
+	if infos["node1"].UtilizationGPU != 40 || infos["node2"].UtilizationGPU != 50 {
+		t.Fatalf("unexpected latest device infos: %+v", infos)
+	}
+}
+
+// testGPUDeviceInfo checks that the samples of the GPUs are stored beside the sample of
+// the device without being taken as samples of the device.
+func testGPUDeviceInfo(ctx context.Context, t *testing.T, store Store) {
+	tm := time.Now().Truncate(time.Millisecond)
+	info := types.WsMachineInfoRequest{
+		Project: "DecentralGPT",
+		GPUs: []types.GPUInfo{
+			{Index: 0, UUID: "GPU-0", Name: "NVIDIA RTX A5000", UtilizationGPU: 30, MemoryTotal: 24564, MemoryUsed: 20000, Temperature: 60},
+			{Index: 1, UUID: "GPU-1", Name: "NVIDIA RTX A5000", UtilizationGPU: 50, MemoryTotal: 24564, MemoryUsed: 10000, Temperature: 70},
+		},
+	}
+	if err := info.Normalize(types.WsMachineInfoVersionGPUs); err != nil {
+		t.Fatalf("Normalize failed: %v", err)
+	}
+	if err := store.AddDeviceInfo(ctx, "node1", tm, info); err != nil {
+		t.Fatalf("AddDeviceInfo failed: %v", err)
+	}
+
+	latest, err := store.GetLatestDeviceInfo(ctx, "node1")
+	if err != nil {
+		t.Fatalf("GetLatestDeviceInfo failed: %v", err)
+	}
+	if latest.Device.GPUIndex != nil || latest.UtilizationGPU != 40 || latest.MemoryTotal != 2*24564 || latest.MemoryUsed != 30000 {
+		t.Fatalf("expect the sample of the whole device, got %+v", latest)
+	}
+	infos, err := store.GetLatestDeviceInfos(ctx, []string{"node1"})
+	if err != nil {
+		t.Fatalf("GetLatestDeviceInfos failed: %v", err)
+	}
+	if info := infos["node1"]; info.Device.GPUIndex != nil || info.UtilizationGPU != 40 {
+		t.Fatalf("expect the sample of the whole device, got %+v", infos)
+	}
+	points, err := store.GetDeviceInfoHistory(ctx, "node1", tm.Add(-time.Minute), tm.Add(time.Minute), 2*time.Minute, types.AggMax)
+	if err != nil {
+		t.Fatalf("GetDeviceInfoHistory failed: %v", err)
+	}
+	if len(points) != 1 || points[0].Count != 1 || points[0].UtilizationGPU != 40 {
+		t.Fatalf("expect only the sample of the whole device in the history, got %+v", points)
+	}
+}
+
+// testDeviceRegistry checks the allow-list, key pinning and revocation of the registry.
+func testDeviceRegistry(ctx context.Context, t *testing.T, store Store) {
+	key1 := bytes.Repeat([]byte{1}, ed25519.PublicKeySize)
+	key2 := bytes.Repeat([]byte{2}, ed25519.PublicKeySize)
+
+	if err := store.VerifyDevice(ctx, "node1", key1, false); !errors.Is(err, ErrDeviceNotRegistered) {
+		t.Fatalf("expect ErrDeviceNotRegistered of unknown device, got %v", err)
+	}
+	if err := store.RevokeDevice(ctx, "node1"); !errors.Is(err, ErrDeviceNotRegistered) {
+		t.Fatalf("expect ErrDeviceNotRegistered revoking unknown device, got %v", err)
+	}
+
+	// Auto registration pins the key of the first online
+	if err := store.VerifyDevice(ctx, "node1", key1, true); err != nil {
+		t.Fatalf("expect unknown device auto registered, got %v", err)
+	}
+	if err := store.VerifyDevice(ctx, "node1", key1, false); err != nil {
+		t.Fatalf("expect auto registered device verified, got %v", err)
+	}
+	if err := store.VerifyDevice(ctx, "node1", key2, true); !errors.Is(err, ErrPubKeyMismatch) {
+		t.Fatalf("expect ErrPubKeyMismatch with another key, got %v", err)
+	}
+
+	// A device registered without key pins the key at the first online
+	if err := store.RegisterDevice(ctx, types.MDBDeviceRegistry{DeviceId: "node2", Project: "DecentralGPT", Owner: "alice"}); err != nil {
+		t.Fatalf("RegisterDevice failed: %v", err)
+	}
+	if err := store.VerifyDevice(ctx, "node2", key2, false); err != nil {
+		t.Fatalf("expect key pinned at the first online, got %v", err)
+	}
+	if err := store.VerifyDevice(ctx, "node2", key1, false); !errors.Is(err, ErrPubKeyMismatch) {
+		t.Fatalf("expect ErrPubKeyMismatch after the key is pinned, got %v", err)
+	}
+
+	// Revoked devices are refused until they are registered again, a new key replaces the pinned one.
+	// Revoking drops the online record, the session is no longer owned on any instance
+	if err := store.NodeOnline(ctx, "node2", "session2", key2); err != nil {
+		t.Fatalf("NodeOnline failed: %v", err)
+	}
+	if err := store.RevokeDevice(ctx, "node2"); err != nil {
+		t.Fatalf("RevokeDevice failed: %v", err)
+	}
+	if owned, err := store.OwnedSessions(ctx, []string{"session2"}); err != nil || owned["session2"] {
+		t.Fatalf("expect the session of the revoked device not owned, got %v %v", owned, err)
+	}
+	if store.IsNodeOnline(ctx, "node2") {
+		t.Fatal("expect the revoked device offline")
+	}
+	if err := store.VerifyDevice(ctx, "node2", key2, true); !errors.Is(err, ErrDeviceRevoked) {
+		t.Fatalf("expect ErrDeviceRevoked, got %v", err)
+	}
+	if err := store.RegisterDevice(ctx, types.MDBDeviceRegistry{DeviceId: "node2", PubKey: key1, Project: "DecentralGPT", Owner: "bob"}); err != nil {
+		t.Fatalf("RegisterDevice failed: %v", err)
+	}
+	if err := store.VerifyDevice(ctx, "node2", key1, false); err != nil {
+		t.Fatalf("expect device approved again with the new key, got %v", err)
+	}
+
+	devices, err := store.ListDevices(ctx)
+	if err != nil {
+		t.Fatalf("ListDevices failed: %v", err)
+	}
+	if len(devices) != 2 || devices[0].DeviceId != "node1" || devices[1].DeviceId != "node2" {
+		t.Fatalf("expect node1 and node2 in order, got %+v", devices)
+	}
+	if devices[1].Revoked || devices[1].Owner != "bob" || !bytes.Equal(devices[1].PubKey, key1) {
+		t.Fatalf("unexpected registry of node2: %+v", devices[1])
+	}
+}
+
+// testOnlineLease checks that an online record whose lease is not renewed stops blocking
+// the device. age moves the heartbeat of the record of the device back by d.
+func testOnlineLease(ctx context.Context, t *testing.T, store Store, age func(nodeId string, d time.Duration)) {
+	if err := store.NodeOnline(ctx, "lease-node", "session1", nil); err != nil {
+		t.Fatalf("NodeOnline failed: %v", err)
+	}
+	if err := store.NodeOnline(ctx, "lease-node", "session2", nil); !errors.Is(err, ErrNodeAlreadyOnline) {
+		t.Fatalf("expect ErrNodeAlreadyOnline within the lease, got %v", err)
+	}
+
+	// Only the session owning the record renews the lease
+	age("lease-node", OnlineLease/2)
+	if err := store.RefreshNodeOnline(ctx, "lease-node", "session2"); err != nil {
+		t.Fatalf("RefreshNodeOnline failed: %v", err)
+	}
+	devices, err := store.ListOnlineDevices(ctx)
+	if err != nil || len(devices) != 1 {
+		t.Fatalf("expect 1 online device, got %+v %v", devices, err)
+	}
+	if time.Since(devices[0].Heartbeat) < OnlineLease/4 {
+		t.Fatalf("expect the lease not renewed by another session, heartbeat %v", devices[0].Heartbeat)
+	}
+	if err := store.RefreshNodeOnline(ctx, "lease-node", "session1"); err != nil {
+		t.Fatalf("RefreshNodeOnline failed: %v", err)
+	}
+	devices, err = store.ListOnlineDevices(ctx)
+	if err != nil || len(devices) != 1 || time.Since(devices[0].Heartbeat) > OnlineLease/4 {
+		t.Fatalf("expect the lease renewed by the owner, got %+v %v", devices, err)
+	}
+
+	// The expired record is ignored and can be replaced
+	age("lease-node", OnlineLease+time.Second)
+	if store.IsNodeOnline(ctx, "lease-node") {
+		t.Fatal("expect the device offline after the lease expired")
+	}
+	if devices, err := store.ListOnlineDevices(ctx); err != nil || len(devices) != 0 {
+		t.Fatalf("expect no online device after the lease expired, got %+v %v", devices, err)
+	}
+	if err := store.NodeOnline(ctx, "lease-node", "session2", nil); err != nil {
+		t.Fatalf("expect online after the lease expired, got %v", err)
+	}
+	owned, err := store.OwnedSessions(ctx, []string{"session1", "session2"})
+	if err != nil || len(owned) != 1 || !owned["session2"] {
+		t.Fatalf("expect only session2 owning the device, got %v %v", owned, err)
+	}
+}
+
+// testDeviceInfoP95 checks that every storage computes p95 with the nearest rank method.
+func testDeviceInfoP95(ctx context.Context, t *testing.T, store Store) {
+	from := time.Now().Add(-time.Hour).Truncate(time.Hour)
+	// 40 samples of 1 to 40 in the first minute and 10 samples of 1 to 10 in the second,
+	// inserted out of order
+	for i := 0; i < 40; i++ {
+		value := (i*7)%40 + 1
+		if err := store.AddDeviceInfo(ctx, "node1", from.Add(time.Duration(i)*time.Second), types.WsMachineInfoRequest{UtilizationGPU: value}); err != nil {
+			t.Fatalf("AddDeviceInfo failed: %v", err)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		value := (i*3)%10 + 1
+		if err := store.AddDeviceInfo(ctx, "node1", from.Add(time.Minute+time.Duration(i)*time.Second), types.WsMachineInfoRequest{UtilizationGPU: value}); err != nil {
+			t.Fatalf("AddDeviceInfo failed: %v", err)
+		}
+	}
+
+	points, err := store.GetDeviceInfoHistory(ctx, "node1", from, from.Add(2*time.Minute), time.Minute, types.AggP95)
+	if err != nil {
+		t.Fatalf("GetDeviceInfoHistory failed: %v", err)
+	}
+	// ceil(0.95 * 40) = 38 and ceil(0.95 * 10) = 10
+	if len(points) != 2 || points[0].UtilizationGPU != 38 || points[1].UtilizationGPU != 10 {
+		t.Fatalf("expect p95 of 38 and 10, got %+v", points)
+	}
+}
@@ -0,0 +1,308 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"health-monitoring/types"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+// defaultCustomMaxSeries limits the label combinations of a custom metric of one device
+// if the schema does not set it.
+const defaultCustomMaxSeries = 100
+
+// reservedMetricNames and reservedMetricPrefixes are the names of the metrics exported by
+// the server itself and the Go client, a custom metric must not take them.
+var (
+	reservedMetricNames    = []string{"utilization_gpu", "device_info", "device_model_loaded", "custom_metrics_rejected_total"}
+	reservedMetricPrefixes = []string{"memory_", "gpu_", "host_", "model_", "device_info_", "ws_", "remote_write_", "mongo_", "go_", "process_", "promhttp_"}
+)
+
+// isReservedMetricName reports whether the name is taken by a metric of the server.
+func isReservedMetricName(name string) bool {
+	if slices.Contains(reservedMetricNames, name) {
+		return true
+	}
+	for _, prefix := range reservedMetricPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	ErrUnknownCustomMetric = errors.New("metric is not configured")
+	ErrCustomMetricType    = errors.New("type does not match the configured type")
+	ErrUnknownCustomLabel  = errors.New("label is not configured")
+	ErrInvalidHistogram    = errors.New("histogram buckets must be sorted by upper bound with non-decreasing counts")
+	ErrTooManySeries       = errors.New("too many label combinations of the metric")
+)
+
+// customSchema is a configured custom metric with its description exported to Prometheus.
+type customSchema struct {
+	types.CustomMetric
+	desc *prometheus.Desc
+}
+
+// customSeries is the latest sample of one series of a device.
+type customSeries struct {
+	metric      string
+	labelValues []string // 按配置中 Labels 的顺序排列，没有上报的标签为空字符串
+	sample      types.CustomSample
+}
+
+// CustomMetrics checks the custom metrics reported by the devices against the configured
+// schema, and exports the latest sample of each series. It is a prometheus.Collector
+// whose metrics change with the schema, so that agents can ship new series by changing
+// the configuration instead of the server.
+type CustomMetrics struct {
+	jobName string
+	schema  map[string]customSchema
+	series  map[string]map[string]customSeries // 每个设备的序列，以指标名称和标签值为键
+	mutex   sync.RWMutex
+
+	rejectedTotal *prometheus.CounterVec
+}
+
+// NewCustomMetrics validates the schema and creates the collector, the metrics of devices
+// are only exported when the job name is configured like PrometheusMetrics.
+func NewCustomMetrics(jobName string, metrics []types.CustomMetric) (*CustomMetrics, error) {
+	cm := &CustomMetrics{
+		jobName: jobName,
+		schema:  make(map[string]customSchema, len(metrics)),
+		series:  make(map[string]map[string]customSeries),
+		rejectedTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "custom_metrics_rejected_total",
+				Help: "number of custom metric samples rejected by reason",
+			},
+			[]string{"reason"},
+		),
+	}
+	for _, metric := range metrics {
+		if !model.IsValidMetricName(model.LabelValue(metric.Name)) {
+			return nil, fmt.Errorf("invalid name of custom metric %q", metric.Name)
+		}
+		if isReservedMetricName(metric.Name) {
+			return nil, fmt.Errorf("name of custom metric %v is reserved by the server", metric.Name)
+		}
+		if _, ok := cm.schema[metric.Name]; ok {
+			return nil, fmt.Errorf("duplicate custom metric %v", metric.Name)
+		}
+		switch metric.Type {
+		case types.CustomMetricGauge, types.CustomMetricCounter, types.CustomMetricHistogram:
+		default:
+			return nil, fmt.Errorf("invalid type %q of custom metric %v", metric.Type, metric.Name)
+		}
+		for i, label := range metric.Labels {
+			if !model.LabelName(label).IsValid() || strings.HasPrefix(label, "__") ||
+				label == "job" || label == "instance" || (metric.Type == types.CustomMetricHistogram && label == "le") {
+				return nil, fmt.Errorf("invalid label %q of custom metric %v", label, metric.Name)
+			}
+			if slices.Contains(metric.Labels[:i], label) {
+				return nil, fmt.Errorf("duplicate label %v of custom metric %v", label, metric.Name)
+			}
+		}
+		if metric.MaxSeries <= 0 {
+			metric.MaxSeries = defaultCustomMaxSeries
+		}
+		help := metric.Help
+		if help == "" {
+			help = "custom metric " + metric.Name
+		}
+		cm.schema[metric.Name] = customSchema{
+			CustomMetric: metric,
+			desc:         prometheus.NewDesc(metric.Name, help, append([]string{"job", "instance"}, metric.Labels...), nil),
+		}
+	}
+	return cm, nil
+}
+
+// Collectors returns the collector of the custom metrics and its own metrics to be registered.
+func (cm *CustomMetrics) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{cm, cm.rejectedTotal}
+}
+
+// Check returns the samples allowed by the schema. The first rejection is returned as the
+// error, the rejected samples are counted by reason.
+func (cm *CustomMetrics) Check(nodeId string, samples []types.CustomSample) ([]types.CustomSample, error) {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+	// The label combinations of each metric of the device, including the new ones of the request
+	known := make(map[string]map[string]bool)
+	for key, series := range cm.series[nodeId] {
+		if known[series.metric] == nil {
+			known[series.metric] = make(map[string]bool)
+		}
+		known[series.metric][key] = true
+	}
+
+	accepted := make([]types.CustomSample, 0, len(samples))
+	var first error
+	for _, sample := range samples {
+		key, err := cm.check(sample, known)
+		if err != nil {
+			cm.rejectedTotal.WithLabelValues(rejectReason(err)).Inc()
+			if first == nil {
+				first = fmt.Errorf("%v: %w", sample.Name, err)
+			}
+			continue
+		}
+		if known[sample.Name] == nil {
+			known[sample.Name] = make(map[string]bool)
+		}
+		known[sample.Name][key] = true
+		accepted = append(accepted, sample)
+	}
+	return accepted, first
+}
+
+// check returns the key of the series of the sample if it is allowed.
+func (cm *CustomMetrics) check(sample types.CustomSample, known map[string]map[string]bool) (string, error) {
+	schema, ok := cm.schema[sample.Name]
+	if !ok {
+		return "", ErrUnknownCustomMetric
+	}
+	if sample.Type != schema.Type {
+		return "", ErrCustomMetricType
+	}
+	for label := range sample.Labels {
+		if !slices.Contains(schema.Labels, label) {
+			return "", ErrUnknownCustomLabel
+		}
+	}
+	if schema.Type == types.CustomMetricHistogram {
+		for i, bucket := range sample.Buckets {
+			if i > 0 && (bucket.UpperBound <= sample.Buckets[i-1].UpperBound || bucket.Count < sample.Buckets[i-1].Count) {
+				return "", ErrInvalidHistogram
+			}
+		}
+		if n := len(sample.Buckets); n > 0 && sample.Count < sample.Buckets[n-1].Count {
+			return "", ErrInvalidHistogram
+		}
+	}
+	key := seriesKey(sample.Name, labelValues(schema.Labels, sample.Labels))
+	if !known[sample.Name][key] && len(known[sample.Name]) >= schema.MaxSeries {
+		return "", ErrTooManySeries
+	}
+	return key, nil
+}
+
+func rejectReason(err error) string {
+	switch err {
+	case ErrUnknownCustomMetric:
+		return "unknown_metric"
+	case ErrCustomMetricType:
+		return "type_mismatch"
+	case ErrUnknownCustomLabel:
+		return "unknown_label"
+	case ErrInvalidHistogram:
+		return "invalid_histogram"
+	case ErrTooManySeries:
+		return "too_many_series"
+	default:
+		return "unknown"
+	}
+}
+
+// labelValues returns the values of the labels in the order of the schema.
+func labelValues(names []string, labels map[string]string) []string {
+	values := make([]string, len(names))
+	for i, name := range names {
+		values[i] = labels[name]
+	}
+	return values
+}
+
+func seriesKey(metric string, labelValues []string) string {
+	return metric + "\xff" + strings.Join(labelValues, "\xff")
+}
+
+// Set keeps the samples checked by Check as the latest samples of their series. Another
+// request of the device may add series between Check and Set, so the new series beyond
+// MaxSeries are dropped here again under the lock.
+func (cm *CustomMetrics) Set(nodeId string, samples []types.CustomSample) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	series := cm.series[nodeId]
+	if series == nil {
+		series = make(map[string]customSeries)
+		cm.series[nodeId] = series
+	}
+	counts := make(map[string]int) // 每个指标已有的标签组合数
+	for _, s := range series {
+		counts[s.metric]++
+	}
+	for _, sample := range samples {
+		schema, ok := cm.schema[sample.Name]
+		if !ok {
+			continue
+		}
+		values := labelValues(schema.Labels, sample.Labels)
+		key := seriesKey(sample.Name, values)
+		if _, ok := series[key]; !ok {
+			if counts[sample.Name] >= schema.MaxSeries {
+				cm.rejectedTotal.WithLabelValues(rejectReason(ErrTooManySeries)).Inc()
+				continue
+			}
+			counts[sample.Name]++
+		}
+		series[key] = customSeries{
+			metric:      sample.Name,
+			labelValues: values,
+			sample:      sample,
+		}
+	}
+}
+
+// Delete removes the series of the device.
+func (cm *CustomMetrics) Delete(nodeId string) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	delete(cm.series, nodeId)
+}
+
+func (cm *CustomMetrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, schema := range cm.schema {
+		ch <- schema.desc
+	}
+}
+
+func (cm *CustomMetrics) Collect(ch chan<- prometheus.Metric) {
+	if cm.jobName == "" {
+		return
+	}
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+	for nodeId, series := range cm.series {
+		for _, s := range series {
+			desc := cm.schema[s.metric].desc
+			values := append([]string{cm.jobName, nodeId}, s.labelValues...)
+			var metric prometheus.Metric
+			var err error
+			switch s.sample.Type {
+			case types.CustomMetricGauge:
+				metric, err = prometheus.NewConstMetric(desc, prometheus.GaugeValue, s.sample.Value, values...)
+			case types.CustomMetricCounter:
+				metric, err = prometheus.NewConstMetric(desc, prometheus.CounterValue, s.sample.Value, values...)
+			case types.CustomMetricHistogram:
+				buckets := make(map[float64]uint64, len(s.sample.Buckets))
+				for _, bucket := range s.sample.Buckets {
+					buckets[bucket.UpperBound] = bucket.Count
+				}
+				metric, err = prometheus.NewConstHistogram(desc, s.sample.Count, s.sample.Sum, buckets, values...)
+			}
+			if err != nil {
+				metric = prometheus.NewInvalidMetric(desc, err)
+			}
+			ch <- metric
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package http
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"health-monitoring/types"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// go test -v -timeout 30s -count=1 -run TestCustomMetricsSchema health-monitoring/http
+func TestCustomMetricsSchema(t *testing.T) {
+	invalid := [][]types.CustomMetric{
+		{{Name: "bad-name", Type: types.CustomMetricGauge}},
+		{{Name: "queue", Type: "summary"}},
+		{{Name: "queue", Type: types.CustomMetricGauge, Labels: []string{"instance"}}},
+		{{Name: "queue", Type: types.CustomMetricGauge, Labels: []string{"model", "model"}}},
+		{{Name: "latency", Type: types.CustomMetricHistogram, Labels: []string{"le"}}},
+		{{Name: "queue", Type: types.CustomMetricGauge}, {Name: "queue", Type: types.CustomMetricCounter}},
+	}
+	// The names of the metrics of the server are reserved
+	for _, name := range []string{
+		"utilization_gpu", "memory_total", "memory_free", "device_info", "device_model_loaded", "gpu_utilization",
+		"host_load1", "model_queue_depth", "ws_pings_total", "remote_write_samples_total", "go_goroutines", "process_cpu_seconds_total",
+	} {
+		invalid = append(invalid, []types.CustomMetric{{Name: name, Type: types.CustomMetricGauge}})
+	}
+	for i, metrics := range invalid {
+		if _, err := NewCustomMetrics("test", metrics); err == nil {
+			t.Errorf("expect schema %v invalid", i)
+		}
+	}
+}
+
+// go test -v -timeout 30s -count=1 -run TestCustomMetrics health-monitoring/http
+func TestCustomMetrics(t *testing.T) {
+	cm, err := NewCustomMetrics("test", []types.CustomMetric{
+		{Name: "queue_depth", Type: types.CustomMetricGauge, Labels: []string{"model"}, MaxSeries: 2},
+		{Name: "requests_total", Type: types.CustomMetricCounter},
+		{Name: "latency_seconds", Type: types.CustomMetricHistogram},
+	})
+	if err != nil {
+		t.Fatalf("NewCustomMetrics failed: %v", err)
+	}
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(cm.Collectors()...)
+
+	samples := []types.CustomSample{
+		{Name: "queue_depth", Type: types.CustomMetricGauge, Labels: map[string]string{"model": "a"}, Value: 3},
+		{Name: "queue_depth", Type: types.CustomMetricGauge, Labels: map[string]string{"model": "b"}, Value: 5},
+		{Name: "queue_depth", Type: types.CustomMetricGauge, Labels: map[string]string{"model": "c"}, Value: 1},
+		{Name: "queue_depth", Type: types.CustomMetricGauge, Labels: map[string]string{"gpu": "0"}},
+		{Name: "requests_total", Type: types.CustomMetricGauge, Value: 10},
+		{Name: "unknown", Type: types.CustomMetricGauge},
+		{Name: "requests_total", Type: types.CustomMetricCounter, Value: 100},
+		{Name: "latency_seconds", Type: types.CustomMetricHistogram, Count: 3, Sum: 1.5, Buckets: []types.HistogramBucket{{UpperBound: 0.5, Count: 2}, {UpperBound: 1, Count: 3}}},
+		{Name: "latency_seconds", Type: types.CustomMetricHistogram, Count: 3, Buckets: []types.HistogramBucket{{UpperBound: 1, Count: 3}, {UpperBound: 0.5, Count: 2}}},
+	}
+	accepted, err := cm.Check("node1", samples)
+	if !errors.Is(err, ErrTooManySeries) {
+		t.Fatalf("expect the third model rejected first, got %v", err)
+	}
+	if len(accepted) != 4 {
+		t.Fatalf("expect 4 samples accepted, got %+v", accepted)
+	}
+	for reason, count := range map[string]float64{
+		"too_many_series":   1,
+		"unknown_label":     1,
+		"type_mismatch":     1,
+		"unknown_metric":    1,
+		"invalid_histogram": 1,
+	} {
+		if v := testutil.ToFloat64(cm.rejectedTotal.WithLabelValues(reason)); v != count {
+			t.Errorf("expect %v rejected %v, got %v", reason, count, v)
+		}
+	}
+	cm.Set("node1", accepted)
+
+	expected := `
+# HELP queue_depth custom metric queue_depth
+# TYPE queue_depth gauge
+queue_depth{instance="node1",job="test",model="a"} 3
+queue_depth{instance="node1",job="test",model="b"} 5
+# HELP requests_total custom metric requests_total
+# TYPE requests_total counter
+requests_total{instance="node1",job="test"} 100
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(expected), "queue_depth", "requests_total"); err != nil {
+		t.Fatalf("unexpected custom metrics: %v", err)
+	}
+	if n, err := testutil.GatherAndCount(reg, "latency_seconds"); err != nil || n != 1 {
+		t.Fatalf("expect 1 histogram, got %v %v", n, err)
+	}
+
+	// The existing series are still accepted after the limit is reached
+	if _, err := cm.Check("node1", samples[:1]); err != nil {
+		t.Fatalf("expect the known series accepted, got %v", err)
+	}
+
+	cm.Delete("node1")
+	if n, err := testutil.GatherAndCount(reg, "queue_depth", "requests_total", "latency_seconds"); err != nil || n != 0 {
+		t.Fatalf("expect the series deleted with the device, got %v %v", n, err)
+	}
+}
+
+// go test -v -timeout 30s -count=1 -run TestCustomMetricsMaxSeriesRace health-monitoring/http
+func TestCustomMetricsMaxSeriesRace(t *testing.T) {
+	cm, err := NewCustomMetrics("test", []types.CustomMetric{
+		{Name: "queue_depth", Type: types.CustomMetricGauge, Labels: []string{"model"}, MaxSeries: 1},
+	})
+	if err != nil {
+		t.Fatalf("NewCustomMetrics failed: %v", err)
+	}
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(cm.Collectors()...)
+
+	// Two requests of the device are both checked before either is set
+	a := []types.CustomSample{{Name: "queue_depth", Type: types.CustomMetricGauge, Labels: map[string]string{"model": "a"}, Value: 1}}
+	b := []types.CustomSample{{Name: "queue_depth", Type: types.CustomMetricGauge, Labels: map[string]string{"model": "b"}, Value: 2}}
+	acceptedA, errA := cm.Check("node1", a)
+	acceptedB, errB := cm.Check("node1", b)
+	if errA != nil || errB != nil {
+		t.Fatalf("expect both checked, got %v %v", errA, errB)
+	}
+	cm.Set("node1", acceptedA)
+	cm.Set("node1", acceptedB)
+
+	if n, err := testutil.GatherAndCount(reg, "queue_depth"); err != nil || n != 1 {
+		t.Fatalf("expect 1 series kept by MaxSeries, got %v %v", n, err)
+	}
+	if v := testutil.ToFloat64(cm.rejectedTotal.WithLabelValues("too_many_series")); v != 1 {
+		t.Fatalf("expect 1 sample rejected by Set, got %v", v)
+	}
+}
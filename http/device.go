@@ -0,0 +1,254 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"health-monitoring/db"
+	"health-monitoring/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// databaseError responds the failure of the storage, 503 if it is temporarily unavailable
+// so that the client can retry later.
+func databaseError(ctx *gin.Context, err error, message string) {
+	if errors.Is(err, db.ErrStoreUnavailable) {
+		ctx.JSON(http.StatusServiceUnavailable, gin.H{
+			"code":    types.ErrCodeUnavailable,
+			"message": "database is temporarily unavailable, try again later",
+		})
+		return
+	}
+	ctx.JSON(http.StatusInternalServerError, gin.H{
+		"code":    types.ErrCodeDatabase,
+		"message": message,
+	})
+}
+
+// ListOnlineDevices lists the devices online on all instances with their latest machine
+// info. The info of the devices connected to this instance comes from the local registry,
+// the others are read from the database.
+//
+// Query parameters: project, model and gpu_name filter the devices, page (from 1) and
+// page_size paginate the result.
+func ListOnlineDevices(store db.Store, od *types.OnlineDevices) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		page, err := strconv.Atoi(ctx.DefaultQuery("page", "1"))
+		if err != nil || page < 1 {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"code":    types.ErrCodeParam,
+				"message": "invalid page",
+			})
+			return
+		}
+		pageSize, err := strconv.Atoi(ctx.DefaultQuery("page_size", strconv.Itoa(defaultPageSize)))
+		if err != nil || pageSize < 1 || pageSize > maxPageSize {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"code":    types.ErrCodeParam,
+				"message": "invalid page_size",
+			})
+			return
+		}
+		project, model, gpuName := ctx.Query("project"), ctx.Query("model"), ctx.Query("gpu_name")
+
+		ctx1, cancel := context.WithTimeout(ctx.Request.Context(), 10*time.Second)
+		defer cancel()
+		onlines, err := store.ListOnlineDevices(ctx1)
+		if err != nil {
+			databaseError(ctx, err, "list online devices failed")
+			return
+		}
+
+		// Only the devices connected to other instances need to be read from the database
+		remoteIds := make([]string, 0)
+		for _, online := range onlines {
+			if device, ok := od.Get(online.DeviceId); !ok || device.Session != online.Session {
+				remoteIds = append(remoteIds, online.DeviceId)
+			}
+		}
+		latest := make(map[string]types.MDBDeviceInfo)
+		if len(remoteIds) != 0 {
+			latest, err = store.GetLatestDeviceInfos(ctx1, remoteIds)
+			if err != nil {
+				databaseError(ctx, err, "query latest device info failed")
+				return
+			}
+		}
+
+		devices := make([]types.DeviceStatus, 0, len(onlines))
+		for _, online := range onlines {
+			status := types.DeviceStatus{
+				NodeId:        online.DeviceId,
+				Instance:      online.Instance,
+				ConnectTime:   online.AddTime,
+				LastHeartbeat: online.Heartbeat,
+			}
+			if device, ok := od.Get(online.DeviceId); ok && device.Session == online.Session {
+				if device.MachineInfo != nil {
+					infoTime := device.MachineInfoTime
+					status.InfoTime = &infoTime
+					status.Project = device.MachineInfo.Project
+					status.Models = device.MachineInfo.Models
+					status.GPUName = device.MachineInfo.GPUName
+					status.UtilizationGPU = device.MachineInfo.UtilizationGPU
+					status.MemoryTotal = device.MachineInfo.MemoryTotal
+					status.MemoryUsed = device.MachineInfo.MemoryUsed
+				}
+			} else if info, ok := latest[online.DeviceId]; ok {
+				infoTime := info.Timestamp
+				status.InfoTime = &infoTime
+				status.Project = info.Device.Project
+				status.Models = info.Device.Models
+				status.GPUName = info.Device.GPUName
+				status.UtilizationGPU = info.UtilizationGPU
+				status.MemoryTotal = info.MemoryTotal
+				status.MemoryUsed = info.MemoryUsed
+			}
+			if matchDevice(status, project, model, gpuName) {
+				devices = append(devices, status)
+			}
+		}
+
+		total := len(devices)
+		start := min((page-1)*pageSize, total)
+		end := min(start+pageSize, total)
+		ctx.JSON(http.StatusOK, gin.H{
+			"code":    0,
+			"message": "ok",
+			"data": types.ListDevicesResponse{
+				Total:   total,
+				Devices: devices[start:end],
+			},
+		})
+	}
+}
+
+// matchDevice reports whether the device matches all the non-empty filters.
+func matchDevice(status types.DeviceStatus, project, model, gpuName string) bool {
+	if project != "" && status.Project != project {
+		return false
+	}
+	if gpuName != "" && status.GPUName != gpuName {
+		return false
+	}
+	if model != "" {
+		for _, m := range status.Models {
+			if m.Model == model {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// GetDevice returns the latest machine info sample of the device.
+func GetDevice(store db.Store) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ctx1, cancel := context.WithTimeout(ctx.Request.Context(), 10*time.Second)
+		defer cancel()
+		info, err := store.GetLatestDeviceInfo(ctx1, ctx.Param("id"))
+		if err != nil {
+			if errors.Is(err, db.ErrDeviceInfoNotFound) {
+				ctx.JSON(http.StatusNotFound, gin.H{
+					"code":    types.ErrCodeParam,
+					"message": err.Error(),
+				})
+				return
+			}
+			databaseError(ctx, err, "query latest device info failed")
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{
+			"code":    0,
+			"message": "ok",
+			"data":    info,
+		})
+	}
+}
+
+// maxPoints limits the number of buckets of a history query.
+const maxPoints = 11000
+
+// GetDeviceMetrics returns the history of the device info aggregated into time buckets.
+//
+// Query parameters: from and to are unix seconds or RFC 3339 times, the last hour by
+// default. step is a duration of whole seconds like 30s or 5m, 1m by default. agg is
+// one of avg, max, min and p95, avg by default.
+func GetDeviceMetrics(store db.Store) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		to, err := parseTime(ctx.Query("to"), time.Now())
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"code":    types.ErrCodeParam,
+				"message": "invalid to: " + err.Error(),
+			})
+			return
+		}
+		from, err := parseTime(ctx.Query("from"), to.Add(-time.Hour))
+		if err != nil || !from.Before(to) {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"code":    types.ErrCodeParam,
+				"message": "invalid from",
+			})
+			return
+		}
+		step, err := time.ParseDuration(ctx.DefaultQuery("step", "1m"))
+		// The buckets are aligned to whole seconds by every storage
+		if err != nil || step < time.Second || step%time.Second != 0 || to.Sub(from)/step > maxPoints {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"code":    types.ErrCodeParam,
+				"message": "invalid step, it must be whole seconds and produce no more than 11000 points",
+			})
+			return
+		}
+		agg := ctx.DefaultQuery("agg", types.AggAvg)
+
+		ctx1, cancel := context.WithTimeout(ctx.Request.Context(), 30*time.Second)
+		defer cancel()
+		points, err := store.GetDeviceInfoHistory(ctx1, ctx.Param("id"), from, to, step, agg)
+		if err != nil {
+			if errors.Is(err, db.ErrUnknownAggregation) {
+				ctx.JSON(http.StatusBadRequest, gin.H{
+					"code":    types.ErrCodeParam,
+					"message": "invalid agg, it must be one of avg, max, min and p95",
+				})
+				return
+			}
+			databaseError(ctx, err, "query device metrics failed")
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{
+			"code":    0,
+			"message": "ok",
+			"data": types.DeviceMetricsResponse{
+				NodeId: ctx.Param("id"),
+				From:   from,
+				To:     to,
+				Step:   int64(step / time.Second),
+				Agg:    agg,
+				Points: points,
+			},
+		})
+	}
+}
+
+// parseTime parses unix seconds or a RFC 3339 time, an empty string returns def.
+func parseTime(s string, def time.Time) (time.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
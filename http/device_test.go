@@ -0,0 +1,199 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"health-monitoring/db"
+	"health-monitoring/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// getJSON serves the GET request and decodes the data of the response into data.
+func getJSON(t *testing.T, router *gin.Engine, path string, data any) int {
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	if w.Code == http.StatusOK && data != nil {
+		res := struct {
+			Data any `json:"data"`
+		}{Data: data}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("decode response of %v failed: %v", path, err)
+		}
+	}
+	return w.Code
+}
+
+// go test -v -timeout 30s -count=1 -run TestListOnlineDevices health-monitoring/http
+func TestListOnlineDevices(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	store := db.NewMemoryDB(time.Hour, "test")
+	od := types.NewOnlineDevices()
+
+	// node1 is connected to this instance, node2 and node3 to other instances, node4 has
+	// not reported machine info yet
+	infos := map[string]types.WsMachineInfoRequest{
+		"node1": {Project: "DecentralGPT", Models: []types.ModelInfo{{Model: "Qwen2-72B"}}, GPUName: "NVIDIA RTX A5000", UtilizationGPU: 10},
+		"node2": {Project: "DecentralGPT", Models: []types.ModelInfo{{Model: "Codestral-22B-v0.1"}}, GPUName: "NVIDIA RTX 4090", UtilizationGPU: 20},
+		"node3": {Project: "SuperImageAI", Models: []types.ModelInfo{{Model: "Qwen2-72B"}}, GPUName: "NVIDIA RTX A5000", UtilizationGPU: 30},
+	}
+	for _, id := range []string{"node1", "node2", "node3", "node4"} {
+		if err := store.NodeOnline(ctx, id, "session-"+id, nil); err != nil {
+			t.Fatalf("NodeOnline failed: %v", err)
+		}
+	}
+	info := infos["node1"]
+	od.SetDevice(types.OnlineDevice{NodeId: "node1", Session: "session-node1", MachineInfo: &info, MachineInfoTime: time.Now()})
+	for _, id := range []string{"node2", "node3"} {
+		if err := store.AddDeviceInfo(ctx, id, time.Now(), infos[id]); err != nil {
+			t.Fatalf("AddDeviceInfo failed: %v", err)
+		}
+	}
+
+	router := gin.New()
+	router.GET("/api/v1/devices", ListOnlineDevices(store, od))
+	list := func(query string) (int, []string) {
+		res := types.ListDevicesResponse{}
+		if code := getJSON(t, router, "/api/v1/devices?"+query, &res); code != http.StatusOK {
+			t.Fatalf("expect 200 of query %q, got %v", query, code)
+		}
+		ids := make([]string, 0, len(res.Devices))
+		for _, device := range res.Devices {
+			ids = append(ids, device.NodeId)
+		}
+		return res.Total, ids
+	}
+
+	cases := []struct {
+		query string
+		total int
+		ids   []string
+	}{
+		{"", 4, []string{"node1", "node2", "node3", "node4"}},
+		{"page_size=3", 4, []string{"node1", "node2", "node3"}},
+		{"page=2&page_size=3", 4, []string{"node4"}},
+		{"page=3&page_size=3", 4, []string{}},
+		{"project=DecentralGPT", 2, []string{"node1", "node2"}},
+		{"model=Qwen2-72B", 2, []string{"node1", "node3"}},
+		{"gpu_name=NVIDIA+RTX+A5000&project=SuperImageAI", 1, []string{"node3"}},
+		{"model=Qwen2-72B&page=2&page_size=1", 2, []string{"node3"}},
+	}
+	for _, c := range cases {
+		total, ids := list(c.query)
+		if total != c.total || len(ids) != len(c.ids) {
+			t.Fatalf("expect %v of %v devices of query %q, got %v of %v", c.ids, c.total, c.query, ids, total)
+		}
+		for i := range ids {
+			if ids[i] != c.ids[i] {
+				t.Fatalf("expect %v of query %q, got %v", c.ids, c.query, ids)
+			}
+		}
+	}
+
+	// The local device takes the info of the registry, the remote ones the latest sample
+	res := types.ListDevicesResponse{}
+	getJSON(t, router, "/api/v1/devices", &res)
+	if res.Devices[0].UtilizationGPU != 10 || res.Devices[1].UtilizationGPU != 20 || res.Devices[3].InfoTime != nil {
+		t.Fatalf("unexpected device status: %+v", res.Devices)
+	}
+
+	for _, query := range []string{"page=0", "page=a", "page_size=0", "page_size=101"} {
+		if code := getJSON(t, router, "/api/v1/devices?"+query, nil); code != http.StatusBadRequest {
+			t.Fatalf("expect 400 of query %q, got %v", query, code)
+		}
+	}
+}
+
+// go test -v -timeout 30s -count=1 -run TestGetDeviceMetrics health-monitoring/http
+func TestGetDeviceMetrics(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := db.NewMemoryDB(time.Hour, "test")
+	base := time.Now().Add(-10 * time.Minute).Truncate(time.Minute)
+	for _, sample := range []struct {
+		offset      time.Duration
+		utilization int
+	}{
+		{10 * time.Second, 20},
+		{20 * time.Second, 40},
+		{70 * time.Second, 60},
+	} {
+		if err := store.AddDeviceInfo(context.Background(), "node1", base.Add(sample.offset), types.WsMachineInfoRequest{
+			UtilizationGPU: sample.utilization,
+		}); err != nil {
+			t.Fatalf("AddDeviceInfo failed: %v", err)
+		}
+	}
+
+	router := gin.New()
+	router.GET("/api/v1/devices/:id/metrics", GetDeviceMetrics(store))
+	from := strconv.FormatInt(base.Unix(), 10)
+	to := base.Add(2 * time.Minute).UTC().Format(time.RFC3339)
+
+	res := types.DeviceMetricsResponse{}
+	if code := getJSON(t, router, "/api/v1/devices/node1/metrics?from="+from+"&to="+to+"&step=1m&agg=max", &res); code != http.StatusOK {
+		t.Fatalf("expect 200, got %v", code)
+	}
+	if res.Step != 60 || res.Agg != types.AggMax || !res.From.Equal(base) || len(res.Points) != 2 ||
+		res.Points[0].UtilizationGPU != 40 || res.Points[1].UtilizationGPU != 60 {
+		t.Fatalf("unexpected metrics: %+v", res)
+	}
+
+	// The last hour in buckets of 1m averaged by default
+	res = types.DeviceMetricsResponse{}
+	if code := getJSON(t, router, "/api/v1/devices/node1/metrics", &res); code != http.StatusOK {
+		t.Fatalf("expect 200 with default parameters, got %v", code)
+	}
+	if res.Step != 60 || res.Agg != types.AggAvg || res.To.Sub(res.From) != time.Hour || len(res.Points) != 2 || res.Points[0].UtilizationGPU != 30 {
+		t.Fatalf("unexpected metrics with default parameters: %+v", res)
+	}
+
+	day := "&from=" + strconv.FormatInt(base.Add(-24*time.Hour).Unix(), 10) + "&to=" + from
+	for _, query := range []string{
+		"to=yesterday",
+		"from=" + from + "&to=" + from,
+		"from=" + strconv.FormatInt(base.Add(time.Hour).Unix(), 10) + "&to=" + from,
+		"step=0s",
+		"step=500ms",
+		"step=1500ms",
+		"step=1",
+		"step=1s" + day, // 86400 points
+		"agg=median",
+	} {
+		if code := getJSON(t, router, "/api/v1/devices/node1/metrics?"+query, nil); code != http.StatusBadRequest {
+			t.Fatalf("expect 400 of query %q, got %v", query, code)
+		}
+	}
+	if code := getJSON(t, router, "/api/v1/devices/node1/metrics?step=10s"+day, nil); code != http.StatusOK {
+		t.Fatalf("expect 200 of 8640 points, got %v", code)
+	}
+}
+
+// go test -v -timeout 30s -count=1 -run TestParseTime health-monitoring/http
+func TestParseTime(t *testing.T) {
+	def := time.Unix(1700000000, 0)
+	cases := []struct {
+		s    string
+		want time.Time
+		ok   bool
+	}{
+		{"", def, true},
+		{"1720000000", time.Unix(1720000000, 0), true},
+		{"2024-07-03T09:46:40Z", time.Unix(1720000000, 0), true},
+		{"2024-07-03T17:46:40+08:00", time.Unix(1720000000, 0), true},
+		{"2024-07-03", time.Time{}, false},
+		{"1.5", time.Time{}, false},
+	}
+	for _, c := range cases {
+		tm, err := parseTime(c.s, def)
+		if (err == nil) != c.ok || (c.ok && !tm.Equal(c.want)) {
+			t.Fatalf("parseTime(%q) = %v %v, want %v ok %v", c.s, tm, err, c.want, c.ok)
+		}
+	}
+}
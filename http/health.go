@@ -0,0 +1,113 @@
+package http
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"health-monitoring/db"
+	"health-monitoring/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// Time allowed to ping the database in the readiness check.
+	healthPingTimeout = 2 * time.Second
+
+	// The instance is not ready when the write queue is fuller than the ratio, devices
+	// would wait for the queue otherwise.
+	queueReadyRatio = 0.9
+)
+
+// Health serves the liveness and readiness probes of the service.
+type Health struct {
+	writer       *db.BatchWriter
+	od           *types.OnlineDevices
+	connections  func() int64
+	startTime    time.Time
+	shuttingDown atomic.Bool
+}
+
+// NewHealth creates the probes, the sessions are the devices online on this instance, and
+// connections returns the number of WebSocket connections including the ones not online yet.
+func NewHealth(writer *db.BatchWriter, od *types.OnlineDevices, connections func() int64) *Health {
+	return &Health{
+		writer:      writer,
+		od:          od,
+		connections: connections,
+		startTime:   time.Now(),
+	}
+}
+
+// SetShuttingDown makes the instance not ready, so that the load balancer stops routing
+// new connections to it while it shuts down.
+func (h *Health) SetShuttingDown() {
+	h.shuttingDown.Store(true)
+}
+
+func (h *Health) status() types.HealthResponse {
+	depth, capacity, spoolBytes := h.writer.QueueStatus()
+	queue := &types.WriteQueueHealth{
+		Status:     "ok",
+		Depth:      depth,
+		Capacity:   capacity,
+		SpoolBytes: spoolBytes,
+	}
+	if float64(depth) >= float64(capacity)*queueReadyRatio {
+		queue.Status = "fail"
+	}
+	return types.HealthResponse{
+		Status:       "ok",
+		ShuttingDown: h.shuttingDown.Load(),
+		Uptime:       int64(time.Since(h.startTime).Seconds()),
+		Sessions:     h.od.Count(),
+		Connections:  h.connections(),
+		WriteQueue:   queue,
+	}
+}
+
+// Healthz reports whether the process is alive. It does not depend on the database, so
+// that the instance is not restarted while the database is unavailable.
+func (h *Health) Healthz(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, gin.H{
+		"code":    0,
+		"message": "ok",
+		"data":    h.status(),
+	})
+}
+
+// Readyz reports whether the instance can accept devices: it is not shutting down, the
+// database can be pinged and the write queue is not nearly full.
+func (h *Health) Readyz(ctx *gin.Context) {
+	res := h.status()
+
+	ctx1, cancel := context.WithTimeout(ctx.Request.Context(), healthPingTimeout)
+	defer cancel()
+	start := time.Now()
+	err := h.writer.Ping(ctx1)
+	res.Database = &types.DatabaseHealth{
+		Status:  "ok",
+		Latency: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		res.Database.Status = "fail"
+		res.Database.Error = err.Error()
+	}
+
+	if res.ShuttingDown || err != nil || res.WriteQueue.Status != "ok" {
+		res.Status = "fail"
+		ctx.JSON(http.StatusServiceUnavailable, gin.H{
+			"code":    types.ErrCodeUnavailable,
+			"message": "not ready",
+			"data":    res,
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"code":    0,
+		"message": "ok",
+		"data":    res,
+	})
+}
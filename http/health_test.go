@@ -0,0 +1,52 @@
+package http
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"health-monitoring/db"
+	"health-monitoring/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// go test -v -timeout 30s -count=1 -run TestHealth health-monitoring/http
+func TestHealth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	writer := db.NewBatchWriter(db.NewMemoryDB(0, "test"), 0, 0, 0, nil)
+	defer writer.Disconnect(context.Background())
+	od := types.NewOnlineDevices()
+	od.SetDevice(types.OnlineDevice{NodeId: "node1", Session: "session1"})
+	health := NewHealth(writer, od, func() int64 { return 3 })
+
+	router := gin.New()
+	router.GET("/healthz", health.Healthz)
+	router.GET("/readyz", health.Readyz)
+	get := func(path string) int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Code
+	}
+
+	if code := get("/healthz"); code != http.StatusOK {
+		t.Fatalf("expect healthz 200, got %v", code)
+	}
+	// Only the device online counts as a session, the connections not online yet do not
+	res := types.HealthResponse{}
+	if code := getJSON(t, router, "/healthz", &res); code != http.StatusOK || res.Sessions != 1 || res.Connections != 3 {
+		t.Fatalf("expect 1 session of 3 connections, got %v %+v", code, res)
+	}
+	if code := get("/readyz"); code != http.StatusOK {
+		t.Fatalf("expect readyz 200, got %v", code)
+	}
+
+	health.SetShuttingDown()
+	if code := get("/readyz"); code != http.StatusServiceUnavailable {
+		t.Fatalf("expect readyz 503 when shutting down, got %v", code)
+	}
+	if code := get("/healthz"); code != http.StatusOK {
+		t.Fatalf("expect healthz 200 when shutting down, got %v", code)
+	}
+}
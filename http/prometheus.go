@@ -1,23 +1,137 @@
 package http
 
 import (
-	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
 
 	"health-monitoring/types"
 
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // https://pkg.go.dev/github.com/prometheus/client_golang@v1.20.2/prometheus
 
+// deviceLabels are the labels of the info metrics of one device.
+type deviceLabels struct {
+	project string
+	gpuName string
+	models  []string
+	gpus    []string // 每块 GPU 的序号，是 GPU 指标的 gpu 标签
+}
+
+// gpuMetrics are the metrics of each GPU reported since version 1 of the machine info,
+// labeled with the index of the GPU.
+var gpuMetrics = []struct {
+	name  string
+	help  string
+	value func(gpu types.GPUInfo) float64
+}{
+	{"gpu_utilization", "utilization of the GPU", func(gpu types.GPUInfo) float64 { return float64(gpu.UtilizationGPU) }},
+	{"gpu_memory_total", "total memory of the GPU", func(gpu types.GPUInfo) float64 { return float64(gpu.MemoryTotal) }},
+	{"gpu_memory_used", "used memory of the GPU", func(gpu types.GPUInfo) float64 { return float64(gpu.MemoryUsed) }},
+	{"gpu_temperature_celsius", "temperature of the GPU", func(gpu types.GPUInfo) float64 { return float64(gpu.Temperature) }},
+	{"gpu_power_draw_watts", "power draw of the GPU", func(gpu types.GPUInfo) float64 { return gpu.PowerDraw }},
+	{"gpu_fan_speed_percent", "fan speed of the GPU", func(gpu types.GPUInfo) float64 { return float64(gpu.FanSpeed) }},
+	{"gpu_clock_sm_mhz", "SM clock of the GPU", func(gpu types.GPUInfo) float64 { return float64(gpu.ClockSM) }},
+	{"gpu_clock_memory_mhz", "memory clock of the GPU", func(gpu types.GPUInfo) float64 { return float64(gpu.ClockMemory) }},
+}
+
+// hostMetrics are the metrics of the host reported in the host metrics request.
+var hostMetrics = []struct {
+	name  string
+	help  string
+	value func(host types.WsHostMetricsRequest) float64
+}{
+	{"host_cpu_utilization", "utilization of the CPU in percent", func(host types.WsHostMetricsRequest) float64 { return host.CPUUtilization }},
+	{"host_cpu_cores", "number of the CPU cores", func(host types.WsHostMetricsRequest) float64 { return float64(host.CPUCores) }},
+	{"host_load1", "load average of 1 minute", func(host types.WsHostMetricsRequest) float64 { return host.Load1 }},
+	{"host_load5", "load average of 5 minutes", func(host types.WsHostMetricsRequest) float64 { return host.Load5 }},
+	{"host_load15", "load average of 15 minutes", func(host types.WsHostMetricsRequest) float64 { return host.Load15 }},
+	{"host_memory_total_bytes", "total memory of the host", func(host types.WsHostMetricsRequest) float64 { return float64(host.MemoryTotal) }},
+	{"host_memory_used_bytes", "used memory of the host", func(host types.WsHostMetricsRequest) float64 { return float64(host.MemoryUsed) }},
+	{"host_uptime_seconds", "uptime of the host", func(host types.WsHostMetricsRequest) float64 { return float64(host.Uptime) }},
+}
+
+// modelMetrics are the serving stats of each model reported in the model metrics request,
+// labeled with the project and the model.
+var modelMetrics = []struct {
+	name  string
+	help  string
+	value func(model types.ModelServingMetrics) float64
+}{
+	{"model_requests_per_second", "requests served per second by the model", func(model types.ModelServingMetrics) float64 { return model.RequestsPerSecond }},
+	{"model_prompt_tokens_per_second", "prompt tokens processed per second by the model", func(model types.ModelServingMetrics) float64 { return model.PromptTokensPerSecond }},
+	{"model_completion_tokens_per_second", "completion tokens generated per second by the model", func(model types.ModelServingMetrics) float64 { return model.CompletionTokensPerSecond }},
+	{"model_queue_depth", "requests waiting in the queue of the model", func(model types.ModelServingMetrics) float64 { return float64(model.QueueDepth) }},
+	{"model_context_length", "maximum context length of the model", func(model types.ModelServingMetrics) float64 { return float64(model.ContextLength) }},
+}
+
+// quantiles are the values of the quantile label of the latency metrics of models.
+var quantiles = []struct {
+	label string
+	value func(p types.Percentiles) float64
+}{
+	{"0.5", func(p types.Percentiles) float64 { return p.P50 }},
+	{"0.9", func(p types.Percentiles) float64 { return p.P90 }},
+	{"0.99", func(p types.Percentiles) float64 { return p.P99 }},
+}
+
+// modelLabels are the labels of the metrics of one model.
+type modelLabels struct {
+	project string
+	model   string
+}
+
+// hostLabels are the mount points and the network interfaces of one host.
+type hostLabels struct {
+	mounts     []string
+	interfaces []string
+}
+
+// gpuNames returns the gpu labels of the GPUs.
+func gpuNames(gpus []types.GPUInfo) []string {
+	names := make([]string, 0, len(gpus))
+	for _, gpu := range gpus {
+		names = append(names, strconv.Itoa(gpu.Index))
+	}
+	return names
+}
+
 type PrometheusMetrics struct {
 	jobName             string
 	reg                 *prometheus.Registry
 	utilizationGPUGauge *prometheus.GaugeVec
 	memoryTotalGauge    *prometheus.GaugeVec
 	memoryUsedGauge     *prometheus.GaugeVec
+	deviceInfoGauge     *prometheus.GaugeVec
+	modelLoadedGauge    *prometheus.GaugeVec
+	gpuGauges           []*prometheus.GaugeVec // 与 gpuMetrics 一一对应
+	hostGauges          []*prometheus.GaugeVec // 与 hostMetrics 一一对应
+	diskTotalGauge      *prometheus.GaugeVec
+	diskUsedGauge       *prometheus.GaugeVec
+	networkRxGauge      *prometheus.GaugeVec
+	networkTxGauge      *prometheus.GaugeVec
+	modelGauges         []*prometheus.GaugeVec // 与 modelMetrics 一一对应
+	ttftGauge           *prometheus.GaugeVec
+	latencyGauge        *prometheus.GaugeVec
+	modelErrors         *prometheus.CounterVec
+	labels              map[string]deviceLabels  // 每个设备当前设置的 device_info 和 device_model_loaded 标签
+	hostLabels          map[string]hostLabels    // 每个主机当前设置的磁盘和网卡标签
+	modelLabels         map[string][]modelLabels // 每个设备当前设置的模型指标标签
+	labelsMutex         *sync.Mutex
+
+	// 服务自身的指标
+	connectionsOpened prometheus.Counter
+	connectionsClosed prometheus.Counter
+	messagesTotal     *prometheus.CounterVec
+	handlerDuration   *prometheus.HistogramVec
+	parseFailures     *prometheus.CounterVec
+	pingsTotal        prometheus.Counter
 }
 
 func NewPrometheusMetrics(jobName string) *PrometheusMetrics {
@@ -45,13 +159,166 @@ func NewPrometheusMetrics(jobName string) *PrometheusMetrics {
 			},
 			[]string{"job", "instance"},
 		),
+		deviceInfoGauge: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "device_info",
+				Help: "information of the device, always 1",
+			},
+			[]string{"job", "instance", "project", "gpu_name"},
+		),
+		modelLoadedGauge: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "device_model_loaded",
+				Help: "models served by the device, always 1",
+			},
+			[]string{"job", "instance", "model"},
+		),
+		diskTotalGauge: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "host_disk_total_bytes",
+				Help: "total size of the disk mounted on the host",
+			},
+			[]string{"job", "instance", "mount"},
+		),
+		diskUsedGauge: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "host_disk_used_bytes",
+				Help: "used size of the disk mounted on the host",
+			},
+			[]string{"job", "instance", "mount"},
+		),
+		networkRxGauge: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "host_network_receive_bytes_per_second",
+				Help: "bytes received per second by the network interface of the host",
+			},
+			[]string{"job", "instance", "interface"},
+		),
+		networkTxGauge: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "host_network_transmit_bytes_per_second",
+				Help: "bytes transmitted per second by the network interface of the host",
+			},
+			[]string{"job", "instance", "interface"},
+		),
+		ttftGauge: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "model_time_to_first_token_seconds",
+				Help: "percentiles of the time to the first token of the model",
+			},
+			[]string{"job", "instance", "project", "model", "quantile"},
+		),
+		latencyGauge: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "model_request_latency_seconds",
+				Help: "percentiles of the end to end latency of the requests of the model",
+			},
+			[]string{"job", "instance", "project", "model", "quantile"},
+		),
+		modelErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "model_errors_total",
+				Help: "number of failed requests of the model",
+			},
+			[]string{"job", "instance", "project", "model"},
+		),
+		labels:      make(map[string]deviceLabels),
+		hostLabels:  make(map[string]hostLabels),
+		modelLabels: make(map[string][]modelLabels),
+		labelsMutex: &sync.Mutex{},
+		connectionsOpened: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ws_connections_opened_total",
+			Help: "number of websocket connections opened",
+		}),
+		connectionsClosed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ws_connections_closed_total",
+			Help: "number of websocket connections closed",
+		}),
+		messagesTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "ws_messages_total",
+				Help: "number of websocket responses by message type and result code",
+			},
+			[]string{"type", "code"},
+		),
+		handlerDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "ws_handler_duration_seconds",
+				Help:    "duration of handling websocket requests by message type",
+				Buckets: prometheus.DefBuckets,
+			},
+			[]string{"type"},
+		),
+		parseFailures: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "ws_parse_failures_total",
+				Help: "number of websocket messages failed to parse by message type",
+			},
+			[]string{"type"},
+		),
+		pingsTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ws_pings_total",
+			Help: "number of websocket pings received",
+		}),
 	}
 	pm.reg.MustRegister(pm.utilizationGPUGauge)
 	pm.reg.MustRegister(pm.memoryTotalGauge)
 	pm.reg.MustRegister(pm.memoryUsedGauge)
+	pm.reg.MustRegister(pm.deviceInfoGauge)
+	pm.reg.MustRegister(pm.modelLoadedGauge)
+	for _, metric := range gpuMetrics {
+		gauge := prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: metric.name,
+				Help: metric.help,
+			},
+			[]string{"job", "instance", "gpu"},
+		)
+		pm.gpuGauges = append(pm.gpuGauges, gauge)
+		pm.reg.MustRegister(gauge)
+	}
+	for _, metric := range hostMetrics {
+		gauge := prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: metric.name,
+				Help: metric.help,
+			},
+			[]string{"job", "instance"},
+		)
+		pm.hostGauges = append(pm.hostGauges, gauge)
+		pm.reg.MustRegister(gauge)
+	}
+	pm.reg.MustRegister(pm.diskTotalGauge, pm.diskUsedGauge, pm.networkRxGauge, pm.networkTxGauge)
+	for _, metric := range modelMetrics {
+		gauge := prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: metric.name,
+				Help: metric.help,
+			},
+			[]string{"job", "instance", "project", "model"},
+		)
+		pm.modelGauges = append(pm.modelGauges, gauge)
+		pm.reg.MustRegister(gauge)
+	}
+	pm.reg.MustRegister(pm.ttftGauge, pm.latencyGauge, pm.modelErrors)
+	pm.reg.MustRegister(
+		pm.connectionsOpened,
+		pm.connectionsClosed,
+		pm.messagesTotal,
+		pm.handlerDuration,
+		pm.parseFailures,
+		pm.pingsTotal,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
 	return pm
 }
 
+// MustRegister adds the metrics of the other components to the registry.
+func (pm PrometheusMetrics) MustRegister(cs ...prometheus.Collector) {
+	pm.reg.MustRegister(cs...)
+}
+
 func (pm PrometheusMetrics) SetMetrics(id string, info types.WsMachineInfoRequest) {
 	if pm.jobName == "" {
 		return
@@ -59,6 +326,36 @@ func (pm PrometheusMetrics) SetMetrics(id string, info types.WsMachineInfoReques
 	pm.utilizationGPUGauge.WithLabelValues(pm.jobName, id).Set(float64(info.UtilizationGPU))
 	pm.memoryTotalGauge.WithLabelValues(pm.jobName, id).Set(float64(info.MemoryTotal))
 	pm.memoryUsedGauge.WithLabelValues(pm.jobName, id).Set(float64(info.MemoryUsed))
+
+	labels := deviceLabels{project: info.Project, gpuName: info.GPUName, models: modelNames(info.Models), gpus: gpuNames(info.GPUs)}
+	pm.labelsMutex.Lock()
+	defer pm.labelsMutex.Unlock()
+	old, ok := pm.labels[id]
+	if ok && (old.project != labels.project || old.gpuName != labels.gpuName) {
+		pm.deviceInfoGauge.DeleteLabelValues(pm.jobName, id, old.project, old.gpuName)
+	}
+	pm.deviceInfoGauge.WithLabelValues(pm.jobName, id, labels.project, labels.gpuName).Set(1)
+	// The models no longer served are removed, so that they do not stay loaded forever
+	for _, model := range old.models {
+		if !slices.Contains(labels.models, model) {
+			pm.modelLoadedGauge.DeleteLabelValues(pm.jobName, id, model)
+		}
+	}
+	for _, model := range labels.models {
+		pm.modelLoadedGauge.WithLabelValues(pm.jobName, id, model).Set(1)
+	}
+	// So are the GPUs no longer reported
+	for _, gpu := range old.gpus {
+		if !slices.Contains(labels.gpus, gpu) {
+			pm.deleteGPU(id, gpu)
+		}
+	}
+	for i, gpu := range info.GPUs {
+		for j, metric := range gpuMetrics {
+			pm.gpuGauges[j].WithLabelValues(pm.jobName, id, labels.gpus[i]).Set(metric.value(gpu))
+		}
+	}
+	pm.labels[id] = labels
 }
 
 func (pm PrometheusMetrics) DeleteMetrics(id string) {
@@ -68,14 +365,174 @@ func (pm PrometheusMetrics) DeleteMetrics(id string) {
 	pm.utilizationGPUGauge.DeleteLabelValues(pm.jobName, id)
 	pm.memoryTotalGauge.DeleteLabelValues(pm.jobName, id)
 	pm.memoryUsedGauge.DeleteLabelValues(pm.jobName, id)
+
+	pm.labelsMutex.Lock()
+	defer pm.labelsMutex.Unlock()
+	if old, ok := pm.labels[id]; ok {
+		pm.deviceInfoGauge.DeleteLabelValues(pm.jobName, id, old.project, old.gpuName)
+		for _, model := range old.models {
+			pm.modelLoadedGauge.DeleteLabelValues(pm.jobName, id, model)
+		}
+		for _, gpu := range old.gpus {
+			pm.deleteGPU(id, gpu)
+		}
+		delete(pm.labels, id)
+	}
+	for _, gauge := range pm.hostGauges {
+		gauge.DeleteLabelValues(pm.jobName, id)
+	}
+	if old, ok := pm.hostLabels[id]; ok {
+		for _, mount := range old.mounts {
+			pm.diskTotalGauge.DeleteLabelValues(pm.jobName, id, mount)
+			pm.diskUsedGauge.DeleteLabelValues(pm.jobName, id, mount)
+		}
+		for _, iface := range old.interfaces {
+			pm.networkRxGauge.DeleteLabelValues(pm.jobName, id, iface)
+			pm.networkTxGauge.DeleteLabelValues(pm.jobName, id, iface)
+		}
+		delete(pm.hostLabels, id)
+	}
+	for _, old := range pm.modelLabels[id] {
+		pm.deleteModel(id, old)
+	}
+	delete(pm.modelLabels, id)
 }
 
-func (pm PrometheusMetrics) Metrics(ctx *gin.Context) {
-	w, r := ctx.Writer, ctx.Request
+// SetModelMetrics sets the serving metrics of the models of the device, the models no
+// longer reported are removed. The errors are added to the counter.
+func (pm PrometheusMetrics) SetModelMetrics(id string, metrics types.WsModelMetricsRequest) {
+	if pm.jobName == "" {
+		return
+	}
+	labels := make([]modelLabels, 0, len(metrics.Models))
+	for _, model := range metrics.Models {
+		labels = append(labels, modelLabels{project: metrics.Project, model: model.Model})
+	}
+	pm.labelsMutex.Lock()
+	defer pm.labelsMutex.Unlock()
+	for _, old := range pm.modelLabels[id] {
+		if !slices.Contains(labels, old) {
+			pm.deleteModel(id, old)
+		}
+	}
+	for _, model := range metrics.Models {
+		for i, metric := range modelMetrics {
+			pm.modelGauges[i].WithLabelValues(pm.jobName, id, metrics.Project, model.Model).Set(metric.value(model))
+		}
+		// The latencies are reported in milliseconds
+		for _, q := range quantiles {
+			pm.ttftGauge.WithLabelValues(pm.jobName, id, metrics.Project, model.Model, q.label).Set(q.value(model.TimeToFirstToken) / 1000)
+			pm.latencyGauge.WithLabelValues(pm.jobName, id, metrics.Project, model.Model, q.label).Set(q.value(model.Latency) / 1000)
+		}
+		pm.modelErrors.WithLabelValues(pm.jobName, id, metrics.Project, model.Model).Add(float64(model.Errors))
+	}
+	pm.modelLabels[id] = labels
+}
+
+func (pm PrometheusMetrics) deleteModel(id string, labels modelLabels) {
+	for _, gauge := range pm.modelGauges {
+		gauge.DeleteLabelValues(pm.jobName, id, labels.project, labels.model)
+	}
+	for _, q := range quantiles {
+		pm.ttftGauge.DeleteLabelValues(pm.jobName, id, labels.project, labels.model, q.label)
+		pm.latencyGauge.DeleteLabelValues(pm.jobName, id, labels.project, labels.model, q.label)
+	}
+	pm.modelErrors.DeleteLabelValues(pm.jobName, id, labels.project, labels.model)
+}
+
+// SetHostMetrics sets the metrics of the host of the device, the disks and the network
+// interfaces no longer reported are removed.
+func (pm PrometheusMetrics) SetHostMetrics(id string, host types.WsHostMetricsRequest) {
 	if pm.jobName == "" {
-		ctx.String(http.StatusInternalServerError, "job name is empty")
 		return
 	}
+	for i, metric := range hostMetrics {
+		pm.hostGauges[i].WithLabelValues(pm.jobName, id).Set(metric.value(host))
+	}
+
+	labels := hostLabels{}
+	for _, disk := range host.Disks {
+		labels.mounts = append(labels.mounts, disk.Mount)
+	}
+	for _, network := range host.Networks {
+		labels.interfaces = append(labels.interfaces, network.Interface)
+	}
+	pm.labelsMutex.Lock()
+	defer pm.labelsMutex.Unlock()
+	old := pm.hostLabels[id]
+	for _, mount := range old.mounts {
+		if !slices.Contains(labels.mounts, mount) {
+			pm.diskTotalGauge.DeleteLabelValues(pm.jobName, id, mount)
+			pm.diskUsedGauge.DeleteLabelValues(pm.jobName, id, mount)
+		}
+	}
+	for _, iface := range old.interfaces {
+		if !slices.Contains(labels.interfaces, iface) {
+			pm.networkRxGauge.DeleteLabelValues(pm.jobName, id, iface)
+			pm.networkTxGauge.DeleteLabelValues(pm.jobName, id, iface)
+		}
+	}
+	for _, disk := range host.Disks {
+		pm.diskTotalGauge.WithLabelValues(pm.jobName, id, disk.Mount).Set(float64(disk.Total))
+		pm.diskUsedGauge.WithLabelValues(pm.jobName, id, disk.Mount).Set(float64(disk.Used))
+	}
+	for _, network := range host.Networks {
+		pm.networkRxGauge.WithLabelValues(pm.jobName, id, network.Interface).Set(network.RxBytes)
+		pm.networkTxGauge.WithLabelValues(pm.jobName, id, network.Interface).Set(network.TxBytes)
+	}
+	pm.hostLabels[id] = labels
+}
+
+func (pm PrometheusMetrics) deleteGPU(id, gpu string) {
+	for _, gauge := range pm.gpuGauges {
+		gauge.DeleteLabelValues(pm.jobName, id, gpu)
+	}
+}
+
+// modelNames returns the sorted names of the models without duplicates and empty names.
+func modelNames(models []types.ModelInfo) []string {
+	names := make([]string, 0, len(models))
+	for _, model := range models {
+		if model.Model != "" {
+			names = append(names, model.Model)
+		}
+	}
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+func (pm PrometheusMetrics) ConnectionOpened() {
+	pm.connectionsOpened.Inc()
+}
+
+func (pm PrometheusMetrics) ConnectionClosed() {
+	pm.connectionsClosed.Inc()
+}
+
+// ObserveResponse counts the response sent to the device.
+func (pm PrometheusMetrics) ObserveResponse(mt types.WsMessageType, code uint32) {
+	pm.messagesTotal.WithLabelValues(mt.String(), strconv.FormatUint(uint64(code), 10)).Inc()
+}
+
+// ObserveHandler records how long the request took to handle.
+func (pm PrometheusMetrics) ObserveHandler(mt types.WsMessageType, d time.Duration) {
+	pm.handlerDuration.WithLabelValues(mt.String()).Observe(d.Seconds())
+}
+
+// ParseFailed counts the message which could not be parsed, mt is 0 if the request itself
+// could not be parsed.
+func (pm PrometheusMetrics) ParseFailed(mt types.WsMessageType) {
+	pm.parseFailures.WithLabelValues(mt.String()).Inc()
+}
+
+func (pm PrometheusMetrics) PingReceived() {
+	pm.pingsTotal.Inc()
+}
+
+// Metrics serves all the metrics, the metrics of devices are only set when the job name
+// is configured.
+func (pm PrometheusMetrics) Metrics(ctx *gin.Context) {
+	w, r := ctx.Writer, ctx.Request
 
 	// pm.utilizationGPUGauge.WithLabelValues("test", "machine1").Set(30)
 	// pm.memoryTotalGauge.WithLabelValues("test", "machine1").Set(24564)
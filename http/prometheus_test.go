@@ -5,7 +5,10 @@ import (
 	"testing"
 	"time"
 
+	"health-monitoring/types"
+
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/prometheus/common/expfmt"
 )
 
@@ -124,3 +127,192 @@ func TestPrometheusTimestamp(t *testing.T) {
 	// }
 	// t.Logf("MetricFamilyToText %v bytes\n%v", written, buf.String())
 }
+
+// go test -v -timeout 30s -count=1 -run TestPrometheusSelfMetrics health-monitoring/http
+func TestPrometheusSelfMetrics(t *testing.T) {
+	pm := NewPrometheusMetrics("")
+	pm.ConnectionOpened()
+	pm.ObserveResponse(types.WsMtMachineInfo, 0)
+	pm.ObserveResponse(types.WsMessageType(100), uint32(types.ErrCodeParam))
+	pm.ObserveHandler(types.WsMtOnline, 10*time.Millisecond)
+
+	metricsFamilies, err := pm.reg.Gather()
+	if err != nil {
+		t.Fatalf("gather metrics failed: %v", err)
+	}
+	names := make(map[string]bool)
+	for _, mf := range metricsFamilies {
+		names[mf.GetName()] = true
+	}
+	for _, name := range []string{
+		"ws_connections_opened_total",
+		"ws_messages_total",
+		"ws_handler_duration_seconds",
+		"go_goroutines",
+		"process_cpu_seconds_total",
+	} {
+		if !names[name] {
+			t.Errorf("metric %v is not registered", name)
+		}
+	}
+	if v := testutil.ToFloat64(pm.messagesTotal.WithLabelValues("unknown", "1")); v != 1 {
+		t.Errorf("expect unknown message type counted once, got %v", v)
+	}
+}
+
+// go test -v -timeout 30s -count=1 -run TestPrometheusDeviceLabels health-monitoring/http
+func TestPrometheusDeviceLabels(t *testing.T) {
+	pm := NewPrometheusMetrics("test")
+	pm.SetMetrics("node1", types.WsMachineInfoRequest{
+		Project: "DecentralGPT",
+		GPUName: "NVIDIA GeForce RTX 4090",
+		Models:  []types.ModelInfo{{Model: "Llama3-70B"}, {Model: "Qwen2-72B"}},
+	})
+	if v := testutil.ToFloat64(pm.deviceInfoGauge.WithLabelValues("test", "node1", "DecentralGPT", "NVIDIA GeForce RTX 4090")); v != 1 {
+		t.Fatalf("expect device_info 1, got %v", v)
+	}
+	if n := testutil.CollectAndCount(pm.modelLoadedGauge); n != 2 {
+		t.Fatalf("expect 2 models loaded, got %v", n)
+	}
+
+	// The model and the project changed
+	pm.SetMetrics("node1", types.WsMachineInfoRequest{
+		Project: "Other",
+		GPUName: "NVIDIA GeForce RTX 4090",
+		Models:  []types.ModelInfo{{Model: "Llama3-70B"}, {Model: "Codestral-22B-v0.1"}},
+	})
+	if n := testutil.CollectAndCount(pm.deviceInfoGauge); n != 1 {
+		t.Fatalf("expect the old device_info deleted, got %v series", n)
+	}
+	if pm.modelLoadedGauge.DeleteLabelValues("test", "node1", "Qwen2-72B") {
+		t.Fatal("expect the unloaded model deleted")
+	}
+	if n := testutil.CollectAndCount(pm.modelLoadedGauge); n != 2 {
+		t.Fatalf("expect 2 models loaded, got %v", n)
+	}
+
+	pm.DeleteMetrics("node1")
+	if n := testutil.CollectAndCount(pm.deviceInfoGauge) + testutil.CollectAndCount(pm.modelLoadedGauge); n != 0 {
+		t.Fatalf("expect the info metrics deleted with the device, got %v series", n)
+	}
+}
+
+// go test -v -timeout 30s -count=1 -run TestPrometheusGPUMetrics health-monitoring/http
+func TestPrometheusGPUMetrics(t *testing.T) {
+	pm := NewPrometheusMetrics("test")
+	pm.SetMetrics("node1", types.WsMachineInfoRequest{
+		GPUs: []types.GPUInfo{
+			{Index: 0, UtilizationGPU: 30, Temperature: 60, PowerDraw: 250.5},
+			{Index: 1, UtilizationGPU: 50, Temperature: 70, PowerDraw: 300},
+		},
+	})
+	if v := testutil.ToFloat64(pm.gpuGauges[0].WithLabelValues("test", "node1", "1")); v != 50 {
+		t.Fatalf("expect gpu_utilization 50 of GPU 1, got %v", v)
+	}
+	if n := testutil.CollectAndCount(pm.gpuGauges[3]); n != 2 {
+		t.Fatalf("expect temperature of 2 GPUs, got %v", n)
+	}
+
+	// GPU 1 is no longer reported
+	pm.SetMetrics("node1", types.WsMachineInfoRequest{
+		GPUs: []types.GPUInfo{{Index: 0, UtilizationGPU: 40}},
+	})
+	for i, gauge := range pm.gpuGauges {
+		if n := testutil.CollectAndCount(gauge); n != 1 {
+			t.Fatalf("expect %v of GPU 1 deleted, got %v series", gpuMetrics[i].name, n)
+		}
+	}
+
+	pm.DeleteMetrics("node1")
+	for i, gauge := range pm.gpuGauges {
+		if n := testutil.CollectAndCount(gauge); n != 0 {
+			t.Fatalf("expect %v deleted with the device, got %v series", gpuMetrics[i].name, n)
+		}
+	}
+}
+
+// go test -v -timeout 30s -count=1 -run TestPrometheusHostMetrics health-monitoring/http
+func TestPrometheusHostMetrics(t *testing.T) {
+	pm := NewPrometheusMetrics("test")
+	pm.SetHostMetrics("node1", types.WsHostMetricsRequest{
+		CPUUtilization: 35.5,
+		Load1:          2,
+		Disks:          []types.DiskUsage{{Mount: "/", Total: 100, Used: 40}, {Mount: "/data", Total: 200, Used: 20}},
+		Networks:       []types.NetworkIO{{Interface: "eth0", RxBytes: 1024, TxBytes: 512}},
+	})
+	if v := testutil.ToFloat64(pm.hostGauges[0].WithLabelValues("test", "node1")); v != 35.5 {
+		t.Fatalf("expect host_cpu_utilization 35.5, got %v", v)
+	}
+	if v := testutil.ToFloat64(pm.diskUsedGauge.WithLabelValues("test", "node1", "/data")); v != 20 {
+		t.Fatalf("expect used size of /data 20, got %v", v)
+	}
+	if v := testutil.ToFloat64(pm.networkRxGauge.WithLabelValues("test", "node1", "eth0")); v != 1024 {
+		t.Fatalf("expect eth0 receiving 1024 bytes per second, got %v", v)
+	}
+
+	// /data is unmounted
+	pm.SetHostMetrics("node1", types.WsHostMetricsRequest{
+		Disks: []types.DiskUsage{{Mount: "/", Total: 100, Used: 50}},
+	})
+	if n := testutil.CollectAndCount(pm.diskTotalGauge) + testutil.CollectAndCount(pm.diskUsedGauge); n != 2 {
+		t.Fatalf("expect the disk metrics of /data deleted, got %v series", n)
+	}
+	if n := testutil.CollectAndCount(pm.networkRxGauge) + testutil.CollectAndCount(pm.networkTxGauge); n != 0 {
+		t.Fatalf("expect the network metrics of eth0 deleted, got %v series", n)
+	}
+
+	pm.DeleteMetrics("node1")
+	for i, gauge := range pm.hostGauges {
+		if n := testutil.CollectAndCount(gauge); n != 0 {
+			t.Fatalf("expect %v deleted with the device, got %v series", hostMetrics[i].name, n)
+		}
+	}
+	if n := testutil.CollectAndCount(pm.diskTotalGauge) + testutil.CollectAndCount(pm.diskUsedGauge); n != 0 {
+		t.Fatalf("expect the disk metrics deleted with the device, got %v series", n)
+	}
+}
+
+// go test -v -timeout 30s -count=1 -run TestPrometheusModelMetrics health-monitoring/http
+func TestPrometheusModelMetrics(t *testing.T) {
+	pm := NewPrometheusMetrics("test")
+	pm.SetModelMetrics("node1", types.WsModelMetricsRequest{
+		Project: "DecentralGPT",
+		Models: []types.ModelServingMetrics{
+			{Model: "Llama3-70B", RequestsPerSecond: 2.5, TimeToFirstToken: types.Percentiles{P50: 200, P90: 400, P99: 900}, Errors: 2},
+			{Model: "Qwen2-72B", QueueDepth: 4},
+		},
+	})
+	pm.SetModelMetrics("node1", types.WsModelMetricsRequest{
+		Project: "DecentralGPT",
+		Models:  []types.ModelServingMetrics{{Model: "Llama3-70B", RequestsPerSecond: 3, Errors: 1}},
+	})
+	if v := testutil.ToFloat64(pm.modelGauges[0].WithLabelValues("test", "node1", "DecentralGPT", "Llama3-70B")); v != 3 {
+		t.Fatalf("expect model_requests_per_second 3, got %v", v)
+	}
+	if v := testutil.ToFloat64(pm.modelErrors.WithLabelValues("test", "node1", "DecentralGPT", "Llama3-70B")); v != 3 {
+		t.Fatalf("expect the errors of both reports counted, got %v", v)
+	}
+	if n := testutil.CollectAndCount(pm.modelGauges[3]); n != 1 {
+		t.Fatalf("expect the queue depth of the model no longer served deleted, got %v series", n)
+	}
+	if n := testutil.CollectAndCount(pm.ttftGauge); n != len(quantiles) {
+		t.Fatalf("expect %v quantiles of time to first token, got %v", len(quantiles), n)
+	}
+
+	pm.SetModelMetrics("node1", types.WsModelMetricsRequest{
+		Project: "DecentralGPT",
+		Models:  []types.ModelServingMetrics{{Model: "Llama3-70B", TimeToFirstToken: types.Percentiles{P99: 1500}}},
+	})
+	if v := testutil.ToFloat64(pm.ttftGauge.WithLabelValues("test", "node1", "DecentralGPT", "Llama3-70B", "0.99")); v != 1.5 {
+		t.Fatalf("expect p99 time to first token 1.5s, got %v", v)
+	}
+
+	pm.DeleteMetrics("node1")
+	n := testutil.CollectAndCount(pm.ttftGauge) + testutil.CollectAndCount(pm.latencyGauge) + testutil.CollectAndCount(pm.modelErrors)
+	for _, gauge := range pm.modelGauges {
+		n += testutil.CollectAndCount(gauge)
+	}
+	if n != 0 {
+		t.Fatalf("expect the model metrics deleted with the device, got %v series", n)
+	}
+}
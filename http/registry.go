@@ -0,0 +1,111 @@
+package http
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"time"
+
+	"health-monitoring/db"
+	"health-monitoring/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AdminAuth only lets requests with the bearer token of the administrator through.
+func AdminAuth(token string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		auth := ctx.GetHeader("Authorization")
+		if token == "" || subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+token)) != 1 {
+			ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"code":    types.ErrCodeAuth,
+				"message": "unauthorized",
+			})
+			return
+		}
+		ctx.Next()
+	}
+}
+
+func RegisterDevice(store db.Store) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		req := types.RegisterDeviceRequest{}
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"code":    types.ErrCodeParam,
+				"message": "parse register device request failed: " + err.Error(),
+			})
+			return
+		}
+		if len(req.PubKey) != 0 && len(req.PubKey) != ed25519.PublicKeySize {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"code":    types.ErrCodeParam,
+				"message": types.ErrInvalidPubKey.Error(),
+			})
+			return
+		}
+
+		ctx1, cancel := context.WithTimeout(ctx.Request.Context(), 5*time.Second)
+		defer cancel()
+		if err := store.RegisterDevice(ctx1, types.MDBDeviceRegistry{
+			DeviceId: req.DeviceId,
+			PubKey:   req.PubKey,
+			Project:  req.Project,
+			Owner:    req.Owner,
+		}); err != nil {
+			databaseError(ctx, err, "register device failed")
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{
+			"code":    0,
+			"message": "ok",
+		})
+	}
+}
+
+// RevokeDevice revokes the device in the registry and kicks its session if it is online
+// on this instance, the sessions on other instances are refused at their next online.
+func RevokeDevice(store db.Store, od *types.OnlineDevices) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		id := ctx.Param("id")
+		ctx1, cancel := context.WithTimeout(ctx.Request.Context(), 5*time.Second)
+		defer cancel()
+		if err := store.RevokeDevice(ctx1, id); err != nil {
+			if errors.Is(err, db.ErrDeviceNotRegistered) {
+				ctx.JSON(http.StatusNotFound, gin.H{
+					"code":    types.ErrCodeRegistry,
+					"message": err.Error(),
+				})
+				return
+			}
+			databaseError(ctx, err, "revoke device failed")
+			return
+		}
+		if device, ok := od.Get(id); ok && device.Kick != nil {
+			device.Kick("device revoked")
+		}
+		ctx.JSON(http.StatusOK, gin.H{
+			"code":    0,
+			"message": "ok",
+		})
+	}
+}
+
+func ListDevices(store db.Store) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ctx1, cancel := context.WithTimeout(ctx.Request.Context(), 5*time.Second)
+		defer cancel()
+		devices, err := store.ListDevices(ctx1)
+		if err != nil {
+			databaseError(ctx, err, "list devices failed")
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{
+			"code":    0,
+			"message": "ok",
+			"data":    devices,
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"health-monitoring/db"
+	"health-monitoring/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// go test -v -timeout 30s -count=1 -run TestAdminRegistry health-monitoring/http
+func TestAdminRegistry(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := db.NewMemoryDB(time.Hour, "test")
+	od := types.NewOnlineDevices()
+
+	router := gin.New()
+	admin := router.Group("/api/v1/admin", AdminAuth("secret"))
+	admin.GET("/devices", ListDevices(store))
+	admin.POST("/devices", RegisterDevice(store))
+	admin.POST("/devices/:id/revoke", RevokeDevice(store, od))
+	do := func(method, path, token string, body any) (int, types.ErrorCode) {
+		var data []byte
+		if body != nil {
+			data, _ = json.Marshal(body)
+		}
+		req := httptest.NewRequest(method, path, bytes.NewReader(data))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		res := struct {
+			Code types.ErrorCode `json:"code"`
+		}{}
+		json.Unmarshal(w.Body.Bytes(), &res)
+		return w.Code, res.Code
+	}
+
+	for _, token := range []string{"", "wrong"} {
+		if status, code := do(http.MethodGet, "/api/v1/admin/devices", token, nil); status != http.StatusUnauthorized || code != types.ErrCodeAuth {
+			t.Fatalf("expect 401 with ErrCodeAuth of token %q, got %v %v", token, status, code)
+		}
+	}
+
+	if status, code := do(http.MethodPost, "/api/v1/admin/devices", "secret", gin.H{"device_id": "node1", "pub_key": []byte("short")}); status != http.StatusBadRequest || code != types.ErrCodeParam {
+		t.Fatalf("expect 400 of invalid public key, got %v %v", status, code)
+	}
+	if status, code := do(http.MethodPost, "/api/v1/admin/devices", "secret", gin.H{"project": "DecentralGPT"}); status != http.StatusBadRequest || code != types.ErrCodeParam {
+		t.Fatalf("expect 400 without device id, got %v %v", status, code)
+	}
+	pubKey := bytes.Repeat([]byte{1}, ed25519.PublicKeySize)
+	if status, _ := do(http.MethodPost, "/api/v1/admin/devices", "secret", types.RegisterDeviceRequest{DeviceId: "node1", PubKey: pubKey, Project: "DecentralGPT"}); status != http.StatusOK {
+		t.Fatalf("expect 200 registering device, got %v", status)
+	}
+	if err := store.VerifyDevice(context.Background(), "node1", pubKey, false); err != nil {
+		t.Fatalf("expect registered device verified, got %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/admin/devices", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	router.ServeHTTP(w, req)
+	list := struct {
+		Data []types.MDBDeviceRegistry `json:"data"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list.Data) != 1 || list.Data[0].DeviceId != "node1" {
+		t.Fatalf("expect node1 listed, got %s", w.Body.String())
+	}
+
+	// Revoking kicks the live session of the device
+	kicked := ""
+	od.SetDevice(types.OnlineDevice{NodeId: "node1", Session: "session1", Kick: func(reason string) { kicked = reason }})
+	if status, _ := do(http.MethodPost, "/api/v1/admin/devices/node1/revoke", "secret", nil); status != http.StatusOK {
+		t.Fatalf("expect 200 revoking device, got %v", status)
+	}
+	if kicked == "" {
+		t.Fatal("expect the session of the revoked device kicked")
+	}
+	if err := store.VerifyDevice(context.Background(), "node1", pubKey, false); err != db.ErrDeviceRevoked {
+		t.Fatalf("expect ErrDeviceRevoked, got %v", err)
+	}
+	if status, code := do(http.MethodPost, "/api/v1/admin/devices/node2/revoke", "secret", nil); status != http.StatusNotFound || code != types.ErrCodeRegistry {
+		t.Fatalf("expect 404 revoking unknown device, got %v %v", status, code)
+	}
+}
@@ -0,0 +1,307 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"health-monitoring/log"
+	"health-monitoring/types"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// https://prometheus.io/docs/specs/remote_write_spec/
+
+const (
+	defaultRemoteWriteInterval = 15 * time.Second
+
+	// Samples in one request, the rest goes in the next requests of the same round.
+	remoteWriteBatchSize = 2000
+	// Time allowed for one attempt to send a request.
+	remoteWriteTimeout = 10 * time.Second
+	// A request is sent at most the times, with the backoff doubling from the minimum.
+	remoteWriteMaxAttempts = 5
+	remoteWriteMinBackoff  = 500 * time.Millisecond
+	remoteWriteMaxBackoff  = 8 * time.Second
+)
+
+// promLabel and promSeries mirror the Label and TimeSeries messages of prompb, one sample
+// is sent for each series in a round.
+type promLabel struct {
+	name  string
+	value string
+}
+
+type promSeries struct {
+	labels    []promLabel
+	value     float64
+	timestamp int64 // 毫秒
+}
+
+// machineInfoSeries returns the series of the machine info reported by the device, the
+// same metrics as the gauges served by PrometheusMetrics.
+func machineInfoSeries(jobName, id string, tm time.Time, info *types.WsMachineInfoRequest) []promSeries {
+	ts := tm.UnixMilli()
+	gauge := func(name string, value float64, labels ...promLabel) promSeries {
+		return promSeries{
+			labels: append([]promLabel{
+				{name: "__name__", value: name},
+				{name: "instance", value: id},
+				{name: "job", value: jobName},
+			}, labels...),
+			value:     value,
+			timestamp: ts,
+		}
+	}
+	series := []promSeries{
+		gauge("utilization_gpu", float64(info.UtilizationGPU)),
+		gauge("memory_total", float64(info.MemoryTotal)),
+		gauge("memory_used", float64(info.MemoryUsed)),
+		gauge("device_info", 1, promLabel{name: "project", value: info.Project}, promLabel{name: "gpu_name", value: info.GPUName}),
+	}
+	for _, model := range modelNames(info.Models) {
+		series = append(series, gauge("device_model_loaded", 1, promLabel{name: "model", value: model}))
+	}
+	for _, gpu := range info.GPUs {
+		index := promLabel{name: "gpu", value: strconv.Itoa(gpu.Index)}
+		for _, metric := range gpuMetrics {
+			series = append(series, gauge(metric.name, metric.value(gpu), index))
+		}
+	}
+	return series
+}
+
+// encodeWriteRequest encodes the series as a prompb.WriteRequest:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+//
+// Labels are sorted by name as required by the receivers.
+func encodeWriteRequest(series []promSeries) []byte {
+	var buf, ts, msg []byte
+	for _, s := range series {
+		sort.Slice(s.labels, func(i, j int) bool { return s.labels[i].name < s.labels[j].name })
+		ts = ts[:0]
+		for _, l := range s.labels {
+			msg = msg[:0]
+			msg = protowire.AppendTag(msg, 1, protowire.BytesType)
+			msg = protowire.AppendString(msg, l.name)
+			msg = protowire.AppendTag(msg, 2, protowire.BytesType)
+			msg = protowire.AppendString(msg, l.value)
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, msg)
+		}
+		msg = msg[:0]
+		msg = protowire.AppendTag(msg, 1, protowire.Fixed64Type)
+		msg = protowire.AppendFixed64(msg, math.Float64bits(s.value))
+		msg = protowire.AppendTag(msg, 2, protowire.VarintType)
+		msg = protowire.AppendVarint(msg, uint64(s.timestamp))
+		ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, msg)
+
+		buf = protowire.AppendTag(buf, 1, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, ts)
+	}
+	return buf
+}
+
+// RemoteWriter pushes the latest machine info of the devices online on this instance to
+// a Prometheus remote write receiver periodically. Each sample carries the timestamp
+// reported by the device, and is only sent once.
+type RemoteWriter struct {
+	url      string
+	jobName  string
+	interval time.Duration
+	od       *types.OnlineDevices
+	client   *http.Client
+	sent     map[string]time.Time // 每个设备已经推送的最新样本的时间
+
+	samplesTotal prometheus.Counter
+	failedTotal  prometheus.Counter
+	retriesTotal prometheus.Counter
+	sendDuration prometheus.Histogram
+}
+
+// NewRemoteWriter creates the writer, a zero interval takes the default value. The job
+// name must not be empty, the series of the devices are labeled by it.
+func NewRemoteWriter(url, jobName string, interval time.Duration, od *types.OnlineDevices) *RemoteWriter {
+	if interval <= 0 {
+		interval = defaultRemoteWriteInterval
+	}
+	return &RemoteWriter{
+		url:      url,
+		jobName:  jobName,
+		interval: interval,
+		od:       od,
+		client:   &http.Client{Timeout: remoteWriteTimeout},
+		sent:     make(map[string]time.Time),
+		samplesTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "remote_write_samples_total",
+			Help: "number of samples sent to the remote write receiver",
+		}),
+		failedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "remote_write_failed_samples_total",
+			Help: "number of samples failed to send to the remote write receiver",
+		}),
+		retriesTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "remote_write_retries_total",
+			Help: "number of remote write requests retried",
+		}),
+		sendDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "remote_write_duration_seconds",
+			Help:    "duration of sending one remote write request including the retries",
+			Buckets: prometheus.DefBuckets,
+		}),
+	}
+}
+
+// Collectors returns the metrics of the writer to be registered.
+func (rw *RemoteWriter) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{rw.samplesTotal, rw.failedTotal, rw.retriesTotal, rw.sendDuration}
+}
+
+// Run pushes the samples every interval until the context is done.
+func (rw *RemoteWriter) Run(ctx context.Context) {
+	ticker := time.NewTicker(rw.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rw.push(ctx)
+		}
+	}
+}
+
+// push sends the samples reported since the last round in batches of whole devices. The
+// devices of a batch failed to send are sent again in the next round unless they have
+// reported newer samples, the devices of the batches sent or refused by the receiver are not.
+func (rw *RemoteWriter) push(ctx context.Context) {
+	type pending struct {
+		id     string
+		tm     time.Time
+		series []promSeries
+	}
+	devices := make([]pending, 0)
+	online := make(map[string]bool)
+	rw.od.Range(func(device types.OnlineDevice) bool {
+		online[device.NodeId] = true
+		if device.MachineInfo == nil || !device.MachineInfoTime.After(rw.sent[device.NodeId]) {
+			return true
+		}
+		devices = append(devices, pending{
+			id:     device.NodeId,
+			tm:     device.MachineInfoTime,
+			series: machineInfoSeries(rw.jobName, device.NodeId, device.MachineInfoTime, device.MachineInfo),
+		})
+		return true
+	})
+
+	// Forget the devices gone offline
+	for id := range rw.sent {
+		if !online[id] {
+			delete(rw.sent, id)
+		}
+	}
+
+	// The series of a device are not split, a batch is larger than the size only if one
+	// device has more series
+	for start := 0; start < len(devices); {
+		end := start
+		batch := make([]promSeries, 0)
+		for end < len(devices) && (end == start || len(batch)+len(devices[end].series) <= remoteWriteBatchSize) {
+			batch = append(batch, devices[end].series...)
+			end++
+		}
+		if err := rw.send(ctx, batch); err != nil {
+			log.Log.Errorf("Remote write %v samples failed: %v", len(batch), err)
+			rw.failedTotal.Add(float64(len(batch)))
+			if _, refused := err.(errNoRetry); !refused {
+				start = end
+				continue
+			}
+		} else {
+			rw.samplesTotal.Add(float64(len(batch)))
+		}
+		for _, device := range devices[start:end] {
+			rw.sent[device.id] = device.tm
+		}
+		start = end
+	}
+}
+
+// errNoRetry wraps the errors of the requests refused by the receiver, sending them again
+// does not help.
+type errNoRetry struct {
+	err error
+}
+
+func (e errNoRetry) Error() string {
+	return e.err.Error()
+}
+
+// send posts one batch, retrying with backoff on network errors, 5xx and 429 responses.
+func (rw *RemoteWriter) send(ctx context.Context, series []promSeries) error {
+	body := snappy.Encode(nil, encodeWriteRequest(series))
+	start := time.Now()
+	defer func() {
+		rw.sendDuration.Observe(time.Since(start).Seconds())
+	}()
+
+	backoff := remoteWriteMinBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = rw.post(ctx, body)
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(errNoRetry); ok || attempt >= remoteWriteMaxAttempts {
+			return err
+		}
+		rw.retriesTotal.Inc()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, remoteWriteMaxBackoff)
+	}
+}
+
+func (rw *RemoteWriter) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, rw.url, bytes.NewReader(body))
+	if err != nil {
+		return errNoRetry{err}
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "health-monitoring")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	res, err := rw.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 == 2 {
+		io.Copy(io.Discard, res.Body)
+		return nil
+	}
+	message, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+	err = fmt.Errorf("remote write response %v: %s", res.Status, bytes.TrimSpace(message))
+	if res.StatusCode/100 == 5 || res.StatusCode == http.StatusTooManyRequests {
+		return err
+	}
+	return errNoRetry{err}
+}
@@ -0,0 +1,198 @@
+package http
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"health-monitoring/types"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// decodeWriteRequest decodes the samples of a WriteRequest, indexed by metric name and instance.
+func decodeWriteRequest(t *testing.T, data []byte) map[string]promSeries {
+	fields := func(b []byte, f func(num protowire.Number, typ protowire.Type, b []byte) int) {
+		for len(b) > 0 {
+			num, typ, n := protowire.ConsumeTag(b)
+			if n < 0 {
+				t.Fatalf("consume tag failed: %v", protowire.ParseError(n))
+			}
+			b = b[n:]
+			n = f(num, typ, b)
+			if n < 0 {
+				t.Fatalf("consume field %v failed: %v", num, protowire.ParseError(n))
+			}
+			b = b[n:]
+		}
+	}
+	result := make(map[string]promSeries)
+	fields(data, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		ts, n := protowire.ConsumeBytes(b)
+		s := promSeries{}
+		labels := make(map[string]string)
+		fields(ts, func(num protowire.Number, typ protowire.Type, b []byte) int {
+			msg, n := protowire.ConsumeBytes(b)
+			fields(msg, func(field protowire.Number, typ protowire.Type, b []byte) int {
+				switch {
+				case num == 1:
+					v, n := protowire.ConsumeString(b)
+					if field == 1 {
+						s.labels = append(s.labels, promLabel{name: v})
+					} else {
+						s.labels[len(s.labels)-1].value = v
+						labels[s.labels[len(s.labels)-1].name] = v
+					}
+					return n
+				case field == 1:
+					v, n := protowire.ConsumeFixed64(b)
+					s.value = math.Float64frombits(v)
+					return n
+				default:
+					v, n := protowire.ConsumeVarint(b)
+					s.timestamp = int64(v)
+					return n
+				}
+			})
+			return n
+		})
+		for i := 1; i < len(s.labels); i++ {
+			if s.labels[i-1].name >= s.labels[i].name {
+				t.Errorf("labels are not sorted: %+v", s.labels)
+			}
+		}
+		result[labels["__name__"]+"/"+labels["instance"]] = s
+		return n
+	})
+	return result
+}
+
+// go test -v -timeout 30s -count=1 -run TestRemoteWriter health-monitoring/http
+func TestRemoteWriter(t *testing.T) {
+	var mutex sync.Mutex
+	requests := 0
+	received := make(map[string]promSeries)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		requests++
+		if requests == 1 {
+			// The first attempt fails and is retried
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			t.Errorf("unexpected headers %v", r.Header)
+		}
+		body, _ := io.ReadAll(r.Body)
+		data, err := snappy.Decode(nil, body)
+		if err != nil {
+			t.Errorf("decode snappy failed: %v", err)
+		}
+		for key, s := range decodeWriteRequest(t, data) {
+			received[key] = s
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	od := types.NewOnlineDevices()
+	tm := time.UnixMilli(1700000000123)
+	od.SetDevice(types.OnlineDevice{NodeId: "node1", Session: "s1"})
+	od.SetDevice(types.OnlineDevice{NodeId: "node2", Session: "s2"}) // 还没有上报机器信息
+	od.UpdateDevice("node1", "s1", func(device *types.OnlineDevice) {
+		device.MachineInfo = &types.WsMachineInfoRequest{UtilizationGPU: 80, MemoryTotal: 24564, MemoryUsed: 1024}
+		device.MachineInfoTime = tm
+	})
+
+	rw := NewRemoteWriter(srv.URL, "test", time.Hour, od)
+	rw.push(context.Background())
+	if requests != 2 || testutil.ToFloat64(rw.retriesTotal) != 1 {
+		t.Fatalf("expect one retry, got %v requests", requests)
+	}
+	if len(received) != 4 {
+		t.Fatalf("expect 4 series of node1, got %+v", received)
+	}
+	s := received["utilization_gpu/node1"]
+	if s.value != 80 || s.timestamp != tm.UnixMilli() {
+		t.Fatalf("expect the sample reported by the device, got %+v", s)
+	}
+
+	// Samples already sent are not sent again
+	rw.push(context.Background())
+	if requests != 2 {
+		t.Fatalf("expect no request without new samples, got %v requests", requests)
+	}
+	od.UpdateDevice("node1", "s1", func(device *types.OnlineDevice) {
+		device.MachineInfo = &types.WsMachineInfoRequest{UtilizationGPU: 90}
+		device.MachineInfoTime = tm.Add(time.Second)
+	})
+	rw.push(context.Background())
+	if requests != 3 || received["utilization_gpu/node1"].value != 90 {
+		t.Fatalf("expect the new sample sent, got %v requests %+v", requests, received["utilization_gpu/node1"])
+	}
+	if v := testutil.ToFloat64(rw.samplesTotal); v != 8 {
+		t.Fatalf("expect 8 samples sent, got %v", v)
+	}
+}
+
+// go test -v -timeout 30s -count=1 -run TestRemoteWriterPartialFailure health-monitoring/http
+func TestRemoteWriterPartialFailure(t *testing.T) {
+	var mutex sync.Mutex
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	requests := make([]map[string]bool, 0)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		body, _ := io.ReadAll(r.Body)
+		data, _ := snappy.Decode(nil, body)
+		instances := make(map[string]bool)
+		for key := range decodeWriteRequest(t, data) {
+			instances[key[strings.Index(key, "/")+1:]] = true
+		}
+		requests = append(requests, instances)
+		if len(requests) == 2 {
+			// The second batch fails, the round is cancelled before it is retried
+			cancel()
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	// 4 series of each device, the devices take 2 batches
+	od := types.NewOnlineDevices()
+	tm := time.UnixMilli(1700000000123)
+	for i := 0; i < remoteWriteBatchSize/4+100; i++ {
+		id := "node" + strconv.Itoa(i)
+		od.SetDevice(types.OnlineDevice{NodeId: id, Session: id, MachineInfo: &types.WsMachineInfoRequest{}, MachineInfoTime: tm})
+	}
+
+	rw := NewRemoteWriter(srv.URL, "test", time.Hour, od)
+	rw.push(ctx)
+	if len(requests) != 2 || len(requests[0]) != remoteWriteBatchSize/4 {
+		t.Fatalf("expect 2 batches and the first one full, got %v", len(requests))
+	}
+
+	// Only the devices of the failed batch are sent again
+	rw.push(context.Background())
+	if len(requests) != 3 || len(requests[2]) != len(requests[1]) {
+		t.Fatalf("expect the failed batch sent again, got %v requests", len(requests))
+	}
+	for id := range requests[2] {
+		if !requests[1][id] {
+			t.Fatalf("expect only the devices of the failed batch, got %v", id)
+		}
+	}
+}
@@ -48,18 +48,98 @@ func main() {
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
-	if err := db.InitMongo(ctx, cfg.MongoDB.URI, cfg.MongoDB.Database, cfg.MongoDB.ExpireTime); err != nil {
-		os.Exit(1)
+	pm := hmp.NewPrometheusMetrics(cfg.Prometheus.JobName)
+	od := types.NewOnlineDevices()
+
+	backend, err := db.NewStore(ctx, cfg)
+	if err != nil {
+		log.Log.Fatalf("Create storage failed: %v", err)
+	}
+	if instrumented, ok := backend.(db.Instrumented); ok {
+		pm.MustRegister(instrumented.Collectors()...)
+	}
+	var spool *db.Spool
+	if cfg.Storage.SpoolDir != "" {
+		maxSize := cfg.Storage.SpoolMaxSize
+		if maxSize <= 0 {
+			maxSize = 1024
+		}
+		spool, err = db.OpenSpool(cfg.Storage.SpoolDir, maxSize<<20)
+		if err != nil {
+			log.Log.Fatalf("Open spool failed: %v", err)
+		}
+	}
+	store := db.NewBatchWriter(
+		backend,
+		cfg.Storage.QueueSize,
+		cfg.Storage.BatchSize,
+		time.Duration(cfg.Storage.BatchInterval)*time.Millisecond,
+		spool,
+	)
+	pm.MustRegister(store.Collectors()...)
+
+	wsOpts := ws.Options{
+		AutoRegister:   cfg.Registry.AutoRegister,
+		TimestampSkew:  time.Duration(cfg.WebSocket.TimestampSkew) * time.Second,
+		TakeoverPolicy: cfg.WebSocket.Takeover,
+	}
+	if cfg.Sign.PrivateKey != "" {
+		privateKey, err := types.ParsePrivateKey(cfg.Sign.PrivateKey)
+		if err != nil {
+			log.Log.Fatalf("Parse private key of server failed: %v", err)
+		}
+		wsOpts.ServerKey = privateKey
+		log.Log.Infof("Sign responses with public key %x", privateKey.Public())
+	}
+	if err := wsOpts.Validate(); err != nil {
+		log.Log.Fatalf("Set takeover policy failed: %v", err)
 	}
 
-	pm := hmp.NewPrometheusMetrics(cfg.Prometheus.JobName)
+	customMetrics, err := hmp.NewCustomMetrics(cfg.Prometheus.JobName, cfg.CustomMetrics)
+	if err != nil {
+		log.Log.Fatalf("Load custom metrics failed: %v", err)
+	}
+	pm.MustRegister(customMetrics.Collectors()...)
+	wsOpts.CustomMetrics = customMetrics
+
+	go ws.WatchTakeover(ctx, store, od)
+
+	if cfg.Prometheus.RemoteWriteURL != "" {
+		// The device metrics are not exported without a job name, the pushed series would
+		// not match the scraped ones
+		if cfg.Prometheus.JobName == "" {
+			log.Log.Fatal("Prometheus.JobName is required by remote write")
+		}
+		rw := hmp.NewRemoteWriter(
+			cfg.Prometheus.RemoteWriteURL,
+			cfg.Prometheus.JobName,
+			time.Duration(cfg.Prometheus.RemoteWriteInterval)*time.Second,
+			od,
+		)
+		pm.MustRegister(rw.Collectors()...)
+		go rw.Run(ctx)
+		log.Log.Infof("Push metrics to %v", cfg.Prometheus.RemoteWriteURL)
+	}
+
+	health := hmp.NewHealth(store, od, ws.ConnectionCount)
 
 	router := gin.Default()
+	router.GET("/healthz", health.Healthz)
+	router.GET("/readyz", health.Readyz)
 	router.GET("/metrics/prometheus", pm.Metrics)
 	// router.GET("/echo", ws.Echo)
 	router.GET("/websocket", func(c *gin.Context) {
-		ws.Ws(c, pm)
+		ws.Ws(c, store, pm, od, wsOpts)
 	})
+	router.GET("/api/v1/devices", hmp.ListOnlineDevices(store, od))
+	router.GET("/api/v1/devices/:id", hmp.GetDevice(store))
+	router.GET("/api/v1/devices/:id/metrics", hmp.GetDeviceMetrics(store))
+	if cfg.Registry.AdminToken != "" {
+		admin := router.Group("/api/v1/admin", hmp.AdminAuth(cfg.Registry.AdminToken))
+		admin.GET("/devices", hmp.ListDevices(store))
+		admin.POST("/devices", hmp.RegisterDevice(store))
+		admin.POST("/devices/:id/revoke", hmp.RevokeDevice(store, od))
+	}
 
 	// log.Log.Fatal(router.Run(cfg.Addr))
 
@@ -82,6 +162,10 @@ func main() {
 	// Restore default behavior on the interrupt signal and notify user of shutdown.
 	stop()
 	log.Log.Println("shutting down gracefully, press Ctrl+C again to force")
+	health.SetShuttingDown()
+	if cfg.ShutdownDelay > 0 {
+		time.Sleep(time.Duration(cfg.ShutdownDelay) * time.Second)
+	}
 
 	// The context is used to inform the server it has 5 seconds to finish
 	// the request it is currently handling
@@ -90,6 +174,16 @@ func main() {
 	if err := srv.Shutdown(ctx); err != nil {
 		log.Log.Fatal("Server forced to shutdown: ", err)
 	}
+	// The websocket connections are hijacked, close them so that the devices are set offline
+	// before the store is disconnected
+	if err := ws.Shutdown(ctx, od); err != nil {
+		log.Log.Errorf("Close websocket connections failed: %v, %v devices left online", err, od.Count())
+	}
+
+	// Insert the queued device info before exiting
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	store.Disconnect(ctx)
 
 	log.Log.Println("Server exiting")
 }
@@ -9,4 +9,8 @@ const (
 	ErrCodeDatabase                         // 数据库错误
 	ErrCodeOnline                           // 上线错误
 	ErrCodeMachineInfo                      // 更新机器信息错误
+	ErrCodeRegistry                         // 设备未登记或者已吊销
+	ErrCodeReplay                           // 时间戳超出允许范围或者消息 ID 重复
+	ErrCodeUnavailable                      // 数据库暂时不可用，稍后重试
+	ErrCodeAuth                             // 管理接口认证失败
 )
@@ -0,0 +1,63 @@
+package types
+
+import "time"
+
+type RegisterDeviceRequest struct {
+	DeviceId string `json:"device_id" binding:"required"`
+	PubKey   []byte `json:"pub_key"` // base64 编码的 ed25519 公钥，可以为空，在第一次上线时绑定
+	Project  string `json:"project"`
+	Owner    string `json:"owner"`
+}
+
+// DeviceStatus is an online device with its latest machine info.
+type DeviceStatus struct {
+	NodeId         string      `json:"node_id"`
+	Instance       string      `json:"instance"`
+	ConnectTime    time.Time   `json:"connect_time"`
+	LastHeartbeat  time.Time   `json:"last_heartbeat"`
+	InfoTime       *time.Time  `json:"info_time"` // 最近一次上报机器信息的时间，还没有上报时为空
+	Project        string      `json:"project"`
+	Models         []ModelInfo `json:"models"`
+	GPUName        string      `json:"gpu_name"`
+	UtilizationGPU int         `json:"utilization_gpu"`
+	MemoryTotal    int64       `json:"memory_total"`
+	MemoryUsed     int64       `json:"memory_used"`
+}
+
+type ListDevicesResponse struct {
+	Total   int            `json:"total"`
+	Devices []DeviceStatus `json:"devices"`
+}
+
+type DeviceMetricsResponse struct {
+	NodeId string            `json:"node_id"`
+	From   time.Time         `json:"from"`
+	To     time.Time         `json:"to"`
+	Step   int64             `json:"step"` // 时间桶的长度，单位秒
+	Agg    string            `json:"agg"`
+	Points []DeviceInfoPoint `json:"points"`
+}
+
+// HealthResponse is the state of the service checked by the liveness and readiness probes.
+type HealthResponse struct {
+	Status       string            `json:"status"` // ok 或者 fail
+	ShuttingDown bool              `json:"shutting_down"`
+	Uptime       int64             `json:"uptime"`             // 运行时长，单位秒
+	Sessions     int               `json:"sessions"`           // 本实例上已上线的设备会话数
+	Connections  int64             `json:"connections"`        // 本实例的 WebSocket 连接数，包括还没有上线的连接
+	Database     *DatabaseHealth   `json:"database,omitempty"` // 只在 readyz 中检查
+	WriteQueue   *WriteQueueHealth `json:"write_queue,omitempty"`
+}
+
+type DatabaseHealth struct {
+	Status  string  `json:"status"`
+	Latency float64 `json:"latency"` // ping 的耗时，单位毫秒
+	Error   string  `json:"error,omitempty"`
+}
+
+type WriteQueueHealth struct {
+	Status     string `json:"status"`
+	Depth      int    `json:"depth"`       // 队列中等待写入的样本数
+	Capacity   int    `json:"capacity"`    // 队列的容量
+	SpoolBytes int64  `json:"spool_bytes"` // 暂存日志中等待补写的数据大小
+}
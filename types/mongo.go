@@ -3,8 +3,12 @@ package types
 import "time"
 
 type MDBDeviceOnline struct {
-	DeviceId string    `json:"device_id" bson:"device_id"`
-	AddTime  time.Time `json:"add_time" bson:"add_time"`
+	DeviceId  string    `json:"device_id" bson:"device_id"`
+	AddTime   time.Time `json:"add_time" bson:"add_time"`
+	Instance  string    `json:"instance" bson:"instance"`   // 设备连接的服务实例
+	Heartbeat time.Time `json:"heartbeat" bson:"heartbeat"` // 最近一次心跳的时间，超过租期没有心跳的记录视为过期
+	Session   string    `json:"session" bson:"session"`     // 连接的唯一标识，被接管的连接据此发现自己已经下线
+	PubKey    []byte    `json:"pub_key" bson:"pub_key"`     // 连接上线时使用的公钥
 }
 
 type MDBMetaField struct {
@@ -12,12 +16,113 @@ type MDBMetaField struct {
 	Project  string      `json:"project" bson:"project"`
 	Models   []ModelInfo `json:"models" bson:"models"`
 	GPUName  string      `json:"gpu_name" bson:"gpu_name"`
+	GPUIndex *int        `json:"gpu_index,omitempty" bson:"gpu_index,omitempty"` // 只在每块 GPU 的文档中设置，设备汇总的文档没有
+	GPUUUID  string      `json:"gpu_uuid,omitempty" bson:"gpu_uuid,omitempty"`
 }
 
+// MDBDeviceInfo is one sample of the device. Besides the sample of the whole device, a
+// device reporting the list of GPUs has one sample of each GPU at the same timestamp,
+// with Device.GPUIndex and GPU set.
 type MDBDeviceInfo struct {
 	Timestamp      time.Time    `json:"timestamp" bson:"timestamp"`
 	Device         MDBMetaField `json:"device" bson:"device"`
 	UtilizationGPU int          `json:"utilization_gpu" bson:"utilization_gpu"`
 	MemoryTotal    int64        `json:"memory_total" bson:"memory_total"`
 	MemoryUsed     int64        `json:"memory_used" bson:"memory_used"`
+	GPU            *MDBGPUInfo  `json:"gpu,omitempty" bson:"gpu,omitempty"`
+}
+
+// MDBGPUInfo is the sample of one GPU besides the utilization and the memory.
+type MDBGPUInfo struct {
+	Temperature int     `json:"temperature" bson:"temperature"`   // 温度，单位摄氏度
+	PowerDraw   float64 `json:"power_draw" bson:"power_draw"`     // 功耗，单位瓦
+	FanSpeed    int     `json:"fan_speed" bson:"fan_speed"`       // 风扇转速百分比
+	ClockSM     int     `json:"clock_sm" bson:"clock_sm"`         // SM 频率，单位 MHz
+	ClockMemory int     `json:"clock_memory" bson:"clock_memory"` // 显存频率，单位 MHz
+}
+
+type MDBHostMetaField struct {
+	DeviceId string `json:"device_id" bson:"device_id"`
+}
+
+// MDBHostMetrics is one sample of the host metrics, stored in the time series collection
+// host_metrics with the meta field device like MDBDeviceInfo.
+type MDBHostMetrics struct {
+	Timestamp      time.Time        `json:"timestamp" bson:"timestamp"`
+	Device         MDBHostMetaField `json:"device" bson:"device"`
+	CPUUtilization float64          `json:"cpu_utilization" bson:"cpu_utilization"`
+	CPUCores       int              `json:"cpu_cores" bson:"cpu_cores"`
+	Load1          float64          `json:"load1" bson:"load1"`
+	Load5          float64          `json:"load5" bson:"load5"`
+	Load15         float64          `json:"load15" bson:"load15"`
+	MemoryTotal    int64            `json:"memory_total" bson:"memory_total"`
+	MemoryUsed     int64            `json:"memory_used" bson:"memory_used"`
+	Disks          []DiskUsage      `json:"disks" bson:"disks"`
+	Networks       []NetworkIO      `json:"networks" bson:"networks"`
+	Uptime         int64            `json:"uptime" bson:"uptime"`
+}
+
+type MDBCustomMetaField struct {
+	DeviceId string            `json:"device_id" bson:"device_id"`
+	Name     string            `json:"name" bson:"name"`
+	Labels   map[string]string `json:"labels,omitempty" bson:"labels,omitempty"`
+}
+
+// MDBCustomMetric is one sample of a custom metric, stored in the time series collection
+// custom_metrics with the series as the meta field.
+type MDBCustomMetric struct {
+	Timestamp time.Time          `json:"timestamp" bson:"timestamp"`
+	Device    MDBCustomMetaField `json:"device" bson:"device"`
+	Type      string             `json:"type" bson:"type"`
+	Value     float64            `json:"value" bson:"value"`
+	Buckets   []HistogramBucket  `json:"buckets,omitempty" bson:"buckets,omitempty"`
+	Count     uint64             `json:"count,omitempty" bson:"count,omitempty"`
+	Sum       float64            `json:"sum,omitempty" bson:"sum,omitempty"`
+}
+
+type MDBModelMetaField struct {
+	DeviceId string `json:"device_id" bson:"device_id"`
+	Project  string `json:"project" bson:"project"`
+	Model    string `json:"model" bson:"model"`
+}
+
+// MDBModelMetrics is one sample of the serving stats of a model, stored in the time series
+// collection model_metrics with the device and the model as the meta field.
+type MDBModelMetrics struct {
+	Timestamp                 time.Time         `json:"timestamp" bson:"timestamp"`
+	Device                    MDBModelMetaField `json:"device" bson:"device"`
+	RequestsPerSecond         float64           `json:"requests_per_second" bson:"requests_per_second"`
+	PromptTokensPerSecond     float64           `json:"prompt_tokens_per_second" bson:"prompt_tokens_per_second"`
+	CompletionTokensPerSecond float64           `json:"completion_tokens_per_second" bson:"completion_tokens_per_second"`
+	TimeToFirstToken          Percentiles       `json:"time_to_first_token" bson:"time_to_first_token"`
+	Latency                   Percentiles       `json:"latency" bson:"latency"`
+	QueueDepth                int               `json:"queue_depth" bson:"queue_depth"`
+	Errors                    uint64            `json:"errors" bson:"errors"`
+	ContextLength             int               `json:"context_length" bson:"context_length"`
+}
+
+type MDBDeviceRegistry struct {
+	DeviceId   string    `json:"device_id" bson:"device_id"`
+	PubKey     []byte    `json:"pub_key" bson:"pub_key,omitempty"` // 绑定的公钥，为空时在第一次上线时绑定
+	Project    string    `json:"project" bson:"project"`
+	Owner      string    `json:"owner" bson:"owner"`
+	Revoked    bool      `json:"revoked" bson:"revoked"`
+	AddTime    time.Time `json:"add_time" bson:"add_time"`
+	UpdateTime time.Time `json:"update_time" bson:"update_time"`
+}
+
+const (
+	AggAvg = "avg"
+	AggMax = "max"
+	AggMin = "min"
+	AggP95 = "p95"
+)
+
+// DeviceInfoPoint is the aggregation of the device info samples in one time bucket.
+type DeviceInfoPoint struct {
+	Timestamp      time.Time `json:"timestamp" bson:"timestamp"` // 时间桶的起始时间
+	UtilizationGPU float64   `json:"utilization_gpu" bson:"utilization_gpu"`
+	MemoryTotal    float64   `json:"memory_total" bson:"memory_total"`
+	MemoryUsed     float64   `json:"memory_used" bson:"memory_used"`
+	Count          int       `json:"count" bson:"count"` // 时间桶内的样本数量
 }
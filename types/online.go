@@ -1,27 +1,104 @@
 package types
 
-import "sync"
+import (
+	"sort"
+	"sync"
+	"time"
+)
 
+// OnlineDevice is the live websocket session of a device on this instance.
+type OnlineDevice struct {
+	NodeId          string                `json:"node_id"`
+	Session         string                `json:"session"`
+	RemoteAddr      string                `json:"remote_addr"`
+	ConnectTime     time.Time             `json:"connect_time"`
+	LastMessageTime time.Time             `json:"last_message_time"`
+	Version         uint32                `json:"version"`                // 最近一次请求的协议版本
+	MachineInfo     *WsMachineInfoRequest `json:"machine_info,omitempty"` // 最近一次上报的机器信息
+	MachineInfoTime time.Time             `json:"machine_info_time"`      // 设备上报机器信息时的时间戳
+	Kick            func(reason string)   `json:"-"`                      // 断开该连接
+}
+
+// OnlineDevices is the registry of the devices online on this instance, indexed by node id.
 type OnlineDevices struct {
-	devices map[string]WsMachineInfoRequest
+	devices map[string]OnlineDevice
 	mutex   sync.RWMutex
 }
 
 func NewOnlineDevices() *OnlineDevices {
 	return &OnlineDevices{
-		devices: make(map[string]WsMachineInfoRequest),
+		devices: make(map[string]OnlineDevice),
 		mutex:   sync.RWMutex{},
 	}
 }
 
-func (od *OnlineDevices) SetDevice(id string, di WsMachineInfoRequest) {
+// SetDevice registers the session of the device, and returns the previous session of
+// the same device if there is one.
+func (od *OnlineDevices) SetDevice(device OnlineDevice) (OnlineDevice, bool) {
 	od.mutex.Lock()
-	od.devices[id] = di
+	old, ok := od.devices[device.NodeId]
+	od.devices[device.NodeId] = device
 	od.mutex.Unlock()
+	return old, ok
 }
 
-func (od *OnlineDevices) RemoveDevice(id string) {
+// UpdateDevice modifies the device if it is still online with the session.
+func (od *OnlineDevices) UpdateDevice(id, session string, update func(device *OnlineDevice)) {
 	od.mutex.Lock()
-	delete(od.devices, id)
+	if device, ok := od.devices[id]; ok && device.Session == session {
+		update(&device)
+		od.devices[id] = device
+	}
 	od.mutex.Unlock()
 }
+
+// RemoveDevice unregisters the device if it is still online with the session, it returns
+// false if the device has been taken over by another session.
+func (od *OnlineDevices) RemoveDevice(id, session string) bool {
+	od.mutex.Lock()
+	defer od.mutex.Unlock()
+	if device, ok := od.devices[id]; !ok || device.Session != session {
+		return false
+	}
+	delete(od.devices, id)
+	return true
+}
+
+func (od *OnlineDevices) Get(id string) (OnlineDevice, bool) {
+	od.mutex.RLock()
+	device, ok := od.devices[id]
+	od.mutex.RUnlock()
+	return device, ok
+}
+
+// List returns all online devices sorted by node id.
+func (od *OnlineDevices) List() []OnlineDevice {
+	od.mutex.RLock()
+	devices := make([]OnlineDevice, 0, len(od.devices))
+	for _, device := range od.devices {
+		devices = append(devices, device)
+	}
+	od.mutex.RUnlock()
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].NodeId < devices[j].NodeId
+	})
+	return devices
+}
+
+func (od *OnlineDevices) Count() int {
+	od.mutex.RLock()
+	defer od.mutex.RUnlock()
+	return len(od.devices)
+}
+
+// Range calls f for each online device until f returns false. The registry is locked
+// for reading during the iteration, f must not modify it.
+func (od *OnlineDevices) Range(f func(device OnlineDevice) bool) {
+	od.mutex.RLock()
+	defer od.mutex.RUnlock()
+	for _, device := range od.devices {
+		if !f(device) {
+			return
+		}
+	}
+}
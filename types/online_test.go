@@ -0,0 +1,72 @@
+package types
+
+import (
+	"testing"
+	"time"
+)
+
+// go test -v -timeout 30s -count=1 -run TestOnlineDevices health-monitoring/types
+func TestOnlineDevices(t *testing.T) {
+	od := NewOnlineDevices()
+
+	kicked := ""
+	if _, ok := od.SetDevice(OnlineDevice{
+		NodeId:      "node1",
+		Session:     "s1",
+		ConnectTime: time.Now(),
+		Kick:        func(reason string) { kicked = "s1" },
+	}); ok {
+		t.Fatal("node1 should not have a previous session")
+	}
+	od.SetDevice(OnlineDevice{NodeId: "node2", Session: "s2"})
+	if od.Count() != 2 {
+		t.Fatalf("expect 2 online devices, got %v", od.Count())
+	}
+
+	// a new session of node1 takes over the old one
+	old, ok := od.SetDevice(OnlineDevice{NodeId: "node1", Session: "s3"})
+	if !ok || old.Session != "s1" {
+		t.Fatalf("expect previous session s1 of node1, got %v", old.Session)
+	}
+	old.Kick("taken over")
+	if kicked != "s1" {
+		t.Fatal("previous session of node1 should be kicked")
+	}
+
+	// the old session must neither update nor remove the new one
+	od.UpdateDevice("node1", "s1", func(device *OnlineDevice) {
+		device.Version = 1
+	})
+	if od.RemoveDevice("node1", "s1") {
+		t.Fatal("old session should not remove the new session")
+	}
+	device, ok := od.Get("node1")
+	if !ok || device.Session != "s3" || device.Version != 0 {
+		t.Fatalf("unexpected session of node1: %+v", device)
+	}
+
+	od.UpdateDevice("node1", "s3", func(device *OnlineDevice) {
+		device.MachineInfo = &WsMachineInfoRequest{GPUName: "NVIDIA RTX A5000"}
+	})
+	if device, _ := od.Get("node1"); device.MachineInfo == nil || device.MachineInfo.GPUName != "NVIDIA RTX A5000" {
+		t.Fatalf("machine info of node1 should be updated: %+v", device)
+	}
+
+	devices := od.List()
+	if len(devices) != 2 || devices[0].NodeId != "node1" || devices[1].NodeId != "node2" {
+		t.Fatalf("unexpected list of online devices: %+v", devices)
+	}
+
+	count := 0
+	od.Range(func(device OnlineDevice) bool {
+		count++
+		return false
+	})
+	if count != 1 {
+		t.Fatalf("range should stop when f returns false, called %v times", count)
+	}
+
+	if !od.RemoveDevice("node1", "s3") || od.Count() != 1 {
+		t.Fatal("session s3 should remove node1")
+	}
+}
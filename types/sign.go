@@ -0,0 +1,99 @@
+package types
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+)
+
+var (
+	ErrInvalidPubKey     = errors.New("invalid ed25519 public key")
+	ErrInvalidPrivateKey = errors.New("invalid ed25519 private key")
+	ErrInvalidSign       = errors.New("invalid ed25519 signature")
+	ErrUnexpectedPubKey  = errors.New("unexpected public key of server")
+)
+
+// ParsePrivateKey parses a hex encoded ed25519 private key, either the 32 bytes seed
+// or the 64 bytes key.
+func ParsePrivateKey(s string) (ed25519.PrivateKey, error) {
+	key, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	switch len(key) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(key), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(key), nil
+	}
+	return nil, ErrInvalidPrivateKey
+}
+
+// 签名内容: version、timestamp、id、type 按大端序依次编码，后面紧跟消息体
+func (header *WsHeader) signContent(body []byte) []byte {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, header.Version)
+	binary.Write(buf, binary.BigEndian, header.Timestamp)
+	binary.Write(buf, binary.BigEndian, header.Id)
+	binary.Write(buf, binary.BigEndian, header.Type)
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+// SignContent returns the bytes of the request covered by the signature.
+func (req *WsRequest) SignContent() []byte {
+	return req.signContent(req.Body)
+}
+
+// SignWith fills PubKey and Sign of the request with the ed25519 private key.
+func (req *WsRequest) SignWith(privateKey ed25519.PrivateKey) {
+	req.PubKey = privateKey.Public().(ed25519.PublicKey)
+	req.Sign = ed25519.Sign(privateKey, req.SignContent())
+}
+
+// Verify checks the signature of the request with the public key it carries.
+func (req *WsRequest) Verify() error {
+	if len(req.PubKey) != ed25519.PublicKeySize {
+		return ErrInvalidPubKey
+	}
+	if !ed25519.Verify(ed25519.PublicKey(req.PubKey), req.SignContent(), req.Sign) {
+		return ErrInvalidSign
+	}
+	return nil
+}
+
+// SignContent returns the bytes of the response covered by the signature:
+// the same header encoding as the request, then code(uint32), the length of
+// message(uint32), message and body.
+func (res *WsResponse) SignContent() []byte {
+	buf := bytes.NewBuffer(res.signContent(nil))
+	binary.Write(buf, binary.BigEndian, res.Code)
+	binary.Write(buf, binary.BigEndian, uint32(len(res.Message)))
+	buf.WriteString(res.Message)
+	buf.Write(res.Body)
+	return buf.Bytes()
+}
+
+// SignWith fills PubKey and Sign of the response with the ed25519 private key.
+func (res *WsResponse) SignWith(privateKey ed25519.PrivateKey) {
+	res.PubKey = privateKey.Public().(ed25519.PublicKey)
+	res.Sign = ed25519.Sign(privateKey, res.SignContent())
+}
+
+// Verify checks that the response is signed by the monitoring server.
+// Agents should pass the public key of the server they trust, a response
+// signed by any other key is rejected with ErrUnexpectedPubKey.
+func (res *WsResponse) Verify(serverPubKey ed25519.PublicKey) error {
+	if len(res.PubKey) != ed25519.PublicKeySize {
+		return ErrInvalidPubKey
+	}
+	if !bytes.Equal(res.PubKey, serverPubKey) {
+		return ErrUnexpectedPubKey
+	}
+	if !ed25519.Verify(ed25519.PublicKey(res.PubKey), res.SignContent(), res.Sign) {
+		return ErrInvalidSign
+	}
+	return nil
+}
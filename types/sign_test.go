@@ -0,0 +1,85 @@
+package types
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+)
+
+// go test -v -timeout 30s -count=1 -run TestWsRequestSign health-monitoring/types
+func TestWsRequestSign(t *testing.T) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate ed25519 key failed: %v", err)
+	}
+
+	req := &WsRequest{
+		WsHeader: WsHeader{
+			Version:   0,
+			Timestamp: time.Now().UnixMilli(),
+			Id:        1,
+			Type:      uint32(WsMtOnline),
+		},
+		Body: []byte(`{"node_id":"123456789"}`),
+	}
+	if err := req.Verify(); err != ErrInvalidPubKey {
+		t.Fatalf("verify unsigned request should fail with invalid public key, got %v", err)
+	}
+
+	req.SignWith(privateKey)
+	if err := req.Verify(); err != nil {
+		t.Fatalf("verify signed request failed: %v", err)
+	}
+
+	req.Id++
+	if err := req.Verify(); err != ErrInvalidSign {
+		t.Fatalf("verify tampered header should fail with invalid signature, got %v", err)
+	}
+	req.Id--
+
+	req.Body = []byte(`{"node_id":"987654321"}`)
+	if err := req.Verify(); err != ErrInvalidSign {
+		t.Fatalf("verify tampered body should fail with invalid signature, got %v", err)
+	}
+}
+
+// go test -v -timeout 30s -count=1 -run TestWsResponseSign health-monitoring/types
+func TestWsResponseSign(t *testing.T) {
+	privateKey, err := ParsePrivateKey("9d61b19deffd5a60ba844af492ec2cc44449c5697b326919703bac031cae7f60")
+	if err != nil {
+		t.Fatalf("parse private key failed: %v", err)
+	}
+	serverPubKey := privateKey.Public().(ed25519.PublicKey)
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate ed25519 key failed: %v", err)
+	}
+
+	res := &WsResponse{
+		WsHeader: WsHeader{
+			Version:   0,
+			Timestamp: time.Now().Unix(),
+			Id:        1,
+			Type:      uint32(WsMtOnline),
+		},
+		Code:    0,
+		Message: "ok",
+		Body:    []byte(""),
+	}
+	res.SignWith(privateKey)
+	if err := res.Verify(serverPubKey); err != nil {
+		t.Fatalf("verify signed response failed: %v", err)
+	}
+
+	res.Code = uint32(ErrCodeOnline)
+	if err := res.Verify(serverPubKey); err != ErrInvalidSign {
+		t.Fatalf("verify tampered code should fail with invalid signature, got %v", err)
+	}
+
+	// a spoofed server signs with its own key
+	res.SignWith(otherKey)
+	if err := res.Verify(serverPubKey); err != ErrUnexpectedPubKey {
+		t.Fatalf("verify response of other key should fail with unexpected public key, got %v", err)
+	}
+}
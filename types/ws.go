@@ -1,12 +1,14 @@
 package types
 
+import "errors"
+
 type WsHeader struct {
 	Version   uint32 `json:"version"`   // 协议版本，暂时用 0
 	Timestamp int64  `json:"timestamp"` // 时间戳
 	Id        uint64 `json:"id"`        // 消息 ID
 	Type      uint32 `json:"type"`      // 消息类型 WsMessageType
-	PubKey    []byte `json:"pub_key"`   // 公钥，验证消息安全完整，暂时不需要
-	Sign      []byte `json:"sign"`      // 签名，验证消息安全完整，暂时不需要
+	PubKey    []byte `json:"pub_key"`   // ed25519 公钥，验证消息安全完整
+	Sign      []byte `json:"sign"`      // ed25519 签名，签名内容见 SignContent
 }
 
 type WsRequest struct {
@@ -26,16 +28,52 @@ type WsMessageType uint32
 const (
 	WsMtOnline WsMessageType = iota + 1
 	WsMtMachineInfo
+	WsMtChallenge     // 服务端在连接建立后主动推送的挑战，不是请求
+	WsMtHostMetrics   // 主机的 CPU、内存、磁盘和网络等系统指标
+	WsMtCustomMetrics // 设备自定义的指标，名称和标签需要在服务端配置中登记
+	WsMtModelMetrics  // 每个模型的推理服务指标
 )
 
+// String returns the name of the message type used in metrics, unknown types share one
+// name so that clients cannot create unbounded labels.
+func (t WsMessageType) String() string {
+	switch t {
+	case WsMtOnline:
+		return "online"
+	case WsMtMachineInfo:
+		return "machine_info"
+	case WsMtChallenge:
+		return "challenge"
+	case WsMtHostMetrics:
+		return "host_metrics"
+	case WsMtCustomMetrics:
+		return "custom_metrics"
+	case WsMtModelMetrics:
+		return "model_metrics"
+	default:
+		return "unknown"
+	}
+}
+
+// WsChallenge is the body of the challenge sent by the server right after the
+// websocket upgrade, the online request must carry the nonce.
+type WsChallenge struct {
+	Nonce []byte `json:"nonce"`
+}
+
 type WsOnlineRequest struct {
 	NodeId string `json:"node_id"`
+	Nonce  []byte `json:"nonce"` // 服务端挑战中的随机数，随请求一起签名，防止重放
 }
 
 type ModelInfo struct {
 	Model string `json:"model" bson:"model"`
 }
 
+// WsMachineInfoVersionGPUs is the version of the machine info request carrying the list
+// of GPUs, the requests of version 0 report the whole device as one GPU.
+const WsMachineInfoVersionGPUs = 1
+
 type WsMachineInfoRequest struct {
 	Project        string      `json:"project" bson:"project"`
 	Models         []ModelInfo `json:"models" bson:"models"`
@@ -43,4 +81,187 @@ type WsMachineInfoRequest struct {
 	UtilizationGPU int         `json:"utilization_gpu" bson:"utilization_gpu"` // GPU 使用率，乘以 100 取整
 	MemoryTotal    int64       `json:"memory_total" bson:"memory_total"`       // 显存总大小，单位 MB 或者 MiB
 	MemoryUsed     int64       `json:"memory_used" bson:"memory_used"`         // 已用显存，单位 MB 或者 MiB
+	GPUs           []GPUInfo   `json:"gpus,omitempty" bson:"gpus,omitempty"`   // 版本 1 开始上报每块 GPU，汇总字段由服务端计算
+}
+
+type GPUInfo struct {
+	Index          int     `json:"index" bson:"index"` // 设备上的 GPU 序号，从 0 开始
+	UUID           string  `json:"uuid" bson:"uuid"`
+	Name           string  `json:"name" bson:"name"`
+	UtilizationGPU int     `json:"utilization_gpu" bson:"utilization_gpu"`
+	MemoryTotal    int64   `json:"memory_total" bson:"memory_total"`
+	MemoryUsed     int64   `json:"memory_used" bson:"memory_used"`
+	Temperature    int     `json:"temperature" bson:"temperature"`   // 温度，单位摄氏度
+	PowerDraw      float64 `json:"power_draw" bson:"power_draw"`     // 功耗，单位瓦
+	FanSpeed       int     `json:"fan_speed" bson:"fan_speed"`       // 风扇转速百分比
+	ClockSM        int     `json:"clock_sm" bson:"clock_sm"`         // SM 频率，单位 MHz
+	ClockMemory    int     `json:"clock_memory" bson:"clock_memory"` // 显存频率，单位 MHz
+}
+
+var (
+	ErrGPUsRequired    = errors.New("gpus is required since version 1")
+	ErrInvalidGPUIndex = errors.New("gpu index is negative or duplicate")
+)
+
+// Normalize checks the request of the version, and fills the fields of the whole device
+// from the list of GPUs if it is reported: the utilization is the average, the memory is
+// the sum, and the name is the name of the first GPU.
+func (req *WsMachineInfoRequest) Normalize(version uint32) error {
+	if version >= WsMachineInfoVersionGPUs && len(req.GPUs) == 0 {
+		return ErrGPUsRequired
+	}
+	if len(req.GPUs) == 0 {
+		return nil
+	}
+	seen := make(map[int]bool, len(req.GPUs))
+	utilization := 0
+	req.MemoryTotal, req.MemoryUsed = 0, 0
+	for _, gpu := range req.GPUs {
+		if gpu.Index < 0 || seen[gpu.Index] {
+			return ErrInvalidGPUIndex
+		}
+		seen[gpu.Index] = true
+		utilization += gpu.UtilizationGPU
+		req.MemoryTotal += gpu.MemoryTotal
+		req.MemoryUsed += gpu.MemoryUsed
+	}
+	req.UtilizationGPU = (utilization + len(req.GPUs)/2) / len(req.GPUs)
+	if req.GPUName == "" {
+		req.GPUName = req.GPUs[0].Name
+	}
+	return nil
+}
+
+// WsHostMetricsRequest is the body of the host metrics request, the system metrics of
+// the host besides the GPUs.
+type WsHostMetricsRequest struct {
+	CPUUtilization float64     `json:"cpu_utilization" bson:"cpu_utilization"` // CPU 使用率百分比
+	CPUCores       int         `json:"cpu_cores" bson:"cpu_cores"`
+	Load1          float64     `json:"load1" bson:"load1"` // 1、5、15 分钟的平均负载
+	Load5          float64     `json:"load5" bson:"load5"`
+	Load15         float64     `json:"load15" bson:"load15"`
+	MemoryTotal    int64       `json:"memory_total" bson:"memory_total"` // 内存总大小，单位字节
+	MemoryUsed     int64       `json:"memory_used" bson:"memory_used"`   // 已用内存，单位字节
+	Disks          []DiskUsage `json:"disks" bson:"disks"`
+	Networks       []NetworkIO `json:"networks" bson:"networks"`
+	Uptime         int64       `json:"uptime" bson:"uptime"` // 开机时长，单位秒
+}
+
+type DiskUsage struct {
+	Mount string `json:"mount" bson:"mount"` // 挂载点
+	Total int64  `json:"total" bson:"total"` // 单位字节
+	Used  int64  `json:"used" bson:"used"`   // 单位字节
+}
+
+// NetworkIO is the throughput of one network interface since the last report.
+type NetworkIO struct {
+	Interface string  `json:"interface" bson:"interface"`
+	RxBytes   float64 `json:"rx_bytes" bson:"rx_bytes"` // 每秒接收的字节数
+	TxBytes   float64 `json:"tx_bytes" bson:"tx_bytes"` // 每秒发送的字节数
+}
+
+var (
+	ErrMountRequired      = errors.New("mount point of disk is required")
+	ErrDuplicateMount     = errors.New("mount point is reported more than once")
+	ErrInterfaceRequired  = errors.New("network interface name is required")
+	ErrDuplicateInterface = errors.New("network interface is reported more than once")
+)
+
+// Validate checks that every disk and network interface is named once, the names are the
+// labels of the series.
+func (req *WsHostMetricsRequest) Validate() error {
+	mounts := make(map[string]bool, len(req.Disks))
+	for _, disk := range req.Disks {
+		if disk.Mount == "" {
+			return ErrMountRequired
+		}
+		if mounts[disk.Mount] {
+			return ErrDuplicateMount
+		}
+		mounts[disk.Mount] = true
+	}
+	interfaces := make(map[string]bool, len(req.Networks))
+	for _, network := range req.Networks {
+		if network.Interface == "" {
+			return ErrInterfaceRequired
+		}
+		if interfaces[network.Interface] {
+			return ErrDuplicateInterface
+		}
+		interfaces[network.Interface] = true
+	}
+	return nil
+}
+
+const (
+	CustomMetricGauge     = "gauge"
+	CustomMetricCounter   = "counter"
+	CustomMetricHistogram = "histogram"
+)
+
+// WsCustomMetricsRequest is the body of the custom metrics request, the samples of the
+// series defined by the agent. Only the metrics configured in CustomMetrics are accepted.
+type WsCustomMetricsRequest struct {
+	Samples []CustomSample `json:"samples"`
+}
+
+type CustomSample struct {
+	Name      string            `json:"name" bson:"name"`
+	Type      string            `json:"type" bson:"type"` // gauge、counter 或者 histogram，必须与配置一致
+	Labels    map[string]string `json:"labels,omitempty" bson:"labels,omitempty"`
+	Timestamp int64             `json:"timestamp" bson:"timestamp"`                 // 采样时间，单位毫秒，为 0 时使用请求的时间戳
+	Value     float64           `json:"value" bson:"value"`                         // gauge 的当前值或者 counter 的累计值
+	Buckets   []HistogramBucket `json:"buckets,omitempty" bson:"buckets,omitempty"` // histogram 的累计桶，按上界升序
+	Count     uint64            `json:"count,omitempty" bson:"count,omitempty"`     // histogram 的样本总数
+	Sum       float64           `json:"sum,omitempty" bson:"sum,omitempty"`         // histogram 的样本总和
+}
+
+type HistogramBucket struct {
+	UpperBound float64 `json:"upper_bound" bson:"upper_bound"`
+	Count      uint64  `json:"count" bson:"count"` // 小于等于上界的样本数
+}
+
+// WsModelMetricsRequest is the body of the model metrics request, the serving stats of
+// each model served by the device since the last report.
+type WsModelMetricsRequest struct {
+	Project string                `json:"project" bson:"project"`
+	Models  []ModelServingMetrics `json:"models" bson:"models"`
+}
+
+type ModelServingMetrics struct {
+	Model                     string      `json:"model" bson:"model"`
+	RequestsPerSecond         float64     `json:"requests_per_second" bson:"requests_per_second"`
+	PromptTokensPerSecond     float64     `json:"prompt_tokens_per_second" bson:"prompt_tokens_per_second"`         // 每秒输入的 token 数
+	CompletionTokensPerSecond float64     `json:"completion_tokens_per_second" bson:"completion_tokens_per_second"` // 每秒输出的 token 数
+	TimeToFirstToken          Percentiles `json:"time_to_first_token" bson:"time_to_first_token"`                   // 首 token 延迟，单位毫秒
+	Latency                   Percentiles `json:"latency" bson:"latency"`                                           // 请求的端到端延迟，单位毫秒
+	QueueDepth                int         `json:"queue_depth" bson:"queue_depth"`                                   // 排队等待的请求数
+	Errors                    uint64      `json:"errors" bson:"errors"`                                             // 距上次上报失败的请求数
+	ContextLength             int         `json:"context_length" bson:"context_length"`                             // 模型的最大上下文长度
+}
+
+type Percentiles struct {
+	P50 float64 `json:"p50" bson:"p50"`
+	P90 float64 `json:"p90" bson:"p90"`
+	P99 float64 `json:"p99" bson:"p99"`
+}
+
+var (
+	ErrModelRequired  = errors.New("model name is required")
+	ErrDuplicateModel = errors.New("model is reported more than once")
+)
+
+// Validate checks that every model is named once.
+func (req *WsModelMetricsRequest) Validate() error {
+	seen := make(map[string]bool, len(req.Models))
+	for _, model := range req.Models {
+		if model.Model == "" {
+			return ErrModelRequired
+		}
+		if seen[model.Model] {
+			return ErrDuplicateModel
+		}
+		seen[model.Model] = true
+	}
+	return nil
 }
@@ -0,0 +1,76 @@
+package types
+
+import "testing"
+
+// go test -v -timeout 30s -count=1 -run TestMachineInfoNormalize health-monitoring/types
+func TestMachineInfoNormalize(t *testing.T) {
+	// The single GPU payload of version 0 is kept as is
+	req := WsMachineInfoRequest{GPUName: "NVIDIA RTX A5000", UtilizationGPU: 30, MemoryTotal: 24564, MemoryUsed: 1000}
+	if err := req.Normalize(0); err != nil || req.UtilizationGPU != 30 || req.MemoryTotal != 24564 {
+		t.Fatalf("unexpected version 0 request: %+v %v", req, err)
+	}
+	if err := req.Normalize(WsMachineInfoVersionGPUs); err != ErrGPUsRequired {
+		t.Fatalf("expect ErrGPUsRequired, got %v", err)
+	}
+
+	req = WsMachineInfoRequest{GPUs: []GPUInfo{
+		{Index: 0, Name: "NVIDIA RTX A5000", UtilizationGPU: 30, MemoryTotal: 24564, MemoryUsed: 1000},
+		{Index: 1, Name: "NVIDIA RTX A5000", UtilizationGPU: 45, MemoryTotal: 24564, MemoryUsed: 2000},
+	}}
+	if err := req.Normalize(WsMachineInfoVersionGPUs); err != nil {
+		t.Fatalf("Normalize failed: %v", err)
+	}
+	if req.UtilizationGPU != 38 || req.MemoryTotal != 49128 || req.MemoryUsed != 3000 || req.GPUName != "NVIDIA RTX A5000" {
+		t.Fatalf("unexpected summary of the GPUs: %+v", req)
+	}
+
+	req.GPUs[1].Index = 0
+	if err := req.Normalize(WsMachineInfoVersionGPUs); err != ErrInvalidGPUIndex {
+		t.Fatalf("expect ErrInvalidGPUIndex for duplicate index, got %v", err)
+	}
+	req.GPUs[1].Index = -1
+	if err := req.Normalize(WsMachineInfoVersionGPUs); err != ErrInvalidGPUIndex {
+		t.Fatalf("expect ErrInvalidGPUIndex for negative index, got %v", err)
+	}
+}
+
+// go test -v -timeout 30s -count=1 -run TestHostMetricsValidate health-monitoring/types
+func TestHostMetricsValidate(t *testing.T) {
+	req := WsHostMetricsRequest{
+		Disks:    []DiskUsage{{Mount: "/"}, {Mount: "/data"}},
+		Networks: []NetworkIO{{Interface: "eth0"}, {Interface: "eth1"}},
+	}
+	if err := req.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	cases := []struct {
+		req WsHostMetricsRequest
+		err error
+	}{
+		{WsHostMetricsRequest{Disks: []DiskUsage{{}}}, ErrMountRequired},
+		{WsHostMetricsRequest{Disks: []DiskUsage{{Mount: "/"}, {Mount: "/"}}}, ErrDuplicateMount},
+		{WsHostMetricsRequest{Networks: []NetworkIO{{}}}, ErrInterfaceRequired},
+		{WsHostMetricsRequest{Networks: []NetworkIO{{Interface: "eth0"}, {Interface: "eth0"}}}, ErrDuplicateInterface},
+	}
+	for _, c := range cases {
+		if err := c.req.Validate(); err != c.err {
+			t.Fatalf("expect %v of %+v, got %v", c.err, c.req, err)
+		}
+	}
+}
+
+// go test -v -timeout 30s -count=1 -run TestModelMetricsValidate health-monitoring/types
+func TestModelMetricsValidate(t *testing.T) {
+	req := WsModelMetricsRequest{Models: []ModelServingMetrics{{Model: "Llama3-70B"}, {Model: "Qwen2-72B"}}}
+	if err := req.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	req.Models = append(req.Models, ModelServingMetrics{Model: "Llama3-70B"})
+	if err := req.Validate(); err != ErrDuplicateModel {
+		t.Fatalf("expect ErrDuplicateModel, got %v", err)
+	}
+	req.Models = []ModelServingMetrics{{}}
+	if err := req.Validate(); err != ErrModelRequired {
+		t.Fatalf("expect ErrModelRequired, got %v", err)
+	}
+}
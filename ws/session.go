@@ -0,0 +1,115 @@
+package ws
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"health-monitoring/db"
+	"health-monitoring/log"
+	"health-monitoring/types"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Close code sent to the old connection of a device taken over by a new connection.
+	closeCodeTakenOver = 4001
+
+	// Period to check whether the local sessions are taken over by other instances.
+	takeoverCheckPeriod = 5 * time.Second
+)
+
+var (
+	// conns are the connections being served, including the ones not online yet, and
+	// handlers counts their handlers, so that Shutdown can close them and wait.
+	conns    sync.Map // *websocket.Conn -> struct{}
+	handlers sync.WaitGroup
+)
+
+// Shutdown kicks the online sessions of this instance, closes the connections not online
+// yet, and waits until their handlers have set the devices offline or the context is done.
+// srv.Shutdown does not wait for the hijacked connections, so it must be called before the
+// store is disconnected.
+func Shutdown(ctx context.Context, od *types.OnlineDevices) error {
+	od.Range(func(device types.OnlineDevice) bool {
+		if device.Kick != nil {
+			device.Kick("server shutting down")
+		}
+		return true
+	})
+	conns.Range(func(key, value any) bool {
+		key.(*websocket.Conn).Close()
+		return true
+	})
+
+	done := make(chan struct{})
+	go func() {
+		handlers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// kick closes the connection of the session with a close message telling why, the read
+// loop of the session then fails and cleans up. It is called from other goroutines, so
+// the node id is passed in instead of read from the session owned by the read loop.
+func (session *wsSession) kick(nodeId, reason string) {
+	log.Log.WithFields(logrus.Fields{
+		"node_id": nodeId,
+		"session": session.id,
+	}).Info("kick session: ", reason)
+	session.conn.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(closeCodeTakenOver, reason),
+		time.Now().Add(writeWait),
+	)
+	session.conn.Close()
+}
+
+// WatchTakeover periodically kicks the local sessions whose devices have been taken over
+// by connections on other instances or revoked, until the context is done.
+func WatchTakeover(ctx context.Context, store db.Store, od *types.OnlineDevices) {
+	ticker := time.NewTicker(takeoverCheckPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			checkTakeover(ctx, store, od)
+		}
+	}
+}
+
+// checkTakeover kicks the local sessions which no longer own the online record of their
+// device. The record is replaced when the device is taken over, and deleted when it is
+// revoked by any instance.
+func checkTakeover(ctx context.Context, store db.Store, od *types.OnlineDevices) {
+	devices := od.List()
+	if len(devices) == 0 {
+		return
+	}
+	ids := make([]string, 0, len(devices))
+	for _, device := range devices {
+		ids = append(ids, device.Session)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	owned, err := store.OwnedSessions(ctx, ids)
+	cancel()
+	if err != nil {
+		return
+	}
+	for _, device := range devices {
+		if !owned[device.Session] {
+			device.Kick("session taken over by a new connection or device revoked")
+		}
+	}
+}
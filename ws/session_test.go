@@ -0,0 +1,92 @@
+package ws
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"health-monitoring/db"
+	"health-monitoring/types"
+
+	"github.com/gorilla/websocket"
+)
+
+// go test -v -timeout 30s -count=1 -run TestCheckTakeoverRevoked health-monitoring/ws
+func TestCheckTakeoverRevoked(t *testing.T) {
+	ctx := context.Background()
+	store := db.NewMemoryDB(time.Hour, "test")
+	od := types.NewOnlineDevices()
+	key := bytes.Repeat([]byte{1}, ed25519.PublicKeySize)
+	if err := store.RegisterDevice(ctx, types.MDBDeviceRegistry{DeviceId: "node1", PubKey: key}); err != nil {
+		t.Fatalf("RegisterDevice failed: %v", err)
+	}
+	if err := store.NodeOnline(ctx, "node1", "session1", key); err != nil {
+		t.Fatalf("NodeOnline failed: %v", err)
+	}
+	kicked := ""
+	od.SetDevice(types.OnlineDevice{NodeId: "node1", Session: "session1", Kick: func(reason string) { kicked = reason }})
+
+	checkTakeover(ctx, store, od)
+	if kicked != "" {
+		t.Fatalf("expect the owning session kept, kicked for %q", kicked)
+	}
+
+	// Revoked through another instance, only the record in the store is changed
+	if err := store.RevokeDevice(ctx, "node1"); err != nil {
+		t.Fatalf("RevokeDevice failed: %v", err)
+	}
+	checkTakeover(ctx, store, od)
+	if kicked == "" {
+		t.Fatal("expect the session of the revoked device kicked")
+	}
+}
+
+// go test -v -timeout 30s -count=1 -run TestCheckTakeoverKick health-monitoring/ws
+func TestCheckTakeoverKick(t *testing.T) {
+	ctx := context.Background()
+	store := db.NewMemoryDB(time.Hour, "test")
+	od := types.NewOnlineDevices()
+
+	// The server side of the connection comes online as session1
+	online := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("Upgrade failed: %v", err)
+			return
+		}
+		session := &wsSession{id: "session1", conn: c, connectTime: time.Now(), nodeId: "node1"}
+		if _, err := store.TakeoverNodeOnline(ctx, "node1", session.id, nil, false); err != nil {
+			t.Errorf("TakeoverNodeOnline failed: %v", err)
+		}
+		od.SetDevice(types.OnlineDevice{NodeId: "node1", Session: session.id, Kick: func(reason string) {
+			session.kick("node1", reason)
+		}})
+		close(online)
+	}))
+	defer srv.Close()
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer client.Close()
+	<-online
+
+	// A connection on another instance takes over the device, the local one is closed with 4001
+	if _, err := store.TakeoverNodeOnline(ctx, "node1", "session2", nil, false); err != nil {
+		t.Fatalf("TakeoverNodeOnline failed: %v", err)
+	}
+	checkTakeover(ctx, store, od)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = client.ReadMessage()
+	closeErr := &websocket.CloseError{}
+	if !errors.As(err, &closeErr) || closeErr.Code != closeCodeTakenOver {
+		t.Fatalf("expect close code %v, got %v", closeCodeTakenOver, err)
+	}
+}
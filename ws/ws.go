@@ -1,8 +1,16 @@
 package ws
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"health-monitoring/db"
@@ -40,32 +48,163 @@ const (
 	pingPeriod = (pongWait * 9) / 10
 )
 
-func Ws(ctx *gin.Context, pm *hmp.PrometheusMetrics) {
+// connectionCount is the number of WebSocket connections of this instance, including the
+// ones not online yet.
+var connectionCount atomic.Int64
+
+func ConnectionCount() int64 {
+	return connectionCount.Load()
+}
+
+const (
+	// defaultTimestampSkew is the maximum difference allowed between the timestamp of a
+	// request and the clock of the server by default.
+	defaultTimestampSkew = 5 * time.Minute
+)
+
+// Options are the settings of the WebSocket service, the zero value is usable: responses
+// are not signed, unknown devices and custom metrics are refused, the default skew is
+// allowed and a device online with another session is rejected.
+type Options struct {
+	ServerKey      ed25519.PrivateKey // 签名每个应答，为空时不签名
+	AutoRegister   bool               // 允许未登记的设备在第一次上线时自动登记
+	CustomMetrics  *hmp.CustomMetrics // 检查并导出自定义指标，为 nil 时拒绝自定义指标
+	TimestampSkew  time.Duration      // 请求时间戳与服务器时钟的最大误差，为 0 时使用默认值
+	TakeoverPolicy string             // 设备仍然在线时又建立新连接的处理策略，为空时为 reject
+}
+
+// Validate checks the takeover policy.
+func (opts *Options) Validate() error {
+	switch opts.TakeoverPolicy {
+	case "", types.TakeoverReject, types.TakeoverKick, types.TakeoverSameKey:
+		return nil
+	}
+	return fmt.Errorf("unknown takeover policy %q", opts.TakeoverPolicy)
+}
+
+func (opts *Options) timestampSkew() time.Duration {
+	if opts.TimestampSkew <= 0 {
+		return defaultTimestampSkew
+	}
+	return opts.TimestampSkew
+}
+
+func (opts *Options) takeoverPolicy() string {
+	if opts.TakeoverPolicy == "" {
+		return types.TakeoverReject
+	}
+	return opts.TakeoverPolicy
+}
+
+var (
+	errTimestampSkew = errors.New("timestamp of request is out of the allowed skew window")
+	errRepeatedId    = errors.New("id of request has been seen or is too old")
+	errNonceMismatch = errors.New("nonce does not match the challenge")
+)
+
+// wsSession is the state of one websocket connection.
+type wsSession struct {
+	opts        Options
+	id          string // 连接的唯一标识
+	conn        *websocket.Conn
+	connectTime time.Time
+	nodeId      string
+	pubKey      []byte   // 上线时绑定的公钥，之后的请求必须使用同一个公钥签名
+	nonce       []byte   // 连接建立后下发的挑战随机数，上线请求必须携带
+	ids         idWindow // 已经收到的请求 ID，重复或者过旧的 ID 被拒绝
+}
+
+// Ws serves one WebSocket connection of a device with the options.
+func Ws(ctx *gin.Context, store db.Store, pm *hmp.PrometheusMetrics, od *types.OnlineDevices, opts Options) {
 	w, r := ctx.Writer, ctx.Request
-	var nodeId string
 	c, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		http.Error(w, "Upgrade to websocket failed", http.StatusUpgradeRequired)
 		log.Log.Error("Upgrade to websocket failed: ", err)
 		return
 	}
+	session := &wsSession{opts: opts, conn: c, connectTime: time.Now()}
+	handlers.Add(1)
+	defer handlers.Done()
+	conns.Store(c, struct{}{})
+	defer conns.Delete(c)
+	connectionCount.Add(1)
+	defer connectionCount.Add(-1)
+	pm.ConnectionOpened()
+	defer pm.ConnectionClosed()
 	defer func() {
-		if nodeId != "" {
-			db.MDB.NodeOffline(r.Context(), nodeId)
-			pm.DeleteMetrics(nodeId)
+		if session.nodeId != "" {
+			store.NodeOffline(r.Context(), session.nodeId, session.id)
+			// The metrics belong to the new session if the node was taken over on this instance
+			if od.RemoveDevice(session.nodeId, session.id) {
+				pm.DeleteMetrics(session.nodeId)
+				if opts.CustomMetrics != nil {
+					opts.CustomMetrics.Delete(session.nodeId)
+				}
+			}
 		}
 		log.Log.WithFields(logrus.Fields{
-			"node_id": nodeId,
+			"node_id": session.nodeId,
 		}).Info("connection stopped")
 		c.Close()
 	}()
 
+	sessionId := make([]byte, 16)
+	session.nonce = make([]byte, 32)
+	if _, err := rand.Read(sessionId); err != nil {
+		log.Log.Error("generate session id failed: ", err)
+		return
+	}
+	session.id = hex.EncodeToString(sessionId)
+	if _, err := rand.Read(session.nonce); err != nil {
+		log.Log.Error("generate challenge nonce failed: ", err)
+		return
+	}
+	challenge, _ := json.Marshal(types.WsChallenge{Nonce: session.nonce})
+	if err := session.writeResponse(pm, session.nodeId, &types.WsResponse{
+		WsHeader: types.WsHeader{
+			Version:   0,
+			Timestamp: time.Now().Unix(),
+			Id:        0,
+			Type:      uint32(types.WsMtChallenge),
+			PubKey:    []byte(""),
+			Sign:      []byte(""),
+		},
+		Code:    0,
+		Message: "challenge",
+		Body:    challenge,
+	}); err != nil {
+		return
+	}
+
+	// The lease is renewed out of the read loop, so that a slow database does not delay
+	// reading the messages past pongWait
+	leases := make(chan string, 1)
+	defer close(leases)
+	handlers.Add(1)
+	go func() {
+		defer handlers.Done()
+		for nodeId := range leases {
+			ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+			store.RefreshNodeOnline(ctx, nodeId, session.id)
+			cancel()
+		}
+	}()
+
 	c.SetReadDeadline(time.Now().Add(pongWait))
 	c.SetPingHandler(func(appData string) error {
 		c.SetReadDeadline(time.Now().Add(pongWait))
+		pm.PingReceived()
 		log.Log.WithFields(logrus.Fields{
-			"node_id": nodeId,
+			"node_id": session.nodeId,
 		}).Info("ping handler")
+		if session.nodeId != "" {
+			select {
+			case leases <- session.nodeId:
+			default:
+				// The previous renewal is still pending, the lease is much longer than the ping period
+			}
+		}
 		return nil
 	})
 
@@ -73,20 +212,26 @@ func Ws(ctx *gin.Context, pm *hmp.PrometheusMetrics) {
 		mt, message, err := c.ReadMessage()
 		if err != nil {
 			log.Log.WithFields(logrus.Fields{
-				"node_id": nodeId,
+				"node_id": session.nodeId,
 			}).Info("read: ", err)
 			break
 		}
 		log.Log.WithFields(logrus.Fields{
-			"node_id": nodeId,
+			"node_id": session.nodeId,
 		}).Infof("recv message: %v %s", mt, message)
+		if session.nodeId != "" {
+			od.UpdateDevice(session.nodeId, session.id, func(device *types.OnlineDevice) {
+				device.LastMessageTime = time.Now()
+			})
+		}
 
 		req := &types.WsRequest{}
 		if err := json.Unmarshal(message, req); err != nil {
 			log.Log.WithFields(logrus.Fields{
-				"node_id": nodeId,
+				"node_id": session.nodeId,
 			}).Error("parse request failed: ", err)
-			writeWsResponse(c, nodeId, &types.WsResponse{
+			pm.ParseFailed(0)
+			session.writeResponse(pm, session.nodeId, &types.WsResponse{
 				WsHeader: types.WsHeader{
 					Version:   0,
 					Timestamp: time.Now().Unix(),
@@ -102,11 +247,117 @@ func Ws(ctx *gin.Context, pm *hmp.PrometheusMetrics) {
 			continue
 		}
 
-		handleWsRequest(r.Context(), c, &nodeId, req, pm)
+		if err := verifyWsRequest(session, req, time.Now()); err != nil {
+			code, message := types.ErrCodeSign, "verify request signature failed"
+			if errors.Is(err, errTimestampSkew) || errors.Is(err, errRepeatedId) {
+				code, message = types.ErrCodeReplay, err.Error()
+			}
+			log.Log.WithFields(logrus.Fields{
+				"node_id": session.nodeId,
+			}).Error("verify request failed: ", err)
+			session.writeResponse(pm, session.nodeId, &types.WsResponse{
+				WsHeader: types.WsHeader{
+					Version:   0,
+					Timestamp: time.Now().Unix(),
+					Id:        req.Id,
+					Type:      req.Type,
+					PubKey:    []byte(""),
+					Sign:      []byte(""),
+				},
+				Code:    uint32(code),
+				Message: message,
+				Body:    []byte(""),
+			})
+			continue
+		}
+
+		start := time.Now()
+		handleWsRequest(r.Context(), c, session, req, store, pm, od)
+		pm.ObserveHandler(types.WsMessageType(req.Type), time.Since(start))
+	}
+}
+
+// verifyWsRequest checks the signature of the request, and once the device is online,
+// that the request is signed by the public key bound to the device. Requests with a
+// timestamp out of the skew window around now or an id already seen on the connection
+// are rejected as replays.
+func verifyWsRequest(session *wsSession, req *types.WsRequest, now time.Time) error {
+	if err := req.Verify(); err != nil {
+		return err
+	}
+	if session.nodeId != "" && !bytes.Equal(session.pubKey, req.PubKey) {
+		return db.ErrPubKeyMismatch
+	}
+	skew := now.Sub(time.UnixMilli(req.Timestamp))
+	if limit := session.opts.timestampSkew(); skew > limit || skew < -limit {
+		return errTimestampSkew
+	}
+	if !session.ids.accept(req.Id) {
+		return errRepeatedId
 	}
+	return nil
 }
 
-func writeWsResponse(c *websocket.Conn, nodeId string, res *types.WsResponse) error {
+// idWindowSize is the number of ids below the largest one seen on a connection which are
+// still accepted, so that requests sent concurrently may arrive out of order.
+const idWindowSize = 1024
+
+// idWindow tracks the ids of the requests seen on a connection like the anti-replay window
+// of IPsec: an id is accepted once if it is within idWindowSize of the largest id seen.
+type idWindow struct {
+	hasId bool
+	max   uint64
+	seen  [idWindowSize / 64]uint64 // bit id%idWindowSize is set if the id has been seen
+}
+
+// accept reports whether the id has not been seen and is not too old, and records it.
+func (w *idWindow) accept(id uint64) bool {
+	if !w.hasId {
+		w.hasId = true
+		w.max = id
+		w.set(id)
+		return true
+	}
+	if id > w.max {
+		// Forget the ids which leave the window
+		if id-w.max >= idWindowSize {
+			w.seen = [idWindowSize / 64]uint64{}
+		} else {
+			for i := w.max + 1; i <= id; i++ {
+				w.seen[i%idWindowSize/64] &^= 1 << (i % 64)
+			}
+		}
+		w.max = id
+		w.set(id)
+		return true
+	}
+	if w.max-id >= idWindowSize || w.seen[id%idWindowSize/64]&(1<<(id%64)) != 0 {
+		return false
+	}
+	w.set(id)
+	return true
+}
+
+func (w *idWindow) set(id uint64) {
+	w.seen[id%idWindowSize/64] |= 1 << (id % 64)
+}
+
+// verifyChallenge checks that the online request carries the nonce of the challenge sent
+// on this connection, so that a recorded online request cannot be replayed on another one.
+func verifyChallenge(session *wsSession, onlineReq *types.WsOnlineRequest) error {
+	if len(session.nonce) == 0 || !bytes.Equal(onlineReq.Nonce, session.nonce) {
+		return errNonceMismatch
+	}
+	return nil
+}
+
+// writeResponse signs the response with the key of the server if there is one and sends it.
+func (session *wsSession) writeResponse(pm *hmp.PrometheusMetrics, nodeId string, res *types.WsResponse) error {
+	c := session.conn
+	pm.ObserveResponse(types.WsMessageType(res.Type), res.Code)
+	if len(session.opts.ServerKey) != 0 {
+		res.SignWith(session.opts.ServerKey)
+	}
 	resBytes, err := json.Marshal(res)
 	if err != nil {
 		log.Log.WithFields(logrus.Fields{
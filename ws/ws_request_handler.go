@@ -3,6 +3,8 @@ package ws
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"time"
 
 	"health-monitoring/db"
@@ -14,17 +16,28 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-func handleWsRequest(ctx context.Context, c *websocket.Conn, nodeId *string, req *types.WsRequest, pm *hmp.PrometheusMetrics) error {
+func handleWsRequest(ctx context.Context, c *websocket.Conn, session *wsSession, req *types.WsRequest, store db.Store, pm *hmp.PrometheusMetrics, od *types.OnlineDevices) error {
+	if session.nodeId != "" {
+		od.UpdateDevice(session.nodeId, session.id, func(device *types.OnlineDevice) {
+			device.Version = req.Version
+		})
+	}
 	switch req.Type {
 	case uint32(types.WsMtOnline):
-		handleWsOnlineRequest(ctx, c, nodeId, req, pm)
+		handleWsOnlineRequest(ctx, c, session, req, store, pm, od)
 	case uint32(types.WsMtMachineInfo):
-		handleWsMachineInfoRequest(ctx, c, *nodeId, req, pm)
+		handleWsMachineInfoRequest(ctx, c, session, req, store, pm, od)
+	case uint32(types.WsMtHostMetrics):
+		handleWsHostMetricsRequest(ctx, c, session, req, store, pm)
+	case uint32(types.WsMtCustomMetrics):
+		handleWsCustomMetricsRequest(ctx, c, session, req, store, pm)
+	case uint32(types.WsMtModelMetrics):
+		handleWsModelMetricsRequest(ctx, c, session, req, store, pm)
 	default:
 		log.Log.WithFields(logrus.Fields{
-			"node_id": *nodeId,
+			"node_id": session.nodeId,
 		}).Error("unknowned request message type")
-		writeWsResponse(c, *nodeId, &types.WsResponse{
+		session.writeResponse(pm, session.nodeId, &types.WsResponse{
 			WsHeader: types.WsHeader{
 				Version:   0,
 				Timestamp: time.Now().Unix(),
@@ -41,9 +54,9 @@ func handleWsRequest(ctx context.Context, c *websocket.Conn, nodeId *string, req
 	return nil
 }
 
-func handleWsOnlineRequest(ctx context.Context, c *websocket.Conn, nodeId *string, req *types.WsRequest, pm *hmp.PrometheusMetrics) error {
-	if *nodeId != "" {
-		writeWsResponse(c, *nodeId, &types.WsResponse{
+func handleWsOnlineRequest(ctx context.Context, c *websocket.Conn, session *wsSession, req *types.WsRequest, store db.Store, pm *hmp.PrometheusMetrics, od *types.OnlineDevices) error {
+	if session.nodeId != "" {
+		session.writeResponse(pm, session.nodeId, &types.WsResponse{
 			WsHeader: types.WsHeader{
 				Version:   0,
 				Timestamp: time.Now().Unix(),
@@ -57,7 +70,7 @@ func handleWsOnlineRequest(ctx context.Context, c *websocket.Conn, nodeId *strin
 			Body:    []byte(""),
 		})
 		log.Log.WithFields(logrus.Fields{
-			"node_id": *nodeId,
+			"node_id": session.nodeId,
 		}).Error("device has been online, repeated requests")
 		return nil
 	}
@@ -65,9 +78,10 @@ func handleWsOnlineRequest(ctx context.Context, c *websocket.Conn, nodeId *strin
 	onlineReq := &types.WsOnlineRequest{}
 	if err := json.Unmarshal(req.Body, onlineReq); err != nil {
 		log.Log.WithFields(logrus.Fields{
-			"node_id": *nodeId,
+			"node_id": session.nodeId,
 		}).Error("parse online request failed: ", err)
-		writeWsResponse(c, *nodeId, &types.WsResponse{
+		pm.ParseFailed(types.WsMtOnline)
+		session.writeResponse(pm, session.nodeId, &types.WsResponse{
 			WsHeader: types.WsHeader{
 				Version:   0,
 				Timestamp: time.Now().Unix(),
@@ -83,10 +97,40 @@ func handleWsOnlineRequest(ctx context.Context, c *websocket.Conn, nodeId *strin
 		return nil
 	}
 
+	if err := verifyChallenge(session, onlineReq); err != nil {
+		log.Log.WithFields(logrus.Fields{
+			"node_id": onlineReq.NodeId,
+		}).Error("verify online request failed: ", err)
+		session.writeResponse(pm, onlineReq.NodeId, &types.WsResponse{
+			WsHeader: types.WsHeader{
+				Version:   0,
+				Timestamp: time.Now().Unix(),
+				Id:        req.Id,
+				Type:      req.Type,
+				PubKey:    []byte(""),
+				Sign:      []byte(""),
+			},
+			Code:    uint32(types.ErrCodeReplay),
+			Message: err.Error(),
+			Body:    []byte(""),
+		})
+		return nil
+	}
+
 	ctx1, cancel1 := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel1()
-	if db.MDB.IsNodeOnline(ctx1, onlineReq.NodeId) {
-		writeWsResponse(c, onlineReq.NodeId, &types.WsResponse{
+	if err := store.VerifyDevice(ctx1, onlineReq.NodeId, req.PubKey, session.opts.AutoRegister); err != nil {
+		code, message := types.ErrCodeDatabase, "query device registry failed"
+		if errors.Is(err, db.ErrPubKeyMismatch) {
+			code, message = types.ErrCodeSign, "public key does not match the device"
+		} else if errors.Is(err, db.ErrDeviceNotRegistered) {
+			code, message = types.ErrCodeRegistry, "device is not registered"
+		} else if errors.Is(err, db.ErrDeviceRevoked) {
+			code, message = types.ErrCodeRegistry, "device has been revoked"
+		} else if errors.Is(err, db.ErrStoreUnavailable) {
+			code, message = types.ErrCodeUnavailable, "database is temporarily unavailable, try again later"
+		}
+		session.writeResponse(pm, onlineReq.NodeId, &types.WsResponse{
 			WsHeader: types.WsHeader{
 				Version:   0,
 				Timestamp: time.Now().Unix(),
@@ -95,20 +139,33 @@ func handleWsOnlineRequest(ctx context.Context, c *websocket.Conn, nodeId *strin
 				PubKey:    []byte(""),
 				Sign:      []byte(""),
 			},
-			Code:    uint32(types.ErrCodeOnline),
-			Message: "device has been online, repeated connection",
+			Code:    uint32(code),
+			Message: message,
 			Body:    []byte(""),
 		})
 		log.Log.WithFields(logrus.Fields{
 			"node_id": onlineReq.NodeId,
-		}).Error("device has been online, repeated connection")
+		}).Error(message)
 		return nil
 	}
 
 	ctx2, cancel2 := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel2()
-	if err := db.MDB.NodeOnline(ctx2, onlineReq.NodeId); err != nil {
-		writeWsResponse(c, onlineReq.NodeId, &types.WsResponse{
+	var err error
+	policy := session.opts.takeoverPolicy()
+	if policy == types.TakeoverReject {
+		err = store.NodeOnline(ctx2, onlineReq.NodeId, session.id, req.PubKey)
+	} else {
+		_, err = store.TakeoverNodeOnline(ctx2, onlineReq.NodeId, session.id, req.PubKey, policy == types.TakeoverSameKey)
+	}
+	if err != nil {
+		code, message := types.ErrCodeDatabase, "insert online database failed"
+		if errors.Is(err, db.ErrNodeAlreadyOnline) {
+			code, message = types.ErrCodeOnline, "device has been online, repeated connection"
+		} else if errors.Is(err, db.ErrStoreUnavailable) {
+			code, message = types.ErrCodeUnavailable, "database is temporarily unavailable, try again later"
+		}
+		session.writeResponse(pm, onlineReq.NodeId, &types.WsResponse{
 			WsHeader: types.WsHeader{
 				Version:   0,
 				Timestamp: time.Now().Unix(),
@@ -117,15 +174,34 @@ func handleWsOnlineRequest(ctx context.Context, c *websocket.Conn, nodeId *strin
 				PubKey:    []byte(""),
 				Sign:      []byte(""),
 			},
-			Code:    uint32(types.ErrCodeDatabase),
-			Message: "insert online database failed",
+			Code:    uint32(code),
+			Message: message,
 			Body:    []byte(""),
 		})
+		log.Log.WithFields(logrus.Fields{
+			"node_id": onlineReq.NodeId,
+		}).Error(message)
 		return nil
 	}
 
-	*nodeId = onlineReq.NodeId
-	writeWsResponse(c, *nodeId, &types.WsResponse{
+	session.nodeId = onlineReq.NodeId
+	session.pubKey = req.PubKey
+	// The old session on this instance is kicked at once, those on other instances are
+	// kicked by WatchTakeover
+	if old, ok := od.SetDevice(types.OnlineDevice{
+		NodeId:          session.nodeId,
+		Session:         session.id,
+		RemoteAddr:      c.RemoteAddr().String(),
+		ConnectTime:     session.connectTime,
+		LastMessageTime: time.Now(),
+		Version:         req.Version,
+		Kick: func(reason string) {
+			session.kick(onlineReq.NodeId, reason)
+		},
+	}); ok {
+		old.Kick("session taken over by a new connection")
+	}
+	session.writeResponse(pm, session.nodeId, &types.WsResponse{
 		WsHeader: types.WsHeader{
 			Version:   0,
 			Timestamp: time.Now().Unix(),
@@ -141,12 +217,13 @@ func handleWsOnlineRequest(ctx context.Context, c *websocket.Conn, nodeId *strin
 	return nil
 }
 
-func handleWsMachineInfoRequest(ctx context.Context, c *websocket.Conn, nodeId string, req *types.WsRequest, pm *hmp.PrometheusMetrics) error {
+func handleWsMachineInfoRequest(ctx context.Context, c *websocket.Conn, session *wsSession, req *types.WsRequest, store db.Store, pm *hmp.PrometheusMetrics, od *types.OnlineDevices) error {
+	nodeId := session.nodeId
 	if nodeId == "" {
 		log.Log.WithFields(logrus.Fields{
 			"node_id": nodeId,
 		}).Error("node id is empty, need online device first")
-		writeWsResponse(c, nodeId, &types.WsResponse{
+		session.writeResponse(pm, nodeId, &types.WsResponse{
 			WsHeader: types.WsHeader{
 				Version:   0,
 				Timestamp: time.Now().Unix(),
@@ -167,7 +244,8 @@ func handleWsMachineInfoRequest(ctx context.Context, c *websocket.Conn, nodeId s
 		log.Log.WithFields(logrus.Fields{
 			"node_id": nodeId,
 		}).Error("parse machine info request failed: ", err)
-		writeWsResponse(c, nodeId, &types.WsResponse{
+		pm.ParseFailed(types.WsMtMachineInfo)
+		session.writeResponse(pm, nodeId, &types.WsResponse{
 			WsHeader: types.WsHeader{
 				Version:   0,
 				Timestamp: time.Now().Unix(),
@@ -182,11 +260,35 @@ func handleWsMachineInfoRequest(ctx context.Context, c *websocket.Conn, nodeId s
 		})
 		return nil
 	}
+	if err := miReq.Normalize(req.Version); err != nil {
+		log.Log.WithFields(logrus.Fields{
+			"node_id": nodeId,
+		}).Error("invalid machine info request: ", err)
+		pm.ParseFailed(types.WsMtMachineInfo)
+		session.writeResponse(pm, nodeId, &types.WsResponse{
+			WsHeader: types.WsHeader{
+				Version:   0,
+				Timestamp: time.Now().Unix(),
+				Id:        req.Id,
+				Type:      req.Type,
+				PubKey:    []byte(""),
+				Sign:      []byte(""),
+			},
+			Code:    uint32(types.ErrCodeParam),
+			Message: err.Error(),
+			Body:    []byte(""),
+		})
+		return nil
+	}
 
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
-	if err := db.MDB.AddDeviceInfo(ctx, nodeId, time.UnixMilli(req.Timestamp), miReq); err != nil {
-		writeWsResponse(c, nodeId, &types.WsResponse{
+	if err := store.AddDeviceInfo(ctx, nodeId, time.UnixMilli(req.Timestamp), miReq); err != nil {
+		code, message := storeError(err)
+		log.Log.WithFields(logrus.Fields{
+			"node_id": nodeId,
+		}).Error("add machine info failed: ", err)
+		session.writeResponse(pm, nodeId, &types.WsResponse{
 			WsHeader: types.WsHeader{
 				Version:   0,
 				Timestamp: time.Now().Unix(),
@@ -195,18 +297,328 @@ func handleWsMachineInfoRequest(ctx context.Context, c *websocket.Conn, nodeId s
 				PubKey:    []byte(""),
 				Sign:      []byte(""),
 			},
-			Code:    uint32(types.ErrCodeDatabase),
-			Message: "update database failed",
+			Code:    uint32(code),
+			Message: message,
 			Body:    []byte(""),
 		})
 		return nil
 	}
 
 	pm.SetMetrics(nodeId, miReq)
+	od.UpdateDevice(nodeId, session.id, func(device *types.OnlineDevice) {
+		device.MachineInfo = &miReq
+		device.MachineInfoTime = time.UnixMilli(req.Timestamp)
+	})
 	log.Log.WithFields(logrus.Fields{
 		"node_id": nodeId,
 	}).WithField("machine info", miReq).Info("update machine info")
-	writeWsResponse(c, nodeId, &types.WsResponse{
+	session.writeResponse(pm, nodeId, &types.WsResponse{
+		WsHeader: types.WsHeader{
+			Version:   0,
+			Timestamp: time.Now().Unix(),
+			Id:        req.Id,
+			Type:      req.Type,
+			PubKey:    []byte(""),
+			Sign:      []byte(""),
+		},
+		Code:    0,
+		Message: "ok",
+		Body:    []byte(""),
+	})
+	return nil
+}
+
+// storeError returns the code and the message responded to the device when a sample
+// could not be written.
+func storeError(err error) (types.ErrorCode, string) {
+	switch {
+	case errors.Is(err, db.ErrStoreUnavailable):
+		return types.ErrCodeUnavailable, "database is temporarily unavailable, try again later"
+	case errors.Is(err, db.ErrWriteQueueFull):
+		return types.ErrCodeDatabase, "write queue is full, try again later"
+	case errors.Is(err, db.ErrNotConfirmed):
+		return types.ErrCodeDatabase, "machine info is queued but not written in time"
+	case errors.Is(err, db.ErrSpoolFull):
+		return types.ErrCodeUnavailable, "database is unavailable and spool is full, try again later"
+	default:
+		return types.ErrCodeDatabase, "update database failed"
+	}
+}
+
+func handleWsHostMetricsRequest(ctx context.Context, c *websocket.Conn, session *wsSession, req *types.WsRequest, store db.Store, pm *hmp.PrometheusMetrics) error {
+	nodeId := session.nodeId
+	if nodeId == "" {
+		log.Log.WithFields(logrus.Fields{
+			"node_id": nodeId,
+		}).Error("node id is empty, need online device first")
+		session.writeResponse(pm, nodeId, &types.WsResponse{
+			WsHeader: types.WsHeader{
+				Version:   0,
+				Timestamp: time.Now().Unix(),
+				Id:        req.Id,
+				Type:      req.Type,
+				PubKey:    []byte(""),
+				Sign:      []byte(""),
+			},
+			Code:    uint32(types.ErrCodeMachineInfo),
+			Message: "node id is empty, need send online device first",
+			Body:    []byte(""),
+		})
+		return nil
+	}
+
+	hmReq := types.WsHostMetricsRequest{}
+	err := json.Unmarshal(req.Body, &hmReq)
+	if err == nil {
+		err = hmReq.Validate()
+	}
+	if err != nil {
+		log.Log.WithFields(logrus.Fields{
+			"node_id": nodeId,
+		}).Error("parse host metrics request failed: ", err)
+		pm.ParseFailed(types.WsMtHostMetrics)
+		session.writeResponse(pm, nodeId, &types.WsResponse{
+			WsHeader: types.WsHeader{
+				Version:   0,
+				Timestamp: time.Now().Unix(),
+				Id:        req.Id,
+				Type:      req.Type,
+				PubKey:    []byte(""),
+				Sign:      []byte(""),
+			},
+			Code:    uint32(types.ErrCodeParam),
+			Message: "parse host metrics request failed",
+			Body:    []byte(""),
+		})
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := store.AddHostMetrics(ctx, nodeId, time.UnixMilli(req.Timestamp), hmReq); err != nil {
+		code, message := storeError(err)
+		log.Log.WithFields(logrus.Fields{
+			"node_id": nodeId,
+		}).Error("add host metrics failed: ", err)
+		session.writeResponse(pm, nodeId, &types.WsResponse{
+			WsHeader: types.WsHeader{
+				Version:   0,
+				Timestamp: time.Now().Unix(),
+				Id:        req.Id,
+				Type:      req.Type,
+				PubKey:    []byte(""),
+				Sign:      []byte(""),
+			},
+			Code:    uint32(code),
+			Message: message,
+			Body:    []byte(""),
+		})
+		return nil
+	}
+
+	pm.SetHostMetrics(nodeId, hmReq)
+	log.Log.WithFields(logrus.Fields{
+		"node_id": nodeId,
+	}).WithField("host metrics", hmReq).Info("update host metrics")
+	session.writeResponse(pm, nodeId, &types.WsResponse{
+		WsHeader: types.WsHeader{
+			Version:   0,
+			Timestamp: time.Now().Unix(),
+			Id:        req.Id,
+			Type:      req.Type,
+			PubKey:    []byte(""),
+			Sign:      []byte(""),
+		},
+		Code:    0,
+		Message: "ok",
+		Body:    []byte(""),
+	})
+	return nil
+}
+
+func handleWsCustomMetricsRequest(ctx context.Context, c *websocket.Conn, session *wsSession, req *types.WsRequest, store db.Store, pm *hmp.PrometheusMetrics) error {
+	nodeId := session.nodeId
+	if nodeId == "" {
+		log.Log.WithFields(logrus.Fields{
+			"node_id": nodeId,
+		}).Error("node id is empty, need online device first")
+		session.writeResponse(pm, nodeId, &types.WsResponse{
+			WsHeader: types.WsHeader{
+				Version:   0,
+				Timestamp: time.Now().Unix(),
+				Id:        req.Id,
+				Type:      req.Type,
+				PubKey:    []byte(""),
+				Sign:      []byte(""),
+			},
+			Code:    uint32(types.ErrCodeMachineInfo),
+			Message: "node id is empty, need send online device first",
+			Body:    []byte(""),
+		})
+		return nil
+	}
+
+	cmReq := types.WsCustomMetricsRequest{}
+	if err := json.Unmarshal(req.Body, &cmReq); err != nil {
+		log.Log.WithFields(logrus.Fields{
+			"node_id": nodeId,
+		}).Error("parse custom metrics request failed: ", err)
+		pm.ParseFailed(types.WsMtCustomMetrics)
+		session.writeResponse(pm, nodeId, &types.WsResponse{
+			WsHeader: types.WsHeader{
+				Version:   0,
+				Timestamp: time.Now().Unix(),
+				Id:        req.Id,
+				Type:      req.Type,
+				PubKey:    []byte(""),
+				Sign:      []byte(""),
+			},
+			Code:    uint32(types.ErrCodeParam),
+			Message: "parse custom metrics request failed",
+			Body:    []byte(""),
+		})
+		return nil
+	}
+
+	var samples []types.CustomSample
+	var rejected error
+	customMetrics := session.opts.CustomMetrics
+	if customMetrics == nil {
+		rejected = errors.New("custom metrics are not configured")
+	} else {
+		samples, rejected = customMetrics.Check(nodeId, cmReq.Samples)
+	}
+
+	if len(samples) != 0 {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		if err := store.AddCustomMetrics(ctx, nodeId, time.UnixMilli(req.Timestamp), samples); err != nil {
+			code, message := storeError(err)
+			log.Log.WithFields(logrus.Fields{
+				"node_id": nodeId,
+			}).Error("add custom metrics failed: ", err)
+			session.writeResponse(pm, nodeId, &types.WsResponse{
+				WsHeader: types.WsHeader{
+					Version:   0,
+					Timestamp: time.Now().Unix(),
+					Id:        req.Id,
+					Type:      req.Type,
+					PubKey:    []byte(""),
+					Sign:      []byte(""),
+				},
+				Code:    uint32(code),
+				Message: message,
+				Body:    []byte(""),
+			})
+			return nil
+		}
+		customMetrics.Set(nodeId, samples)
+	}
+
+	code, message := types.ErrorCode(0), "ok"
+	if rejected != nil {
+		// The accepted samples are kept, the device is told which one was rejected first
+		code = types.ErrCodeParam
+		message = fmt.Sprintf("%v of %v samples rejected, first: %v", len(cmReq.Samples)-len(samples), len(cmReq.Samples), rejected)
+		log.Log.WithFields(logrus.Fields{
+			"node_id": nodeId,
+		}).Warn(message)
+	}
+	session.writeResponse(pm, nodeId, &types.WsResponse{
+		WsHeader: types.WsHeader{
+			Version:   0,
+			Timestamp: time.Now().Unix(),
+			Id:        req.Id,
+			Type:      req.Type,
+			PubKey:    []byte(""),
+			Sign:      []byte(""),
+		},
+		Code:    uint32(code),
+		Message: message,
+		Body:    []byte(""),
+	})
+	return nil
+}
+
+func handleWsModelMetricsRequest(ctx context.Context, c *websocket.Conn, session *wsSession, req *types.WsRequest, store db.Store, pm *hmp.PrometheusMetrics) error {
+	nodeId := session.nodeId
+	if nodeId == "" {
+		log.Log.WithFields(logrus.Fields{
+			"node_id": nodeId,
+		}).Error("node id is empty, need online device first")
+		session.writeResponse(pm, nodeId, &types.WsResponse{
+			WsHeader: types.WsHeader{
+				Version:   0,
+				Timestamp: time.Now().Unix(),
+				Id:        req.Id,
+				Type:      req.Type,
+				PubKey:    []byte(""),
+				Sign:      []byte(""),
+			},
+			Code:    uint32(types.ErrCodeMachineInfo),
+			Message: "node id is empty, need send online device first",
+			Body:    []byte(""),
+		})
+		return nil
+	}
+
+	mmReq := types.WsModelMetricsRequest{}
+	err := json.Unmarshal(req.Body, &mmReq)
+	if err == nil {
+		err = mmReq.Validate()
+	}
+	if err != nil {
+		log.Log.WithFields(logrus.Fields{
+			"node_id": nodeId,
+		}).Error("parse model metrics request failed: ", err)
+		pm.ParseFailed(types.WsMtModelMetrics)
+		session.writeResponse(pm, nodeId, &types.WsResponse{
+			WsHeader: types.WsHeader{
+				Version:   0,
+				Timestamp: time.Now().Unix(),
+				Id:        req.Id,
+				Type:      req.Type,
+				PubKey:    []byte(""),
+				Sign:      []byte(""),
+			},
+			Code:    uint32(types.ErrCodeParam),
+			Message: "parse model metrics request failed",
+			Body:    []byte(""),
+		})
+		return nil
+	}
+
+	if len(mmReq.Models) != 0 {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		if err := store.AddModelMetrics(ctx, nodeId, time.UnixMilli(req.Timestamp), mmReq); err != nil {
+			code, message := storeError(err)
+			log.Log.WithFields(logrus.Fields{
+				"node_id": nodeId,
+			}).Error("add model metrics failed: ", err)
+			session.writeResponse(pm, nodeId, &types.WsResponse{
+				WsHeader: types.WsHeader{
+					Version:   0,
+					Timestamp: time.Now().Unix(),
+					Id:        req.Id,
+					Type:      req.Type,
+					PubKey:    []byte(""),
+					Sign:      []byte(""),
+				},
+				Code:    uint32(code),
+				Message: message,
+				Body:    []byte(""),
+			})
+			return nil
+		}
+	}
+
+	// An empty list removes the metrics of the models no longer served
+	pm.SetModelMetrics(nodeId, mmReq)
+	log.Log.WithFields(logrus.Fields{
+		"node_id": nodeId,
+	}).WithField("model metrics", mmReq).Info("update model metrics")
+	session.writeResponse(pm, nodeId, &types.WsResponse{
 		WsHeader: types.WsHeader{
 			Version:   0,
 			Timestamp: time.Now().Unix(),
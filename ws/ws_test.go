@@ -1,10 +1,14 @@
 package ws
 
 import (
+	"crypto/ed25519"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"testing"
 	"time"
 
+	"health-monitoring/db"
 	"health-monitoring/types"
 
 	"github.com/gorilla/websocket"
@@ -44,10 +48,24 @@ func TestWsMachine(t *testing.T) {
 		}
 	}()
 
+	// the node must always sign with the same key, which is pinned on the first online
+	seed := sha256.Sum256([]byte("123456789"))
+	privateKey := ed25519.NewKeyFromSeed(seed[:])
+
 	var reqId uint64 = 0
 
+	challengeRes := <-resChan
+	if challengeRes.Type != uint32(types.WsMtChallenge) {
+		t.Fatal("expect challenge right after connected, received", challengeRes.Type)
+	}
+	challenge := &types.WsChallenge{}
+	if err := json.Unmarshal(challengeRes.Body, challenge); err != nil {
+		t.Fatalf("parse challenge body failed: %v", err)
+	}
+
 	onlineReq := &types.WsOnlineRequest{
 		NodeId: "123456789",
+		Nonce:  challenge.Nonce,
 	}
 	reqBody, err := json.Marshal(onlineReq)
 	if err != nil {
@@ -64,6 +82,7 @@ func TestWsMachine(t *testing.T) {
 		},
 		Body: reqBody,
 	}
+	req.SignWith(privateKey)
 	reqBytes, err := json.Marshal(req)
 	if err != nil {
 		t.Fatalf("marshal online request failed: %v", err)
@@ -106,6 +125,7 @@ func TestWsMachine(t *testing.T) {
 		},
 		Body: reqBody,
 	}
+	req2.SignWith(privateKey)
 	reqBytes, err = json.Marshal(req2)
 	if err != nil {
 		t.Fatalf("marshal machine info request failed: %v", err)
@@ -131,3 +151,112 @@ func TestWsMachine(t *testing.T) {
 	case <-time.After(time.Second):
 	}
 }
+
+// go test -v -timeout 30s -count=1 -run TestVerifyWsRequest health-monitoring/ws
+func TestVerifyWsRequest(t *testing.T) {
+	seed := sha256.Sum256([]byte("123456789"))
+	privateKey := ed25519.NewKeyFromSeed(seed[:])
+	seed = sha256.Sum256([]byte("987654321"))
+	otherKey := ed25519.NewKeyFromSeed(seed[:])
+
+	now := time.Now()
+	session := &wsSession{}
+	newRequest := func(id uint64, tm time.Time, key ed25519.PrivateKey) *types.WsRequest {
+		req := &types.WsRequest{
+			WsHeader: types.WsHeader{
+				Timestamp: tm.UnixMilli(),
+				Id:        id,
+				Type:      uint32(types.WsMtMachineInfo),
+			},
+			Body: []byte(`{"project":"DecentralGPT"}`),
+		}
+		req.SignWith(key)
+		return req
+	}
+
+	if err := verifyWsRequest(session, newRequest(5, now, privateKey), now); err != nil {
+		t.Fatalf("verify valid request failed: %v", err)
+	}
+	tampered := newRequest(6, now, privateKey)
+	tampered.Body = []byte(`{"project":"other"}`)
+	if err := verifyWsRequest(session, tampered, now); !errors.Is(err, types.ErrInvalidSign) {
+		t.Fatalf("expect ErrInvalidSign of tampered request, got %v", err)
+	}
+
+	// Timestamps out of the skew window in both directions, the ids are not consumed
+	for _, tm := range []time.Time{now.Add(-defaultTimestampSkew - time.Second), now.Add(defaultTimestampSkew + time.Second)} {
+		if err := verifyWsRequest(session, newRequest(6, tm, privateKey), now); !errors.Is(err, errTimestampSkew) {
+			t.Fatalf("expect errTimestampSkew of timestamp %v, got %v", tm, err)
+		}
+	}
+
+	// Repeated ids are refused, smaller ids not seen yet are accepted out of order
+	if err := verifyWsRequest(session, newRequest(5, now, privateKey), now); !errors.Is(err, errRepeatedId) {
+		t.Fatalf("expect errRepeatedId of repeated id, got %v", err)
+	}
+	if err := verifyWsRequest(session, newRequest(4, now, privateKey), now); err != nil {
+		t.Fatalf("verify request with smaller id not seen failed: %v", err)
+	}
+	if err := verifyWsRequest(session, newRequest(4, now, privateKey), now); !errors.Is(err, errRepeatedId) {
+		t.Fatalf("expect errRepeatedId of repeated smaller id, got %v", err)
+	}
+	if err := verifyWsRequest(session, newRequest(6, now.Add(defaultTimestampSkew-time.Second), privateKey), now); err != nil {
+		t.Fatalf("verify request with increased id in the skew window failed: %v", err)
+	}
+
+	// Once online the requests must be signed by the bound key
+	session.nodeId = "123456789"
+	session.pubKey = privateKey.Public().(ed25519.PublicKey)
+	if err := verifyWsRequest(session, newRequest(7, now, otherKey), now); !errors.Is(err, db.ErrPubKeyMismatch) {
+		t.Fatalf("expect ErrPubKeyMismatch of another key, got %v", err)
+	}
+	if err := verifyWsRequest(session, newRequest(7, now, privateKey), now); err != nil {
+		t.Fatalf("verify request of the bound key failed: %v", err)
+	}
+}
+
+// go test -v -timeout 30s -count=1 -run TestIdWindow health-monitoring/ws
+func TestIdWindow(t *testing.T) {
+	w := idWindow{}
+	cases := []struct {
+		id     uint64
+		accept bool
+	}{
+		{100, true},
+		{100, false},
+		{99, true},
+		{102, true},
+		{101, true},
+		{99, false},
+		{100 + idWindowSize, true},
+		{100, false}, // 离开窗口
+		{101, false}, // 仍在窗口内，已经收到过
+		{103, true},  // 仍在窗口内，没有收到过
+		{103, false},
+		{100 + 3*idWindowSize, true},
+		{101 + 2*idWindowSize, true},
+		{100 + 2*idWindowSize, false},
+	}
+	for i, c := range cases {
+		if got := w.accept(c.id); got != c.accept {
+			t.Fatalf("case %v: accept(%v) = %v, want %v", i, c.id, got, c.accept)
+		}
+	}
+}
+
+// go test -v -timeout 30s -count=1 -run TestVerifyChallenge health-monitoring/ws
+func TestVerifyChallenge(t *testing.T) {
+	session := &wsSession{nonce: []byte("0123456789abcdef0123456789abcdef")}
+	if err := verifyChallenge(session, &types.WsOnlineRequest{NodeId: "123456789", Nonce: session.nonce}); err != nil {
+		t.Fatalf("verify nonce of the challenge failed: %v", err)
+	}
+	for _, nonce := range [][]byte{nil, []byte("0123456789abcdef0123456789abcdee")} {
+		if err := verifyChallenge(session, &types.WsOnlineRequest{NodeId: "123456789", Nonce: nonce}); !errors.Is(err, errNonceMismatch) {
+			t.Fatalf("expect errNonceMismatch of nonce %q, got %v", nonce, err)
+		}
+	}
+	// A connection without challenge accepts no online request
+	if err := verifyChallenge(&wsSession{}, &types.WsOnlineRequest{NodeId: "123456789"}); !errors.Is(err, errNonceMismatch) {
+		t.Fatalf("expect errNonceMismatch without challenge, got %v", err)
+	}
+}